@@ -1,14 +1,19 @@
-package main
+package spell
 
 import (
 	"fmt"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
-// anchorEntry maps a user-defined anchor id to the chapter file it lives in.
+// Pass 1 entries refer to their chapter rather than to its file, because
+// chapter files are only final once empty index chapters have been dropped.
+
+// anchorEntry maps a user-defined anchor id to the chapter it lives in.
 type anchorEntry struct {
-	chapterFile string
+	chapter *chapter
+	pos     sourcePos
 }
 
 // indexEntry records one occurrence of an index term in the text.
@@ -16,192 +21,353 @@ type indexEntry struct {
 	displayTerm string // text shown in the running text
 	canonical   string // key used for grouping in the index (defaults to displayTerm)
 	indexName   string
-	chapterFile string
+	chapter     *chapter
+	section     *headingNode // nearest heading before the entry, nil at the chapter start
 	htmlID      string
+
+	// A cross-reference from canonical to xref has no occurrence.
+	xref string
+	also bool // see also rather than see
+	pos  sourcePos
 }
 
 // tocEntry records one heading for the %toc command.
 type tocEntry struct {
-	level       int    // 1 for chapters (h1), 2-6 for subchapters
-	title       string // raw markdown title, inline-parsed at render time
-	chapterFile string // file the heading lives in
-	label       string // heading anchor id (label<level>_<n>)
+	level   int // 1 for chapters (h1), 2-6 for subchapters
+	title   []inline
+	chapter *chapter // chapter the heading lives in
+	label   string   // heading anchor id (label<level>_<n>); empty for the chapter heading itself
 }
 
-var (
-	// anchors maps anchor id → chapter file (populated by scanAnchorsAndIndex)
-	anchors = map[string]anchorEntry{}
-
-	// indexes maps index name → ordered list of occurrences
-	indexes = map[string][]indexEntry{}
-
-	// indexCounters tracks how many times each (indexName+term) combo has been seen
-	// during Pass 2 rendering so we can assign stable sequential IDs
-	indexCounters = map[string]int{}
-
-	// tocEntries lists all headings in document order (populated by scanAnchorsAndIndex)
-	tocEntries []tocEntry
-
-	// footnoteDefs maps a footnote id to its (raw markdown) definition text,
-	// collected in Pass 1 so a reference may appear before its definition.
-	footnoteDefs = map[string]string{}
+// figureEntry records one figure for numbering and the lists of figures.
+type figureEntry struct {
+	figure  *figureNode
+	chapter *chapter // chapter the figure lives in
+}
 
-	// Per-chapter footnote state, reset whenever a chapter is finalized.
-	footnoteNum      int            // last number assigned in the current chapter
-	footnoteAssigned = map[string]int{}
-	pendingFootnotes []pendingNote
-)
+// tableEntry records one table with a caption for the lists of tables.
+type tableEntry struct {
+	table   *tableNode
+	chapter *chapter // chapter the table lives in
+}
 
 // pendingNote is a footnote referenced in the current chapter and awaiting
-// emission as an <aside> when the chapter is finalized.
+// emission as an <aside> when the chapter is finalized, or an endnote
+// waiting for the %endnotes chapter.
 type pendingNote struct {
 	chap int    // chapter number (for globally unique ids)
-	num  int    // display number within the chapter
+	num  int    // display number within the chapter, or within the book
 	id   string // author-supplied footnote id
+	file string // file of the reference, the target of the back-link
+
+	// Endnotes only: the chapter they are listed under and their text,
+	// rendered when their chapter is finalized.
+	chapter *chapter
+	text    string
 }
 
 var (
-	reAnchorDef   = regexp.MustCompile(`\{#([a-zA-Z0-9_-]+)\}`)
-	reAnchorLink  = regexp.MustCompile(`\[([^\]]+)\]\(#([a-zA-Z0-9_-]+)\)`)
+	reAnchorDef  = regexp.MustCompile(`\{#([a-zA-Z0-9_-]+)\}`)
+	reAnchorLink = regexp.MustCompile(`\[([^\]]+)\]\(#([a-zA-Z0-9_-]+)\)`)
 	// %[displayTerm](indexname) or %[displayTerm](indexname|canonical)
 	reIndexEntry = regexp.MustCompile(`%\[([^\]]+)\]\(([^)|]+)(?:\|([^)]+))?\)`)
-	// %index[name] or %index[name](Title)
-	reIndexOutput = regexp.MustCompile(`^%index\[([^\]]+)\](?:\(([^)]+)\))?$`)
+	// %see[term](indexname|target) or %seealso[term](indexname|target)
+	reIndexXref = regexp.MustCompile(`%(see|seealso)\[([^\]]+)\]\(([^)|]+)\|([^)]+)\)`)
+	// %index[name] or %index[name](Title), optionally followed by {options}
+	reIndexOutput = regexp.MustCompile(`^%index\[([^\]]+)\](?:\(([^)]+)\))?\s*(?:\{(.*)\})?$`)
 	// %toc or %toc(Title)
 	reTocOutput = regexp.MustCompile(`^%toc(?:\(([^)]+)\))?$`)
+	// %figures or %figures(Title)
+	reFiguresOutput = regexp.MustCompile(`^%figures(?:\(([^)]+)\))?$`)
+	// %tables or %tables(Title)
+	reTablesOutput = regexp.MustCompile(`^%tables(?:\(([^)]+)\))?$`)
+	// %endnotes or %endnotes(Title), optionally followed by {options}
+	reEndnotesOutput = regexp.MustCompile(`^%endnotes(?:\(([^)]+)\))?\s*(?:\{(.*)\})?$`)
 	// [^id]: definition text  (a footnote definition line)
 	reFootnoteDef = regexp.MustCompile(`^\s*\[\^([a-zA-Z0-9_-]+)\]:\s*(.*)$`)
 	// [^id]  (an inline footnote reference)
 	reFootnoteRef = regexp.MustCompile(`\[\^([a-zA-Z0-9_-]+)\]`)
+	// [@fig:id]  (a reference to a figure)
+	reFigureRef = regexp.MustCompile(`\[@fig:([a-zA-Z0-9_-]+)\]`)
 )
 
-// resetAnchors clears all anchor/index state so processMarkdownFile is idempotent.
-func resetAnchors() {
-	anchors = map[string]anchorEntry{}
-	indexes = map[string][]indexEntry{}
-	indexCounters = map[string]int{}
-	tocEntries = nil
-	footnoteDefs = map[string]string{}
-	footnoteNum = 0
-	footnoteAssigned = map[string]int{}
-	pendingFootnotes = nil
-}
-
 // chapterFileForNumber returns the deterministic XHTML filename for a chapter number.
 func chapterFileForNumber(n int) string {
 	return fmt.Sprintf("xhtml/chapter_%05d.xhtml", n)
 }
 
-// scanAnchorsAndIndex performs Pass 1: walks all lines of the fully-included
-// content, tracks chapter numbering exactly as Pass 2 rendering does
-// (including the chapters generated by %toc and non-empty %index commands),
-// and populates the anchors, indexes and tocEntries collections.
-func scanAnchorsAndIndex(content string) {
-	lines := reNewline.Split(content, -1)
+// labelFor returns the anchor id of the n-th heading of the given level.
+func labelFor(level, n int) string {
+	return fmt.Sprintf("label%d_%d", level, n)
+}
 
-	// Sub-pass A: count entries per index name, so we know which %index
-	// commands will produce a chapter (empty indexes are skipped in Pass 2).
-	indexEntryCount := map[string]int{}
-	for _, line := range lines {
-		for _, m := range reIndexEntry.FindAllStringSubmatch(line, -1) {
-			indexEntryCount[m[2]]++
+// numberChapters assigns the final chapter numbers and files in document
+// order, after Pass 1. An %index command whose index has no entries produces
+// no chapter, and neither does %toc in a book without chapters, %endnotes
+// in a book without footnotes or %figures and %tables in a book without
+// figures or captioned tables; the blocks
+// written after such a command stay with the chapter before it.
+func numberChapters(ctx *parseContext, doc *document) {
+	hasChapters := false
+	for _, c := range doc.chapters {
+		if c.kind == chapterText || (c.kind == chapterIndex && len(ctx.indexes[c.indexName]) > 0) {
+			hasChapters = true
 		}
 	}
 
-	// Sub-pass B: mirror Pass 2 chapter numbering and collect everything.
-	// levelNum mirrors currentChapterNumber: index 1 counts chapters (h1,
-	// %toc, non-empty %index), indices 2-6 count subchapter headings.
-	var levelNum [7]int
-	for _, line := range lines {
+	var kept []*chapter
+	for _, c := range doc.chapters {
 		switch {
-		case reChapter.MatchString(line):
-			m := reChapter.FindStringSubmatch(line)
-			levelNum[1]++
-			tocEntries = append(tocEntries, tocEntry{
-				level:       1,
-				title:       m[2],
-				chapterFile: chapterFileForNumber(levelNum[1]),
-				label:       fmt.Sprintf("label1_%d", levelNum[1]),
-			})
-		case reHeadlines.MatchString(line):
-			m := reHeadlines.FindStringSubmatch(line)
-			level := strings.Count(m[1], "#")
-			levelNum[level]++
-			if levelNum[1] > 0 { // headings before the first chapter have no file
-				tocEntries = append(tocEntries, tocEntry{
-					level:       level,
-					title:       m[2],
-					chapterFile: chapterFileForNumber(levelNum[1]),
-					label:       fmt.Sprintf("label%d_%d", level, levelNum[level]),
-				})
+		case c.kind == chapterIndex && len(ctx.indexes[c.indexName]) == 0:
+			ctx.warnAt(c.pos, "no index entries found for %q", c.indexName)
+		case c.kind == chapterTOC && !hasChapters:
+			ctx.warnAt(c.pos, "%%toc found but the book has no chapters")
+		case c.kind == chapterEndnotes && len(ctx.footnoteDefs) == 0:
+			ctx.warnAt(c.pos, "%%endnotes found but the book has no footnotes")
+			ctx.endnotesChapter = nil
+		case c.kind == chapterFigures && len(ctx.figures) == 0:
+			ctx.warnAt(c.pos, "%%figures found but the book has no figures")
+		case c.kind == chapterTables && len(ctx.tables) == 0:
+			ctx.warnAt(c.pos, "%%tables found but the book has no tables with a caption")
+		default:
+			kept = append(kept, c)
+			c.number = len(kept)
+			c.file = chapterFileForNumber(c.number)
+			continue
+		}
+		c.dropped = true
+		if len(kept) > 0 {
+			prev := kept[len(kept)-1]
+			prev.blocks = append(prev.blocks, c.blocks...)
+			c.mergedInto = prev
+		} else {
+			doc.preamble = append(doc.preamble, c.blocks...)
+		}
+	}
+	doc.chapters = kept
+
+	var entries []tocEntry
+	for _, e := range ctx.tocEntries {
+		if e.label == "" && e.chapter.dropped {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	ctx.tocEntries = entries
+}
+
+// numberFigures numbers the figures after numberChapters: per chapter as
+// 3.2, counting only the chapters with a # title, or through the book if the
+// book says $[figure-numbering](global). Figures before the first chapter
+// are numbered through the book either way.
+func numberFigures(ctx *parseContext, doc *document) {
+	global := false
+	for _, b := range doc.preamble {
+		if m, ok := b.(*metaNode); ok && m.key == "figure-numbering" {
+			switch m.value {
+			case "chapter", "global":
+				global = m.value == "global"
+			default:
+				ctx.warnAt(m.pos, "figure numbering must be chapter or global, got %q", m.value)
 			}
-		case reTocOutput.MatchString(line):
-			levelNum[1]++ // the TOC chapter itself; not listed as an entry
-		case reIndexOutput.MatchString(line):
-			m := reIndexOutput.FindStringSubmatch(line)
-			if indexEntryCount[m[1]] > 0 {
-				levelNum[1]++
-				title := m[2]
-				if title == "" {
-					title = m[1]
+		}
+	}
+
+	ordinals := map[*chapter]int{}
+	n := 0
+	for _, c := range doc.chapters {
+		if c.kind == chapterText {
+			n++
+		}
+		ordinals[c] = n
+	}
+	counts := map[int]int{}
+	for _, e := range ctx.figures {
+		c := e.chapter
+		if c.mergedInto != nil {
+			c = c.mergedInto
+		}
+		ordinal := ordinals[c]
+		if global {
+			ordinal = 0
+		}
+		counts[ordinal]++
+		if ordinal == 0 {
+			e.figure.number = strconv.Itoa(counts[ordinal])
+		} else {
+			e.figure.number = fmt.Sprintf("%d.%d", ordinal, counts[ordinal])
+		}
+		ctx.logMsg(LogVerbose, "Figure %s registered as %s", e.figure.number, e.figure.id)
+	}
+}
+
+// startChapterNumbers gives every chapter a provisional number and file,
+// used by Pass 1 log messages until numberChapters assigns the final ones.
+func startChapterNumbers(doc *document) {
+	for i, c := range doc.chapters {
+		c.number = i + 1
+		c.file = chapterFileForNumber(c.number)
+	}
+}
+
+// scanAnchorsAndIndex performs Pass 1: walks the document tree and
+// populates the anchors, indexes, tocEntries and footnoteDefs collections of
+// ctx, assigns the ids of all index terms and calls the Scan function of
+// custom commands.
+func scanAnchorsAndIndex(ctx *parseContext, doc *document) {
+	indexCounters := map[string]int{} // per (indexName+term) sequence for stable ids
+	var section *headingNode
+	scanInlines := func(c *chapter, nodes []inline) {
+		walkInlines(nodes, func(n inline) {
+			switch n := n.(type) {
+			case *anchorDefNode:
+				// Collect {#id} anchor definitions.
+				addAnchor(ctx, n.id, c, n.pos)
+			case *imageNode:
+				if n.id != "" {
+					addAnchor(ctx, n.id, c, n.pos)
 				}
-				tocEntries = append(tocEntries, tocEntry{
-					level:       1,
-					title:       title,
-					chapterFile: chapterFileForNumber(levelNum[1]),
-					label:       fmt.Sprintf("label1_%d", levelNum[1]),
+			case *indexTermNode:
+				// Collect %[displayTerm](indexname|canonical) entries.
+				key := n.index + "\x00" + n.canonical
+				seq := indexCounters[key]
+				indexCounters[key]++
+				n.id = fmt.Sprintf("idx-%s-%s-%d", sanitizeID(n.index), sanitizeID(n.canonical), seq)
+				displayTerm := inlineText(n.children)
+				ctx.indexes[n.index] = append(ctx.indexes[n.index], indexEntry{
+					displayTerm: displayTerm,
+					canonical:   n.canonical,
+					indexName:   n.index,
+					chapter:     c,
+					section:     section,
+					htmlID:      n.id,
+				})
+				ctx.logMsg(LogVerbose, "Index entry %q → %q (%s) registered as %s in %s", displayTerm, n.canonical, n.index, n.id, c.file)
+			case *indexXrefNode:
+				ctx.indexes[n.index] = append(ctx.indexes[n.index], indexEntry{
+					canonical: n.term,
+					indexName: n.index,
+					xref:      n.target,
+					also:      n.also,
+					pos:       n.pos,
 				})
+			case *commandNode:
+				scanCommand(ctx, c, n.match)
 			}
-		}
-
-		currentFile := chapterFileForNumber(levelNum[1])
+		})
+	}
 
-		// Collect [^id]: footnote definitions (so a reference may precede its
-		// definition). A definition line yields no inline output in Pass 2.
-		if m := reFootnoteDef.FindStringSubmatch(line); m != nil {
-			if _, exists := footnoteDefs[m[1]]; exists {
-				logMsg(LogDefault, "WARNING: duplicate footnote id %q (second definition ignored)", m[1])
-			} else {
-				footnoteDefs[m[1]] = m[2]
-				logMsg(LogVerbose, "Footnote %q registered", m[1])
+	// scanBlocks collects the blocks of chapter c. The blocks of a footnote
+	// are collected too, for the chapter its text lands in; their headings
+	// do not go in the TOC.
+	var scanBlocks func(c *chapter, blocks []block, inNote bool)
+	scanBlocks = func(c *chapter, blocks []block, inNote bool) {
+		for _, b := range blocks {
+			switch b := b.(type) {
+			case *headingNode:
+				if inNote {
+					break
+				}
+				section = b
+				ctx.tocEntries = append(ctx.tocEntries, tocEntry{
+					level:   b.level,
+					title:   b.title,
+					chapter: c,
+					label:   b.label,
+				})
+			case *tableNode:
+				addAnchor(ctx, b.id, c, b.pos)
+				if b.caption != nil {
+					ctx.tables = append(ctx.tables, tableEntry{table: b, chapter: c})
+				}
+			case *figureNode:
+				addAnchor(ctx, b.id, c, b.pos)
+				ctx.figures = append(ctx.figures, figureEntry{figure: b, chapter: c})
+			case *footnoteDefNode:
+				registerFootnote(ctx, b)
+				if nc := noteChapter(ctx, doc, c); nc != c {
+					saved := section
+					section = nil
+					scanBlocks(nc, b.blocks, true)
+					section = saved
+				} else {
+					scanBlocks(c, b.blocks, true)
+				}
+				continue
+			case *commandNode:
+				scanCommand(ctx, c, b.match)
+			}
+			for _, nodes := range blockInlines(b) {
+				scanInlines(c, nodes)
 			}
-			continue
 		}
+	}
 
-		// Collect {#id} anchor definitions.
-		for _, m := range reAnchorDef.FindAllStringSubmatch(line, -1) {
-			id := m[1]
-			if _, exists := anchors[id]; exists {
-				logMsg(LogDefault, "WARNING: duplicate anchor id %q (second occurrence in %s ignored)", id, currentFile)
+	// Footnotes may be defined anywhere, even before the first chapter.
+	for _, b := range doc.preamble {
+		if d, ok := b.(*footnoteDefNode); ok {
+			if len(doc.chapters) == 0 {
+				registerFootnote(ctx, d)
 				continue
 			}
-			anchors[id] = anchorEntry{chapterFile: currentFile}
-			logMsg(LogVerbose, "Anchor %q registered in %s", id, currentFile)
+			scanBlocks(doc.chapters[0], []block{d}, true)
 		}
+	}
 
-		// Collect %[displayTerm](indexname) or %[displayTerm](indexname|canonical) entries.
-		for _, m := range reIndexEntry.FindAllStringSubmatch(line, -1) {
-			displayTerm, indexName, canonical := m[1], m[2], m[3]
-			if canonical == "" {
-				canonical = displayTerm
-			}
-			key := indexName + "\x00" + canonical
-			seq := indexCounters[key]
-			indexCounters[key]++
-			htmlID := fmt.Sprintf("idx-%s-%s-%d", sanitizeID(indexName), sanitizeID(canonical), seq)
-			indexes[indexName] = append(indexes[indexName], indexEntry{
-				displayTerm: displayTerm,
-				canonical:   canonical,
-				indexName:   indexName,
-				chapterFile: currentFile,
-				htmlID:      htmlID,
-			})
-			logMsg(LogVerbose, "Index entry %q → %q (%s) registered as %s in %s", displayTerm, canonical, indexName, htmlID, currentFile)
+	for _, c := range doc.chapters {
+		section = nil
+		if c.kind != chapterTOC { // the TOC does not list itself
+			ctx.tocEntries = append(ctx.tocEntries, tocEntry{level: 1, title: c.title, chapter: c})
 		}
+		scanInlines(c, c.title)
+		scanBlocks(c, c.blocks, false)
 	}
+}
 
-	// Reset counters; Pass 2 rendering uses the same deterministic formula.
-	indexCounters = map[string]int{}
+// noteChapter returns the chapter the text of a footnote defined in chapter
+// c lands in: the %endnotes chapter if c comes before it, else c itself.
+func noteChapter(ctx *parseContext, doc *document, c *chapter) *chapter {
+	if ctx.endnotesChapter == nil {
+		return c
+	}
+	for _, d := range doc.chapters {
+		switch d {
+		case c:
+			return ctx.endnotesChapter
+		case ctx.endnotesChapter:
+			return c
+		}
+	}
+	return c
+}
+
+// scanCommand hands an occurrence of a custom command to its Scan function.
+func scanCommand(ctx *parseContext, c *chapter, m *Match) {
+	if m.Command.Scan != nil {
+		m.Command.Scan(&ScanContext{ctx: ctx, chapter: c, match: m}, m)
+	}
+}
+
+// addAnchor registers anchor id, defined at pos in chapter c; the first
+// definition wins.
+func addAnchor(ctx *parseContext, id string, c *chapter, pos sourcePos) {
+	if first, exists := ctx.anchors[id]; exists {
+		ctx.warnAt(pos, "duplicate anchor id %q ignored, first defined at %s", id, first.pos)
+		return
+	}
+	ctx.anchors[id] = anchorEntry{chapter: c, pos: pos}
+	ctx.logMsg(LogVerbose, "Anchor %q registered in %s", id, c.file)
+}
+
+// registerFootnote collects a [^id]: definition, so a reference may precede
+// its definition.
+func registerFootnote(ctx *parseContext, d *footnoteDefNode) {
+	if first, exists := ctx.footnoteDefs[d.id]; exists {
+		ctx.warnAt(d.pos, "duplicate footnote id %q ignored, first defined at %s", d.id, first.pos)
+		return
+	}
+	ctx.footnoteDefs[d.id] = d
+	ctx.logMsg(LogVerbose, "Footnote %q registered", d.id)
 }
 
 // sanitizeID converts a string to a safe HTML id fragment.
@@ -218,16 +384,14 @@ func sanitizeID(s string) string {
 	return strings.Trim(b.String(), "-")
 }
 
-// resolveAnchorHref returns the href value for a link to anchorID from currentChapterFile.
-// In AZW3 mode all chapters form one concatenated document, so all links are plain #id.
-func resolveAnchorHref(ctx *parseContext, anchorID, currentChapterFile string) string {
-	entry, ok := anchors[anchorID]
+// resolveAnchorHref returns the href value for a link to anchorID from
+// currentChapterFile; at is the position of the link, for the warning if
+// the anchor does not exist.
+func resolveAnchorHref(ctx *parseContext, anchorID, currentChapterFile string, at sourcePos) string {
+	entry, ok := ctx.anchors[anchorID]
 	if !ok {
-		logMsg(LogDefault, "WARNING: anchor %q not found", anchorID)
-		return "#" + anchorID
-	}
-	if ctx.azw3Mode || entry.chapterFile == currentChapterFile {
+		ctx.warnAt(at, "anchor %q not found", anchorID)
 		return "#" + anchorID
 	}
-	return "../" + entry.chapterFile + "#" + anchorID
+	return ctx.format.href(entry.chapter.fileName(), anchorID, currentChapterFile)
 }
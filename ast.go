@@ -0,0 +1,403 @@
+package spell
+
+import "strings"
+
+// The document tree sits between parsing and rendering. parseDocument turns
+// the fully-included markdown into a document, scanAnchorsAndIndex collects
+// anchors, index terms, headings and footnotes from it (Pass 1) and a
+// renderer writes it into the book (Pass 2). Nodes carry no HTML: everything
+// that differs between output formats is decided by the renderer.
+
+// document is the root of the tree.
+type document struct {
+	preamble []block // blocks before the first chapter; only meta and cover take effect
+	chapters []*chapter
+}
+
+type chapterKind int
+
+const (
+	chapterText     chapterKind = iota // a "# Title" chapter
+	chapterTOC                         // generated by %toc
+	chapterIndex                       // generated by %index[name]
+	chapterEndnotes                    // generated by %endnotes
+	chapterFigures                     // generated by %figures
+	chapterTables                      // generated by %tables
+)
+
+// chapter is one XHTML file of the book. Generated chapters (TOC, index, notes, lists)
+// render their generated body first, followed by any blocks written between
+// the command and the next chapter.
+type chapter struct {
+	kind      chapterKind
+	number    int      // chapter number, final once numberChapters ran
+	file      string   // XHTML file name, final once numberChapters ran
+	title     []inline // heading text; a single textNode for generated chapters
+	indexName string   // chapterIndex only
+	index     indexOptions
+	numbering string // chapterEndnotes only: "chapter" or "continuous"
+	blocks    []block
+	pos       sourcePos // the # line or command starting the chapter
+
+	dropped    bool     // not written, see numberChapters
+	mergedInto *chapter // chapter the blocks of a dropped chapter were moved to
+}
+
+// indexOptions are the {options} of an %index command.
+type indexOptions struct {
+	jumpBar  bool   // link the letter groups from the top
+	locators string // "chapter", "section" or "number"
+}
+
+// fileName returns the file the content of c ends up in, following a
+// dropped chapter to the chapter its blocks were moved to.
+func (c *chapter) fileName() string {
+	if c.mergedInto != nil {
+		return c.mergedInto.file
+	}
+	if c.dropped {
+		return ""
+	}
+	return c.file
+}
+
+// block is a block-level node inside a chapter.
+type block interface{ isBlock() }
+
+// headingNode is a "##" to "######" subchapter heading.
+type headingNode struct {
+	level int
+	label string // anchor id, label<level>_<n>
+	title []inline
+}
+
+// paragraphNode holds the source lines of one paragraph, each parsed
+// separately and joined by a space when rendered.
+type paragraphNode struct {
+	lines [][]inline
+}
+
+// rawBlockNode is a line that starts with a block-level HTML tag. It is
+// written as-is instead of being wrapped in a paragraph.
+type rawBlockNode struct {
+	content []inline
+}
+
+// imageLineNode is a line of images and nothing else. It is rendered as
+// its own block and restarts first-paragraph styling.
+type imageLineNode struct {
+	content []inline
+}
+
+// figureNode is an image alone on its line with a title or an {#id}: a
+// numbered figure with the title as its caption. number is set by
+// numberFigures.
+type figureNode struct {
+	id      string // anchor of the figure, from {#id} or figure-<n>
+	image   *imageNode
+	caption []inline
+	number  string // "3.2" or "7"
+	pos     sourcePos
+}
+
+// blockquoteNode is a ```cite, ```note, ```info or ```warn block. class is
+// the lowercased fence tag. Blank lines split the content into paragraphs.
+type blockquoteNode struct {
+	class      string
+	paragraphs []*paragraphNode
+}
+
+// codeBlockNode is any other ``` fence. Its lines are kept exactly, blank
+// lines included, and highlighted when rendered if lang is known.
+type codeBlockNode struct {
+	lang        string // lowercased fence tag; "" for a plain code fence
+	title       string // caption, e.g. the file name
+	lines       []string
+	tabWidth    int
+	wrap        bool // wrap long lines instead of scrolling them
+	lineNumbers bool // number the lines, starting at start
+	start       int
+	highlight   []lineRange // lines to emphasize
+	pos         sourcePos
+}
+
+// lineRange is a range of lines, 1-based and inclusive; 0 leaves that end
+// open.
+type lineRange struct{ first, last int }
+
+// listNode is a bullet or ordered list. Nested lists hang off their item.
+type listNode struct {
+	ordered bool
+	start   int // first ordinal of an ordered list
+	items   []*listItem
+}
+
+type listItem struct {
+	content  []inline
+	sublists []*listNode
+}
+
+// tableNode is a pipe table. header is nil for a table without header row.
+type tableNode struct {
+	id      string   // anchor of the table, from the caption or table-<n>
+	caption []inline // nil if the table has no Table: line
+	align   []string // per column: "", "left", "center" or "right"
+	header  [][]inline
+	rows    [][][]inline
+	pos     sourcePos
+}
+
+type dividerNode struct{}
+type pagebreakNode struct{}
+
+// metaNode is a $[key](value) line or a value of the front matter. attrs
+// holds the further fields of an author or contributor given as a table.
+type metaNode struct {
+	key, value string
+	attrs      map[string]string
+	pos        sourcePos
+}
+
+// coverNode is a ![cover](src) line.
+type coverNode struct {
+	src string
+	pos sourcePos
+}
+
+// footnoteDefNode is a [^id]: text line and the lines indented below it,
+// parsed into blocks of their own. It renders nothing where it stands; the
+// note is emitted at the end of the chapter that references it.
+type footnoteDefNode struct {
+	id     string
+	pos    sourcePos
+	blocks []block
+}
+
+// commandNode is an occurrence of a custom command, see Command. It is a
+// block or an inline node depending on the command.
+type commandNode struct {
+	match *Match
+}
+
+func (*headingNode) isBlock()     {}
+func (*paragraphNode) isBlock()   {}
+func (*rawBlockNode) isBlock()    {}
+func (*imageLineNode) isBlock()   {}
+func (*figureNode) isBlock()      {}
+func (*blockquoteNode) isBlock()  {}
+func (*codeBlockNode) isBlock()   {}
+func (*listNode) isBlock()        {}
+func (*tableNode) isBlock()       {}
+func (*dividerNode) isBlock()     {}
+func (*pagebreakNode) isBlock()   {}
+func (*metaNode) isBlock()        {}
+func (*coverNode) isBlock()       {}
+func (*footnoteDefNode) isBlock() {}
+func (*commandNode) isBlock()     {}
+
+// inline is a node inside a line of text.
+type inline interface{ isInline() }
+
+// textNode is running text; typography (dashes, ellipsis) is applied when
+// it is rendered.
+type textNode struct {
+	text string
+}
+
+type codeSpanNode struct {
+	text string
+}
+
+type boldNode struct {
+	children []inline
+}
+
+type italicNode struct {
+	children []inline
+}
+
+// quoteNode is one of the explicit quote markers %" "% %' '%, or a straight
+// quote of the text (auto) that smart quotes turn into one of them or into
+// an apostrophe, marker "'".
+type quoteNode struct {
+	marker string
+	auto   bool
+}
+
+// linkNode is an external link [text](href "title").
+type linkNode struct {
+	href, title string
+	children    []inline
+}
+
+// anchorLinkNode is an internal link [text](#id).
+type anchorLinkNode struct {
+	id       string
+	pos      sourcePos
+	children []inline
+}
+
+// anchorDefNode is an anchor definition {#id}.
+type anchorDefNode struct {
+	id  string
+	pos sourcePos
+}
+
+// indexTermNode is %[display](index) or %[display](index|canonical). id is
+// assigned in Pass 1. A canonical term like "lantern > oil" is a sub-entry.
+type indexTermNode struct {
+	index, canonical string
+	id               string
+	children         []inline
+}
+
+// indexXrefNode is a cross-reference %see[term](index|target) or
+// %seealso[term](index|target). It adds to the index only and renders
+// nothing.
+type indexXrefNode struct {
+	index, term, target string
+	also                bool
+	pos                 sourcePos
+}
+
+// footnoteRefNode is a footnote reference [^id].
+type footnoteRefNode struct {
+	id  string
+	pos sourcePos
+}
+
+// figureRefNode is a reference [@fig:id] to a figure, rendered as its number.
+type figureRefNode struct {
+	id  string
+	pos sourcePos
+}
+
+// imageNode is an image ![alt](src "title"), optionally followed by an
+// attribute block like {#id width=40% align=right}.
+type imageNode struct {
+	alt, src, title string
+	id              string
+	attrs           imageAttrs
+	source          string // the markdown it was parsed from, written back if the image fails to load
+	pos             sourcePos
+}
+
+// imageAttrs are the presentation attributes of an image.
+type imageAttrs struct {
+	width    int    // percentage of the page, 0 for the natural size
+	align    string // "left", "center" or "right"
+	float    string // "left" or "right": text flows around the image
+	icon     bool   // as high as the text around it
+	fullPage bool   // on a page of its own
+}
+
+func (*textNode) isInline()        {}
+func (*codeSpanNode) isInline()    {}
+func (*boldNode) isInline()        {}
+func (*italicNode) isInline()      {}
+func (*quoteNode) isInline()       {}
+func (*linkNode) isInline()        {}
+func (*anchorLinkNode) isInline()  {}
+func (*anchorDefNode) isInline()   {}
+func (*indexTermNode) isInline()   {}
+func (*indexXrefNode) isInline()   {}
+func (*footnoteRefNode) isInline() {}
+func (*figureRefNode) isInline()   {}
+func (*imageNode) isInline()       {}
+func (*commandNode) isInline()     {}
+
+// walkInlines calls fn for every inline node in nodes, depth first and in
+// document order.
+func walkInlines(nodes []inline, fn func(inline)) {
+	for _, n := range nodes {
+		fn(n)
+		switch n := n.(type) {
+		case *boldNode:
+			walkInlines(n.children, fn)
+		case *italicNode:
+			walkInlines(n.children, fn)
+		case *linkNode:
+			walkInlines(n.children, fn)
+		case *anchorLinkNode:
+			walkInlines(n.children, fn)
+		case *indexTermNode:
+			walkInlines(n.children, fn)
+		}
+	}
+}
+
+// blockInlines returns the inline sequences of b in document order.
+func blockInlines(b block) [][]inline {
+	switch b := b.(type) {
+	case *headingNode:
+		return [][]inline{b.title}
+	case *paragraphNode:
+		return b.lines
+	case *rawBlockNode:
+		return [][]inline{b.content}
+	case *imageLineNode:
+		return [][]inline{b.content}
+	case *figureNode:
+		return [][]inline{b.caption}
+	case *blockquoteNode:
+		var out [][]inline
+		for _, p := range b.paragraphs {
+			out = append(out, p.lines...)
+		}
+		return out
+	case *listNode:
+		var out [][]inline
+		for _, it := range b.items {
+			out = append(out, it.content)
+			for _, sub := range it.sublists {
+				out = append(out, blockInlines(sub)...)
+			}
+		}
+		return out
+	case *tableNode:
+		out := [][]inline{b.caption}
+		out = append(out, b.header...)
+		for _, row := range b.rows {
+			out = append(out, row...)
+		}
+		return out
+	case *footnoteDefNode:
+		var out [][]inline
+		for _, sub := range b.blocks {
+			out = append(out, blockInlines(sub)...)
+		}
+		return out
+	}
+	return nil
+}
+
+// chapterInlines returns the inline sequences of c in document order: its
+// title, then its blocks. Footnote definitions are left out, they are
+// rendered in the chapter that references them.
+func chapterInlines(c *chapter) [][]inline {
+	out := [][]inline{c.title}
+	for _, b := range c.blocks {
+		if _, ok := b.(*footnoteDefNode); ok {
+			continue
+		}
+		out = append(out, blockInlines(b)...)
+	}
+	return out
+}
+
+// inlineText returns the text of nodes without any markup, e.g. for log
+// messages.
+func inlineText(nodes []inline) string {
+	var b strings.Builder
+	walkInlines(nodes, func(n inline) {
+		switch n := n.(type) {
+		case *textNode:
+			b.WriteString(n.text)
+		case *codeSpanNode:
+			b.WriteString(n.text)
+		case *imageNode:
+			b.WriteString(n.alt)
+		}
+	})
+	return b.String()
+}
@@ -0,0 +1,30 @@
+package spell
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// reAttribute matches one entry of an attribute block: key=value,
+// key="quoted value" or a bare key.
+var reAttribute = regexp.MustCompile(`^([a-zA-Z][a-zA-Z0-9_-]*)(?:=(?:"([^"]*)"|([^\s"]*)))?(?:\s+|$)`)
+
+// parseAttributes parses the content of an attribute block like
+// {shift=1 from="// start"}. A bare key has the value "".
+func parseAttributes(s string) (map[string]string, error) {
+	attrs := map[string]string{}
+	s = strings.TrimSpace(s)
+	for s != "" {
+		m := reAttribute.FindStringSubmatch(s)
+		if m == nil {
+			return nil, fmt.Errorf("invalid attribute %q", s)
+		}
+		if _, dup := attrs[m[1]]; dup {
+			return nil, fmt.Errorf("attribute %s given twice", m[1])
+		}
+		attrs[m[1]] = m[2] + m[3]
+		s = s[len(m[0]):]
+	}
+	return attrs, nil
+}
@@ -1,4 +1,4 @@
-package main
+package spell
 
 import (
 	"encoding/binary"
@@ -19,9 +19,14 @@ func (n *azw3Navpoint) AddNavpoint(label, target string, order int) NavpointAdde
 }
 
 // azw3Book wraps *azw3.Book to implement SpellBook.
-type azw3Book struct{ book *azw3.Book }
+type azw3Book struct {
+	book *azw3.Book
+	// verbose, when set, logs the metadata that KF8 cannot hold.
+	verbose func(format string, args ...any)
+}
 
-func newAZW3Book() *azw3Book { return &azw3Book{book: azw3.New()} }
+// NewAZW3Book returns an empty AZW3 (KF8) book.
+func NewAZW3Book() SpellBook { return &azw3Book{book: azw3.New()} }
 
 func (b *azw3Book) SetTitle(title string)        { b.book.SetTitle(title) }
 func (b *azw3Book) AddAuthor(author string)       { b.book.AddAuthor(author) }
@@ -35,23 +40,95 @@ func (b *azw3Book) AddLanguage(lang string) error { return b.book.AddLanguage(la
 // alternative is folding the series into the title, which was deliberately
 // declined so the displayed title stays clean. Do not "fix" these into title
 // mangling without revisiting that decision.
-func (b *azw3Book) SetSeries(_ string) error      { return nil }
-func (b *azw3Book) SetSet(_ string) error         { return nil }
-func (b *azw3Book) SetEntryNumber(_ string) error { return nil }
+func (b *azw3Book) SetSeries(s string) error      { b.drop("series", s); return nil }
+func (b *azw3Book) SetSet(s string) error         { b.drop("set", s); return nil }
+func (b *azw3Book) SetEntryNumber(n string) error { b.drop("entry", n); return nil }
+
+// SetUUID derives the uint32 unique ID of the MOBI header from the first 4
+// bytes of the UUID hex digits and keeps the whole UUID as the ASIN (EXTH
+// 113), which Kindles use to tell books apart, as calibre does.
 func (b *azw3Book) SetUUID(uu string) error {
-	// Derive a uint32 from the first 4 bytes of the UUID hex digits.
 	clean := strings.ReplaceAll(uu, "-", "")
 	if len(clean) >= 8 {
 		if raw, err := hex.DecodeString(clean[:8]); err == nil {
 			b.book.SetUniqueID(binary.BigEndian.Uint32(raw))
 		}
 	}
+	b.setEXTH("ASIN", uu, func(m azw3EXTH) { m.SetASIN(uu) })
+	return nil
+}
+
+// azw3EXTH are the setters of the EXTH records Kindle libraries show: rights
+// (109), source (112), ASIN (113), publisher (101), description (103), ISBN
+// (104) and subjects (105). Versions of the azw3 library without them drop
+// the values, which is logged.
+type azw3EXTH interface {
+	SetRights(string)
+	SetSource(string)
+	SetASIN(string)
+	SetPublisher(string)
+	SetDescription(string)
+	SetISBN(string)
+	AddSubject(string)
+}
+
+// setEXTH writes value with set if the azw3 library has the EXTH setters.
+func (b *azw3Book) setEXTH(key, value string, set func(azw3EXTH)) {
+	if m, ok := any(b.book).(azw3EXTH); ok {
+		set(m)
+		return
+	}
+	b.logf("The azw3 library cannot write the %s record, dropped %q", key, value)
+}
+
+func (b *azw3Book) AddRights(rights string) {
+	b.setEXTH("rights", rights, func(m azw3EXTH) { m.SetRights(rights) })
+}
+func (b *azw3Book) AddSource(source string) {
+	b.setEXTH("source", source, func(m azw3EXTH) { m.SetSource(source) })
+}
+func (b *azw3Book) SetPublisher(p string) {
+	b.setEXTH("publisher", p, func(m azw3EXTH) { m.SetPublisher(p) })
+}
+func (b *azw3Book) SetDescription(d string) {
+	b.setEXTH("description", d, func(m azw3EXTH) { m.SetDescription(d) })
+}
+func (b *azw3Book) AddSubject(s string) {
+	b.setEXTH("subject", s, func(m azw3EXTH) { m.AddSubject(s) })
+}
+func (b *azw3Book) SetISBN(isbn string) error {
+	b.setEXTH("ISBN", isbn, func(m azw3EXTH) { m.SetISBN(isbn) })
 	return nil
 }
-func (b *azw3Book) AddRights(_ string)            {}
-func (b *azw3Book) AddSource(_ string)            {}
-func (b *azw3Book) AddRelation(_ string)          {}
-func (b *azw3Book) AddType(_ string)              {}
+
+// KF8 has no record for relations and the Dublin Core type (EXTH 501 is the
+// Kindle document type, not the genre), no roles and no sort names: authors
+// are kept, everything else is dropped.
+func (b *azw3Book) AddRelation(rel string) { b.drop("relation", rel) }
+func (b *azw3Book) AddType(t string)       { b.drop("type", t) }
+func (b *azw3Book) AddContributor(name, role, sortName string) {
+	if role == "aut" {
+		b.book.AddAuthor(name)
+		if sortName != "" {
+			b.drop("author sort name", sortName)
+		}
+		return
+	}
+	b.drop("contributor", name+" ("+role+")")
+}
+func (b *azw3Book) SetTitleSort(t string)  { b.drop("title-sort", t) }
+func (b *azw3Book) SetAuthorSort(a string) { b.drop("author-sort", a) }
+
+// drop notes metadata that is intentionally not written.
+func (b *azw3Book) drop(key, value string) {
+	b.logf("AZW3 has no record for %s, dropped %q", key, value)
+}
+
+func (b *azw3Book) logf(format string, args ...any) {
+	if b.verbose != nil {
+		b.verbose(format, args...)
+	}
+}
 
 func (b *azw3Book) AddDate(date string) {
 	for _, layout := range []string{"2006-01-02", "2006", "January 2, 2006", "02 January 2006"} {
@@ -60,6 +137,7 @@ func (b *azw3Book) AddDate(date string) {
 			return
 		}
 	}
+	b.logf("AZW3 needs a date like 2006-01-02, dropped %q", date)
 }
 
 func (b *azw3Book) AddXHTML(filename, title, content string, order int) (string, error) {
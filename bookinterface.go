@@ -1,4 +1,4 @@
-package main
+package spell
 
 // NavpointAdder is the common interface for epub and azw3 table-of-contents nodes.
 type NavpointAdder interface {
@@ -19,6 +19,16 @@ type SpellBook interface {
 	AddSource(source string)
 	AddRelation(rel string)
 	AddType(t string)
+	SetISBN(isbn string) error
+	SetPublisher(publisher string)
+	SetDescription(description string)
+	// AddSubject adds a subject, e.g. a BISAC or Thema code.
+	AddSubject(subject string)
+	// AddContributor adds a person in role, a MARC relator code like "edt";
+	// role "aut" adds an author. sortName may be empty.
+	AddContributor(name, role, sortName string)
+	SetTitleSort(title string)
+	SetAuthorSort(author string)
 	// AddXHTML adds an XHTML chapter. title is used by azw3; epub ignores it.
 	AddXHTML(filename, title, content string, order int) (string, error)
 	AddImageFile(source, dest string) (string, error)
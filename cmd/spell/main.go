@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/behringer24/argumentative"
+	"github.com/behringer24/spell"
+)
+
+const (
+	title       = "spell"
+	description = "Smart Processing and Enhanced Lightweight Layout. Command line parser for converting enhanced markdown to epub."
+	version     = "v1.7.0"
+)
+
+// Exit codes. A build with several kinds of errors exits with the highest.
+const (
+	exitOK          = 0
+	exitUsage       = 1 // bad arguments or unreadable input file
+	exitParseErrors = 2 // errors in the markdown, or warnings with --strict
+	exitAssetErrors = 3 // includes, images, the cover or stylesheets missing
+	exitWriteErrors = 4 // the book could not be written
+)
+
+var (
+	inFileName    *string
+	outFileName   *string
+	outputFormat  *string
+	generateCover *bool
+	customCSS     *string
+	showHelp      *bool
+	showVer       *bool
+	verboseFlag   *bool
+	strictFlag    *bool
+	highlight     *string
+	smartQuotes   *bool
+	hyphenate     *bool
+	hyphenMin     *string
+
+	hyphenMinLength int
+)
+
+// Parse command line parameters
+func parseArgs() {
+	flags := &argumentative.Flags{}
+	showHelp = flags.Flags().AddBool("help", "h", "Show this help text")
+	showVer = flags.Flags().AddBool("version", "v", "Show version information")
+	generateCover = flags.Flags().AddBool("cover", "c", "Generate cover page. This is normally not recommended")
+	outputFormat = flags.Flags().AddString("format", "f", false, "epub3", "Output format: epub2, epub3, or azw3")
+	customCSS = flags.Flags().AddString("style", "s", false, "", "Comma-separated list of CSS files to include")
+	verboseFlag = flags.Flags().AddBool("verbose", "V", "Enable verbose logging")
+	strictFlag = flags.Flags().AddBool("strict", "S", "Treat warnings as errors and write no book if there are any")
+	highlight = flags.Flags().AddString("highlight", "H", false, "", "Code highlighting theme: "+strings.Join(spell.HighlightThemes(), ", ")+" (default: light for EPUB, eink for AZW3)")
+	smartQuotes = flags.Flags().AddBool("smartquotes", "q", "Turn straight quotes into the typographic quotes of the book language")
+	hyphenate = flags.Flags().AddBool("hyphenate", "y", "Insert soft hyphens into paragraph text, using patterns for the book language")
+	hyphenMin = flags.Flags().AddString("hyphen-min", "m", false, "6", "Shortest word to hyphenate, in letters")
+	inFileName = flags.Flags().AddPositional("infile", true, "", "File to read from")
+	outFileName = flags.Flags().AddPositional("outfile", false, "", "File to write to (default: ./ebook.epub or ./ebook.azw3)")
+
+	err := flags.Parse(os.Args)
+	minLength, minErr := strconv.Atoi(*hyphenMin)
+	hyphenMinLength = minLength
+	if *showHelp {
+		flags.Usage(title, description, nil)
+		os.Exit(0)
+	} else if *showVer {
+		fmt.Print(strings.ToUpper(title), " version: ", version)
+		os.Exit(0)
+	} else if *outputFormat != spell.FormatEPUB2 && *outputFormat != spell.FormatEPUB3 && *outputFormat != spell.FormatAZW3 {
+		fmt.Print("Error: format must be epub2, epub3, or azw3")
+		os.Exit(exitUsage)
+	} else if *highlight != "" && !slices.Contains(spell.HighlightThemes(), *highlight) {
+		fmt.Print("Error: highlight theme must be ", strings.Join(spell.HighlightThemes(), ", "))
+		os.Exit(exitUsage)
+	} else if minErr != nil || minLength < 1 {
+		fmt.Print("Error: hyphen-min must be a positive number")
+		os.Exit(exitUsage)
+	} else if err != nil {
+		flags.Usage(title, description, err)
+		os.Exit(exitUsage)
+	}
+}
+
+func main() {
+	// Use argumentative as command line parser
+	parseArgs()
+
+	// Apply default output filename based on format when not specified
+	if *outFileName == "" {
+		if *outputFormat == spell.FormatAZW3 {
+			*outFileName = "./ebook.azw3"
+		} else {
+			*outFileName = "./ebook.epub"
+		}
+	}
+
+	var cssFiles []string
+	for _, cssFile := range strings.FieldsFunc(*customCSS, func(r rune) bool { return r == ',' }) {
+		cssFiles = append(cssFiles, strings.TrimSpace(cssFile))
+	}
+
+	in, err := os.Open(*inFileName)
+	if err != nil {
+		log.Printf("Error processing file '%s': %v", *inFileName, err)
+		os.Exit(exitUsage)
+	}
+	defer in.Close()
+
+	out, err := os.Create(*outFileName)
+	if err != nil {
+		log.Printf("Error writing file '%s': %v", *outFileName, err)
+		os.Exit(exitWriteErrors)
+	}
+
+	// Convert input file into output file
+	err = spell.Convert(in, spell.Options{
+		Format:          *outputFormat,
+		CSS:             cssFiles,
+		Cover:           *generateCover,
+		Verbose:         *verboseFlag,
+		Strict:          *strictFlag,
+		HighlightTheme:  *highlight,
+		SmartQuotes:     *smartQuotes,
+		Hyphenate:       *hyphenate,
+		MinHyphenLength: hyphenMinLength,
+		BaseDir:         filepath.Dir(*inFileName),
+		Name:            *inFileName,
+	}, out)
+	if cerr := out.Close(); cerr != nil {
+		log.Printf("Error writing file '%s': %v", *outFileName, cerr)
+		os.Remove(*outFileName)
+		os.Exit(exitWriteErrors)
+	}
+
+	var buildErr *spell.BuildError
+	switch {
+	case err == nil:
+		fmt.Printf("File '%s' created successfully!\n", *outFileName)
+	case errors.As(err, &buildErr) && buildErr.Written:
+		fmt.Printf("File '%s' created with %s\n", *outFileName, buildErr)
+		os.Exit(exitCode(buildErr))
+	case buildErr != nil:
+		os.Remove(*outFileName)
+		log.Printf("Error processing file '%s': %v", *inFileName, err)
+		os.Exit(exitCode(buildErr))
+	default:
+		os.Remove(*outFileName)
+		log.Printf("Error processing file '%s': %v", *inFileName, err)
+		os.Exit(exitUsage)
+	}
+}
+
+// exitCode returns the exit code for the most serious kind of error in e.
+func exitCode(e *spell.BuildError) int {
+	switch {
+	case e.WriteErrors > 0:
+		return exitWriteErrors
+	case e.AssetErrors > 0:
+		return exitAssetErrors
+	case e.ParseErrors > 0:
+		return exitParseErrors
+	}
+	return exitOK
+}
@@ -0,0 +1,107 @@
+package spell
+
+import (
+	"strings"
+	"unicode"
+)
+
+// Index terms are sorted by a collation key: the term in lower case,
+// without a leading article and with accented letters folded to their base
+// letter, as DIN 5007 does for German. Languages that sort some letters
+// after z keep them apart.
+
+// letterFolds maps accented letters to the letters they sort as.
+var letterFolds = map[rune]string{
+	'à': "a", 'á': "a", 'â': "a", 'ã': "a", 'ä': "a", 'å': "a", 'ā': "a", 'ą': "a", 'æ': "ae",
+	'ç': "c", 'ć': "c", 'č': "c", 'ď': "d", 'đ': "d", 'ð': "d",
+	'è': "e", 'é': "e", 'ê': "e", 'ë': "e", 'ē': "e", 'ė': "e", 'ę': "e", 'ě': "e",
+	'ì': "i", 'í': "i", 'î': "i", 'ï': "i", 'ī': "i", 'ł': "l", 'ľ': "l",
+	'ñ': "n", 'ń': "n", 'ň': "n",
+	'ò': "o", 'ó': "o", 'ô': "o", 'õ': "o", 'ö': "o", 'ø': "o", 'ō': "o", 'ő': "o", 'œ': "oe",
+	'ŕ': "r", 'ř': "r", 'ś': "s", 'š': "s", 'ş': "s", 'ß': "ss", 'ť': "t", 'ţ': "t", 'þ': "th",
+	'ù': "u", 'ú': "u", 'û': "u", 'ü': "u", 'ū': "u", 'ů': "u", 'ű': "u",
+	'ý': "y", 'ÿ': "y", 'ź': "z", 'ż': "z", 'ž': "z",
+}
+
+// ownLetters are the letters a language sorts after z, in their order.
+var ownLetters = map[string][]rune{
+	"sv": {'å', 'ä', 'ö'},
+	"fi": {'å', 'ä', 'ö'},
+	"da": {'æ', 'ø', 'å'},
+	"no": {'æ', 'ø', 'å'},
+	"nb": {'æ', 'ø', 'å'},
+	"nn": {'æ', 'ø', 'å'},
+}
+
+// leadingArticles are ignored at the start of a term when sorting.
+var leadingArticles = map[string][]string{
+	"en": {"the ", "a ", "an "},
+	"de": {"der ", "die ", "das ", "den ", "dem ", "des ", "ein ", "eine "},
+	"fr": {"le ", "la ", "les ", "l'", "l’", "un ", "une "},
+	"es": {"el ", "la ", "los ", "las ", "un ", "una "},
+	"it": {"il ", "lo ", "la ", "i ", "gli ", "le ", "l'", "l’", "un ", "una "},
+	"nl": {"de ", "het ", "een "},
+}
+
+// collator sorts index terms for one language.
+type collator struct {
+	own      map[rune]int
+	articles []string
+}
+
+func newCollator(lang string) *collator {
+	primary, _, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(lang, "_", "-")), "-")
+	c := &collator{own: map[rune]int{}, articles: leadingArticles[primary]}
+	for i, letter := range ownLetters[primary] {
+		c.own[letter] = i + 1
+	}
+	return c
+}
+
+// stripArticle returns term without a leading article, in lower case.
+func (c *collator) stripArticle(term string) string {
+	lower := strings.ToLower(strings.TrimSpace(term))
+	for _, article := range c.articles {
+		if rest := strings.TrimPrefix(lower, article); rest != lower && strings.TrimSpace(rest) != "" {
+			return strings.TrimSpace(rest)
+		}
+	}
+	return lower
+}
+
+// key returns the collation key of term.
+func (c *collator) key(term string) string {
+	var b strings.Builder
+	for _, r := range c.stripArticle(term) {
+		switch {
+		case c.own[r] > 0:
+			// After z, in the order of the language.
+			b.WriteRune('z' + 1)
+			b.WriteRune(rune('0' + c.own[r]))
+		case letterFolds[r] != "":
+			b.WriteString(letterFolds[r])
+		case unicode.IsLetter(r) || unicode.IsDigit(r) || r == ' ':
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// group returns the heading of the letter group term belongs to: its first
+// letter without accents, or # for terms starting with a digit. Symbols are
+// skipped, as in the key.
+func (c *collator) group(term string) string {
+	for _, r := range c.stripArticle(term) {
+		switch {
+		case c.own[r] > 0:
+			return strings.ToUpper(string(r))
+		case letterFolds[r] != "":
+			return strings.ToUpper(letterFolds[r][:1])
+		case unicode.IsLetter(r):
+			return strings.ToUpper(string(r))
+		case unicode.IsDigit(r):
+			return "#"
+		}
+	}
+	return "#"
+}
@@ -0,0 +1,126 @@
+package spell
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestCollationKey(t *testing.T) {
+	tests := []struct {
+		lang, term, want string
+	}{
+		{"en", "Lantern", "lantern"},
+		{"en", "The Lantern", "lantern"},
+		{"en", "A", "a"},
+		{"en", "Theory", "theory"},
+		{"en", "Ångström", "angstrom"},
+		{"en", "naïve café", "naive cafe"},
+		{"en", "“Quoted”-term!", "quotedterm"},
+		{"de", "Die Straße", "strasse"},
+		{"de", "Öl", "ol"},
+		{"de", "Ärger", "arger"},
+		{"fr", "L'Œuvre", "oeuvre"},
+		{"fr", "l’été", "ete"},
+		{"sv", "Åsa", "{1sa"},
+		{"sv", "Öl", "{3l"},
+		{"da", "Ærø", "{1r{2"},
+	}
+	for _, tt := range tests {
+		if got := newCollator(tt.lang).key(tt.term); got != tt.want {
+			t.Errorf("%s key(%q) = %q, want %q", tt.lang, tt.term, got, tt.want)
+		}
+	}
+}
+
+func TestCollationOrder(t *testing.T) {
+	tests := []struct {
+		lang  string
+		terms []string // in the order wanted
+	}{
+		{"de", []string{"Apfel", "Ärger", "Arzt", "Ofen", "Öl", "Ost", "Straße", "Strasser", "Zebra"}},
+		{"sv", []string{"Apa", "Zebra", "Åsa", "Ärta", "Öl"}},
+		{"da", []string{"Apa", "Zebra", "Æble", "Øl", "Ål"}},
+		{"en", []string{"The Apple", "banana", "a Cherry", "Éclair", "egg"}},
+	}
+	for _, tt := range tests {
+		c := newCollator(tt.lang)
+		got := make([]string, len(tt.terms))
+		for i, term := range tt.terms {
+			got[len(got)-1-i] = term
+		}
+		sort.SliceStable(got, func(i, j int) bool { return c.key(got[i]) < c.key(got[j]) })
+		if strings.Join(got, ",") != strings.Join(tt.terms, ",") {
+			t.Errorf("%s: got %q, want %q", tt.lang, got, tt.terms)
+		}
+	}
+}
+
+func TestCollationGroup(t *testing.T) {
+	tests := []struct {
+		lang, term, want string
+	}{
+		{"en", "lantern", "L"},
+		{"en", "The Lantern", "L"},
+		{"en", "Éclair", "E"},
+		{"en", "1984", "#"},
+		{"en", "…", "#"},
+		{"en", "“Quoted”", "Q"},
+		{"de", "Öl", "O"},
+		{"de", "Ärger", "A"},
+		{"sv", "Öl", "Ö"},
+		{"da", "æble", "Æ"},
+		{"fr", "L'Œuvre", "O"},
+	}
+	for _, tt := range tests {
+		if got := newCollator(tt.lang).group(tt.term); got != tt.want {
+			t.Errorf("%s group(%q) = %q, want %q", tt.lang, tt.term, got, tt.want)
+		}
+	}
+}
+
+var reIndexItem = regexp.MustCompile(`<span[^>]*>([^<]*)</span>(.*)</li>`)
+
+// indexEntries converts md and returns the entries of its index as
+// "term: locators", with the locator links reduced to their text.
+func indexEntries(t *testing.T, md string) []string {
+	t.Helper()
+	c := convertMarkdown(t, md)
+	if c.err != nil {
+		t.Fatalf("unexpected error: %v\n%s", c.err, c.diags)
+	}
+	index := c.book.chapters[len(c.book.chapters)-1].content
+	var out []string
+	for _, m := range reIndexItem.FindAllStringSubmatch(index, -1) {
+		out = append(out, m[1]+":"+reTag.ReplaceAllString(m[2], ""))
+	}
+	return out
+}
+
+func TestIndexLocators(t *testing.T) {
+	md := "$[language](de)\n\n# Eins\n\n%[Öl](idx) und %[Apfel](idx), %[Öl](idx).\n\n## Teil\n\n%[Öl](idx)\n\n" +
+		"# Zwei\n\n%[Zebra](idx) %[Öl](idx)\n\n%index[idx](Index)%s\n"
+	tests := []struct {
+		options string
+		want    []string
+	}{
+		{"", []string{"Apfel: Eins", "Öl: Eins (2, 3), Zwei", "Zebra: Zwei"}},
+		{"{locators=section}", []string{"Apfel: Eins", "Öl: Eins (2), Teil, Zwei", "Zebra: Zwei"}},
+		{"{locators=number}", []string{"Apfel: 1", "Öl: 1, 2, 3, 4", "Zebra: 1"}},
+	}
+	for _, tt := range tests {
+		got := indexEntries(t, strings.Replace(md, "%s", tt.options, 1))
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("%s: got %q, want %q", tt.options, got, tt.want)
+		}
+	}
+}
+
+func TestIndexCanonicalClass(t *testing.T) {
+	c := convertMarkdown(t, "# One\n\n%[oil lamp](idx|lantern > oil)\n\n%index[idx](Index)\n")
+	index := c.book.chapters[len(c.book.chapters)-1].content
+	if !strings.Contains(index, `class="index-canonical">lantern</span>`) || strings.Contains(index, `class="index-canonical">oil`) {
+		t.Errorf("index-canonical must mark the top level only:\n%s", index)
+	}
+}
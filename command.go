@@ -0,0 +1,243 @@
+package spell
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// Command is a custom block or inline command, registered with
+// Converter.Register. A block command takes a whole line, like %toc; an
+// inline command is found inside running text, like %[term](index).
+//
+// Built-in block constructs, in the order they are tried: fence, chapter,
+// heading, meta, cover, image, index, toc, figures, tables, endnotes, footnote,
+// table, divider, pagebreak, list, html. Built-in inline constructs: code, anchor, image, index-term,
+// index-xref, quote, figure-ref, anchor-link, link, footnote-ref, bold, italic, comment.
+type Command struct {
+	// Name identifies the command in log messages and as a position for
+	// commands registered later.
+	Name string
+
+	// Inline makes this an inline command; otherwise it is a block command.
+	Inline bool
+
+	// Pattern is the match rule. A block command matches if Pattern matches
+	// the line, so it should normally be anchored with ^ and $. An inline
+	// command is tried at every position of the text and must match right
+	// there. Submatches are handed on in Match.Groups.
+	Pattern *regexp.Regexp
+
+	// Before is the name of the construct or command this command is tried
+	// before. Empty means after all built-in constructs, just before a line
+	// is taken as paragraph text or a character as running text.
+	Before string
+
+	// Scan, if set, is called for every occurrence in Pass 1, before any
+	// chapter is rendered, so the command can add anchors, TOC entries and
+	// index entries.
+	Scan func(s *ScanContext, m *Match)
+
+	// Render renders an occurrence, per output format (FormatEPUB2,
+	// FormatEPUB3 or FormatAZW3). The entry for "" is used for formats
+	// without an entry of their own.
+	Render map[string]RenderFunc
+}
+
+// RenderFunc returns the XHTML for one occurrence of a command.
+type RenderFunc func(r *RenderContext, m *Match) string
+
+// Match is one occurrence of a command in the text.
+type Match struct {
+	Command *Command
+	Groups  []string // submatches of Command.Pattern; Groups[0] is the whole match
+
+	// ID is free for Scan to set, e.g. to the anchor id of an added TOC
+	// entry, so that Render can write the element carrying it.
+	ID string
+
+	pos sourcePos
+}
+
+// Register adds a custom command to c. It must not be called while c is
+// converting a book.
+func (c *Converter) Register(cmd Command) error {
+	if cmd.Name == "" {
+		return fmt.Errorf("command without name")
+	}
+	if cmd.Pattern == nil {
+		return fmt.Errorf("command %s: no pattern", cmd.Name)
+	}
+	if len(cmd.Render) == 0 {
+		return fmt.Errorf("command %s: no render function", cmd.Name)
+	}
+	var names []string
+	if cmd.Inline {
+		for _, r := range c.inlineRules() {
+			names = append(names, r.name)
+		}
+	} else {
+		for _, r := range c.blockRules() {
+			names = append(names, r.name)
+		}
+	}
+	known := cmd.Before == ""
+	for _, name := range names {
+		if name == cmd.Name {
+			return fmt.Errorf("command %s: name already in use", cmd.Name)
+		}
+		if name == cmd.Before {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("command %s: unknown position %q", cmd.Name, cmd.Before)
+	}
+	c.commands = append(c.commands, &cmd)
+	return nil
+}
+
+// blockRules returns the block pipeline: the built-in rules with the
+// registered block commands inserted.
+func (c *Converter) blockRules() []blockRule {
+	rules := append([]blockRule(nil), builtinBlockRules...)
+	for _, cmd := range c.commands {
+		if cmd.Inline {
+			continue
+		}
+		rules = insertRule(rules, cmd.Before, func(r blockRule) string { return r.name }, blockRule{
+			name:  cmd.Name,
+			match: matchLine(cmd.Pattern),
+			parse: func(p *blockParser, line string) {
+				p.addBlock(&commandNode{match: &Match{Command: cmd, Groups: cmd.Pattern.FindStringSubmatch(line), pos: p.pos}})
+			},
+		})
+	}
+	return rules
+}
+
+// inlineRules returns the inline pipeline: the built-in rules with the
+// registered inline commands inserted.
+func (c *Converter) inlineRules() []inlineRule {
+	rules := append([]inlineRule(nil), builtinInlineRules...)
+	for _, cmd := range c.commands {
+		if !cmd.Inline {
+			continue
+		}
+		re := anchored(cmd.Pattern)
+		rules = insertRule(rules, cmd.Before, func(r inlineRule) string { return r.name }, inlineRule{
+			name: cmd.Name,
+			parse: func(_ *parseContext, s string, i int, at sourcePos) (inline, int) {
+				m := re.FindStringSubmatch(s[i:])
+				if m == nil || m[0] == "" {
+					return nil, 0
+				}
+				return &commandNode{match: &Match{Command: cmd, Groups: m, pos: at}}, len(m[0])
+			},
+		})
+	}
+	return rules
+}
+
+// insertRule inserts rule in front of the rule named before, or at the end
+// if before is empty.
+func insertRule[R any](rules []R, before string, name func(R) string, rule R) []R {
+	if before != "" {
+		for i, r := range rules {
+			if name(r) == before {
+				return append(rules[:i], append([]R{rule}, rules[i:]...)...)
+			}
+		}
+	}
+	return append(rules, rule)
+}
+
+// ScanContext is handed to Command.Scan in Pass 1.
+type ScanContext struct {
+	ctx     *parseContext
+	chapter *chapter
+	match   *Match
+}
+
+// AddAnchor registers id as an anchor in the current chapter, so that
+// [text](#id) links to it. The command's Render must write an element with
+// that id.
+func (s *ScanContext) AddAnchor(id string) {
+	addAnchor(s.ctx, id, s.chapter, s.match.pos)
+}
+
+// AddTOCEntry adds an entry to the %toc after the headings before it. level
+// is 1 for a chapter and 2-6 for subchapters; title is inline markdown; id
+// is the anchor the entry links to.
+func (s *ScanContext) AddTOCEntry(level int, title, id string) {
+	if level < 1 || level > 6 {
+		s.Warnf("TOC entry %q has invalid level %d", title, level)
+		return
+	}
+	s.ctx.tocEntries = append(s.ctx.tocEntries, tocEntry{
+		level:   level,
+		title:   s.ctx.parseInline(title, sourcePos{}),
+		chapter: s.chapter,
+		label:   id,
+	})
+}
+
+// AddIndexEntry adds an occurrence of term to the index called index,
+// linking to id.
+func (s *ScanContext) AddIndexEntry(index, term, id string) {
+	s.ctx.indexes[index] = append(s.ctx.indexes[index], indexEntry{
+		displayTerm: term,
+		canonical:   term,
+		indexName:   index,
+		chapter:     s.chapter,
+		htmlID:      id,
+	})
+	s.ctx.logMsg(LogVerbose, "Index entry %q (%s) registered as %s", term, index, id)
+}
+
+// Warnf reports a problem with the occurrence being scanned, at its
+// position in the source.
+func (s *ScanContext) Warnf(format string, args ...any) {
+	s.ctx.warnAt(s.match.pos, format, args...)
+}
+
+// RenderContext is handed to a RenderFunc in Pass 2.
+type RenderContext struct {
+	r     *renderer
+	match *Match
+}
+
+// Format returns the output format: FormatEPUB2, FormatEPUB3 or FormatAZW3.
+func (rc *RenderContext) Format() string {
+	return rc.r.format.name()
+}
+
+// Inline renders inline markdown, e.g. a title taken from the command.
+func (rc *RenderContext) Inline(markdown string) string {
+	return rc.r.renderInline(rc.r.parseInline(markdown, sourcePos{}))
+}
+
+// Text escapes plain text, e.g. a submatch, for use in the returned
+// markup. Numeric character references are kept.
+func (rc *RenderContext) Text(s string) string {
+	return escapeText(s)
+}
+
+// Warnf reports a problem with the occurrence being rendered, at its
+// position in the source.
+func (rc *RenderContext) Warnf(format string, args ...any) {
+	rc.r.warnAt(rc.match.pos, format, args...)
+}
+
+// renderCommand renders an occurrence of a custom command for the current
+// output format.
+func (r *renderer) renderCommand(m *Match) string {
+	render, ok := m.Command.Render[r.format.name()]
+	if !ok {
+		render, ok = m.Command.Render[""]
+	}
+	if !ok {
+		r.warnAt(m.pos, "command %s cannot be rendered as %s", m.Command.Name, r.format.name())
+		return m.Groups[0]
+	}
+	return render(&RenderContext{r: r, match: m}, m)
+}
@@ -0,0 +1,136 @@
+package spell
+
+import (
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+const (
+	LogDefault = iota
+	LogVerbose
+)
+
+// Converter turns enhanced markdown into a SpellBook. It only holds options;
+// every conversion creates its own parseContext, so one Converter may be used
+// for any number of books, also from parallel goroutines.
+type Converter struct {
+	GenerateCover bool        // add a cover page chapter for ![cover](...)
+	Verbose       bool        // also print LogVerbose messages
+	Logger        *log.Logger // destination for log messages; nil uses the standard logger
+	Strict        bool        // treat warnings as errors
+
+	// HighlightTheme styles highlighted code: "light", "dark", "eink" or
+	// "none". Empty means "light" for EPUB and "eink" for AZW3.
+	HighlightTheme string
+
+	// SmartQuotes turns the straight quotes and apostrophes of the text into
+	// the typographic ones of the book language, see quotePresets.
+	SmartQuotes bool
+
+	// Hyphenate inserts soft hyphens into the words of paragraphs that have
+	// at least MinHyphenLength letters (0 means 6), using the hyphenation
+	// patterns of the book language.
+	Hyphenate       bool
+	MinHyphenLength int
+
+	// FS, when set, is used for every file the markdown refers to (includes,
+	// images, the cover and custom CSS). Paths are then slash-separated and
+	// relative to the root of FS. When nil, the local file system is used.
+	FS fs.FS
+
+	commands []*Command // custom commands, see Register
+}
+
+func (c *Converter) logMsg(level int, format string, args ...any) {
+	if level != LogDefault && !c.Verbose {
+		return
+	}
+	if c.Logger != nil {
+		c.Logger.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// joinPath joins a base directory and a relative path in the path syntax of
+// the file system in use.
+func (c *Converter) joinPath(baseDir, name string) string {
+	if c.FS != nil {
+		return path.Join(baseDir, name)
+	}
+	return filepath.Join(baseDir, name)
+}
+
+// dirName returns the directory of name in the path syntax of the file
+// system in use.
+func (c *Converter) dirName(name string) string {
+	if c.FS != nil {
+		return path.Dir(name)
+	}
+	return filepath.Dir(name)
+}
+
+// readFile reads a file from FS, or from the local file system if FS is nil.
+func (c *Converter) readFile(filename string) ([]byte, error) {
+	if c.FS != nil {
+		return fs.ReadFile(c.FS, filename)
+	}
+	return os.ReadFile(filename)
+}
+
+// addImageFile adds the image at source to book as dest. Images from FS are
+// read here and handed over as bytes, since the book writers only know about
+// the local file system.
+func (c *Converter) addImageFile(book SpellBook, source, dest string) (string, error) {
+	if c.FS == nil {
+		return book.AddImageFile(source, dest)
+	}
+	data, err := fs.ReadFile(c.FS, source)
+	if err != nil {
+		return "", err
+	}
+	return book.AddImage(dest, data)
+}
+
+// ProcessMarkdownFile reads the markdown file at filePath, resolves its
+// includes relative to the file's directory and renders it into book.
+// customCSS lists stylesheet files added after the default stylesheet.
+func (c *Converter) ProcessMarkdownFile(book SpellBook, filePath string, customCSS []string) error {
+	// Read markdown file
+	content, err := c.readFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	return c.convertSource(book, string(content), filePath, c.dirName(filePath), customCSS)
+}
+
+// ParseMarkdown renders markdown content into book. Includes, images and
+// the cover are resolved relative to baseDir.
+//
+// Problems are reported as they are found. If any of them was an error,
+// ParseMarkdown and ProcessMarkdownFile return a *BuildError; book then
+// lacks what failed but is otherwise complete.
+func (c *Converter) ParseMarkdown(book SpellBook, content string, baseDir string, customCSS []string) error {
+	return c.convertSource(book, content, "", baseDir, customCSS)
+}
+
+// convertSource renders content, read from the file called name, into book.
+// name is only used in diagnostics; empty means "<input>".
+func (c *Converter) convertSource(book SpellBook, content, name, baseDir string, customCSS []string) error {
+	if name == "" {
+		name = "<input>"
+	}
+
+	ctx := newParseContext(c, book, baseDir)
+
+	// Take the metadata from the front matter and replace all includes
+	lines := ctx.replaceAllIncludes(ctx.parseFrontMatter(splitLines(content, name)))
+
+	// Parse markdown
+	ctx.parseMarkdown(lines, customCSS)
+	return ctx.result()
+}
@@ -0,0 +1,146 @@
+package spell
+
+import (
+	"fmt"
+	"os"
+)
+
+// sourcePos is a position in a markdown source file, carried through
+// includes so that diagnostics point at the line the author wrote.
+type sourcePos struct {
+	file string
+	line int // 1-based; 0 if unknown
+	col  int // 1-based byte column; 0 if unknown
+}
+
+func (p sourcePos) String() string {
+	switch {
+	case p.file == "":
+		return ""
+	case p.line == 0:
+		return p.file
+	case p.col == 0:
+		return fmt.Sprintf("%s:%d", p.file, p.line)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.file, p.line, p.col)
+}
+
+// shift returns the position n bytes further on the same line.
+func (p sourcePos) shift(n int) sourcePos {
+	if p.col > 0 {
+		p.col += n
+	}
+	return p
+}
+
+// sourceLine is one line of the fully-included markdown and the position it
+// came from.
+type sourceLine struct {
+	text string
+	pos  sourcePos
+}
+
+// splitLines splits the content of file into lines.
+func splitLines(content, file string) []sourceLine {
+	texts := reNewline.Split(content, -1)
+	lines := make([]sourceLine, len(texts))
+	for i, text := range texts {
+		lines[i] = sourceLine{text: text, pos: sourcePos{file: file, line: i + 1, col: 1}}
+	}
+	return lines
+}
+
+// problem classifies an error by what went wrong, so that a build can
+// tell a broken book from a missing file or a full disk.
+type problem int
+
+const (
+	problemParse problem = iota // the markdown is wrong
+	problemAsset                // a file the markdown refers to cannot be read
+	problemWrite                // the book cannot be written
+)
+
+// Summary counts the diagnostics of one conversion.
+type Summary struct {
+	Warnings int
+	Errors   int
+
+	ParseErrors int // errors in the markdown, including warnings in strict mode
+	AssetErrors int // includes, images, the cover or stylesheets that cannot be read
+	WriteErrors int // chapters or the book that cannot be written
+}
+
+func (s Summary) String() string {
+	return plural(s.Warnings, "warning") + ", " + plural(s.Errors, "error")
+}
+
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// BuildError is returned if a conversion reported errors. In strict mode
+// every warning is an error.
+type BuildError struct {
+	Summary
+	Written bool // the book was written anyway, without what failed
+}
+
+func (e *BuildError) Error() string {
+	return e.Summary.String()
+}
+
+// warnAt reports a problem at pos that does not stop the conversion. In
+// strict mode it is an error.
+func (ctx *parseContext) warnAt(pos sourcePos, format string, args ...any) {
+	if ctx.Strict {
+		ctx.errorAt(pos, problemParse, format, args...)
+		return
+	}
+	ctx.summary.Warnings++
+	ctx.diag(pos, "warning", format, args...)
+}
+
+// errorAt reports a problem at pos that leaves something out of the book.
+func (ctx *parseContext) errorAt(pos sourcePos, kind problem, format string, args ...any) {
+	ctx.summary.Errors++
+	switch kind {
+	case problemParse:
+		ctx.summary.ParseErrors++
+	case problemAsset:
+		ctx.summary.AssetErrors++
+	case problemWrite:
+		ctx.summary.WriteErrors++
+	}
+	ctx.diag(pos, "error", format, args...)
+}
+
+// result logs the summary of the conversion and returns a *BuildError if
+// there were errors.
+func (ctx *parseContext) result() error {
+	if ctx.summary == (Summary{}) {
+		return nil
+	}
+	ctx.logMsg(LogDefault, "Finished with %s", ctx.summary)
+	if ctx.summary.Errors == 0 {
+		return nil
+	}
+	return &BuildError{Summary: ctx.summary}
+}
+
+// diag writes a diagnostic in the compiler style editors can jump to,
+// file:line:col: severity: message. Without a logger it goes to stderr
+// without a timestamp, so the position starts the line.
+func (c *Converter) diag(pos sourcePos, severity, format string, args ...any) {
+	msg := severity + ": " + fmt.Sprintf(format, args...)
+	if p := pos.String(); p != "" {
+		msg = p + ": " + msg
+	}
+	if c.Logger != nil {
+		c.Logger.Print(msg)
+		return
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
@@ -1,4 +1,4 @@
-package main
+package spell
 
 import "github.com/behringer24/epub"
 
@@ -10,12 +10,18 @@ func (n *epubNavpoint) AddNavpoint(label, filename string, order int) NavpointAd
 }
 
 // epubBook wraps *epub.EPub to implement SpellBook.
-type epubBook struct{ book *epub.EPub }
+type epubBook struct {
+	book    *epub.EPub
+	version float64
+	// verbose, when set, logs the metadata the epub library cannot write.
+	verbose func(format string, args ...any)
+}
 
-func newEpubBook(version float64) *epubBook {
+// NewEpubBook returns an empty EPUB book; version is 2.0 or 3.0.
+func NewEpubBook(version float64) SpellBook {
 	b := epub.New()
 	b.SetVersion(version)
-	return &epubBook{book: b}
+	return &epubBook{book: b, version: version}
 }
 
 func (b *epubBook) SetTitle(title string)        { b.book.SetTitle(title) }
@@ -31,6 +37,89 @@ func (b *epubBook) AddSource(source string)       { b.book.AddSource(source) }
 func (b *epubBook) AddRelation(rel string)        { b.book.AddRelation(rel) }
 func (b *epubBook) AddType(t string)              { b.book.AddType(t) }
 
+// The metadata for distributors needs methods that not every version of the
+// epub library has. They are looked up when the book is written to, so spell
+// builds against any version; without them the value is dropped and logged.
+
+func (b *epubBook) SetISBN(isbn string) error {
+	if m, ok := any(b.book).(interface{ AddIdentifier(string) error }); ok {
+		return m.AddIdentifier("urn:isbn:" + isbn)
+	}
+	b.drop("ISBN", isbn)
+	return nil
+}
+
+func (b *epubBook) SetPublisher(p string) {
+	if m, ok := any(b.book).(interface{ AddPublisher(string) }); ok {
+		m.AddPublisher(p)
+		return
+	}
+	b.drop("publisher", p)
+}
+
+func (b *epubBook) SetDescription(d string) {
+	if m, ok := any(b.book).(interface{ AddDescription(string) }); ok {
+		m.AddDescription(d)
+		return
+	}
+	b.drop("description", d)
+}
+
+func (b *epubBook) AddSubject(s string) {
+	if m, ok := any(b.book).(interface{ AddSubject(string) }); ok {
+		m.AddSubject(s)
+		return
+	}
+	b.drop("subject", s)
+}
+
+func (b *epubBook) SetTitleSort(t string) {
+	if m, ok := any(b.book).(interface{ SetTitleSort(string) }); ok {
+		m.SetTitleSort(t)
+		return
+	}
+	b.drop("title-sort", t)
+}
+
+func (b *epubBook) SetAuthorSort(a string) {
+	if m, ok := any(b.book).(interface{ SetAuthorSort(string) }); ok {
+		m.SetAuthorSort(a)
+		return
+	}
+	b.drop("author-sort", a)
+}
+
+// AddContributor writes authors as dc:creator and everybody else as
+// dc:contributor, both with their role and sort name (file-as). Without
+// AddCreator in the library, authors are added by name only.
+func (b *epubBook) AddContributor(name, role, sortName string) {
+	type personAdder interface{ AddCreator(name, role, sortName string) }
+	type contributorAdder interface{ AddContributor(name, role, sortName string) }
+	if role != "aut" {
+		if m, ok := any(b.book).(contributorAdder); ok {
+			m.AddContributor(name, role, sortName)
+		} else {
+			b.drop("contributor", name+" ("+role+")")
+		}
+		return
+	}
+	if m, ok := any(b.book).(personAdder); ok {
+		m.AddCreator(name, role, sortName)
+		return
+	}
+	b.book.AddAuthor(name)
+	if sortName != "" {
+		b.drop("author sort name", sortName)
+	}
+}
+
+// drop notes metadata that the epub library cannot write.
+func (b *epubBook) drop(key, value string) {
+	if b.verbose != nil {
+		b.verbose("The epub library has no method for %s, dropped %q", key, value)
+	}
+}
+
 func (b *epubBook) AddXHTML(filename, _ /* title */, content string, order int) (string, error) {
 	id, err := b.book.AddXHTML(filename, content, order)
 	return string(id), err
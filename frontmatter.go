@@ -0,0 +1,819 @@
+package spell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Front matter is a block of metadata at the very top of the root file,
+// either YAML between --- lines or TOML between +++ lines:
+//
+//	---
+//	title: The Lantern
+//	author:
+//	  - name: Jane Doe
+//	    sort-name: Doe, Jane
+//	  - Joe Bloggs
+//	language: en
+//	---
+//
+// The keys are those of the $[key](value) lines, and each value has the same
+// effect as such a line. A list gives the key once for every item; an author
+// or contributor may also be a table with name, role and sort-name. Only the parts of YAML
+// and TOML that metadata needs are understood: strings and other scalars,
+// lists, tables, comments, and multi-line strings for long texts.
+
+// fmKind tells what a front matter value is.
+type fmKind int
+
+const (
+	fmScalar fmKind = iota
+	fmList
+	fmTable
+)
+
+// fmValue is a parsed front matter value: a scalar, a list or a table.
+type fmValue struct {
+	kind   fmKind
+	text   string     // the value of a scalar
+	list   []*fmValue // the items of a list
+	fields []fmField  // the fields of a table, in the order written
+	pos    sourcePos
+}
+
+type fmField struct {
+	key   string
+	value *fmValue
+	pos   sourcePos
+}
+
+// field returns the value of the field key of a table, or nil.
+func (v *fmValue) field(key string) *fmValue {
+	for _, f := range v.fields {
+		if f.key == key {
+			return f.value
+		}
+	}
+	return nil
+}
+
+// set adds the field key to a table; a key may only be given once.
+func (v *fmValue) set(key string, value *fmValue, pos sourcePos) error {
+	if v.field(key) != nil {
+		return fmErrorf(pos, "key %s given twice", key)
+	}
+	v.fields = append(v.fields, fmField{key: key, value: value, pos: pos})
+	return nil
+}
+
+// fmError is a syntax error in the front matter.
+type fmError struct {
+	pos sourcePos
+	msg string
+}
+
+func (e *fmError) Error() string { return e.msg }
+
+func fmErrorf(pos sourcePos, format string, args ...any) error {
+	return &fmError{pos: pos, msg: fmt.Sprintf(format, args...)}
+}
+
+// personFields are the fields of an author or contributor given as a table.
+var personFields = map[string]bool{"name": true, "role": true, "sort-name": true}
+
+// parseFrontMatter removes the front matter from the top of lines and keeps
+// its metadata for the preamble of the document. Lines without front matter
+// are returned unchanged. After a syntax error, the values read before it
+// are kept.
+func (ctx *parseContext) parseFrontMatter(lines []sourceLine) []sourceLine {
+	if len(lines) == 0 {
+		return lines
+	}
+	delim := strings.TrimSpace(lines[0].text)
+	if delim != "---" && delim != "+++" {
+		return lines
+	}
+	end := -1
+	for i := 1; i < len(lines); i++ {
+		if t := strings.TrimSpace(lines[i].text); t == delim || (delim == "---" && t == "...") {
+			end = i
+			break
+		}
+	}
+	if end < 0 {
+		ctx.errorAt(lines[0].pos, problemParse, "front matter is not closed by %s", delim)
+		return lines
+	}
+
+	var root *fmValue
+	var err error
+	if delim == "---" {
+		root, err = parseYAML(lines[1:end])
+	} else {
+		root, err = parseTOML(lines[1:end])
+	}
+	if err != nil {
+		pos := lines[0].pos
+		if e, ok := err.(*fmError); ok {
+			pos = e.pos
+		}
+		ctx.errorAt(pos, problemParse, "invalid front matter: %v", err)
+		if root == nil {
+			return lines[end+1:]
+		}
+	}
+	ctx.frontMatter = ctx.frontMatterMeta(root)
+	ctx.logMsg(LogVerbose, "Read %d metadata values from the front matter", len(ctx.frontMatter))
+	return lines[end+1:]
+}
+
+// frontMatterMeta turns the parsed front matter into meta nodes.
+func (ctx *parseContext) frontMatterMeta(root *fmValue) []block {
+	var meta []block
+	for _, f := range root.fields {
+		if !isMetaKey(f.key) {
+			ctx.warnAt(f.pos, "unknown front matter key %q ignored", f.key)
+			continue
+		}
+		values := []*fmValue{f.value}
+		if f.value.kind == fmList {
+			values = f.value.list
+		}
+		if f.key == "quotes" && f.value.kind == fmList {
+			// The four quotes may be given as a list, too.
+			var quotes []string
+			for _, v := range values {
+				quotes = append(quotes, v.text)
+			}
+			values = []*fmValue{{text: strings.Join(quotes, ","), pos: f.value.pos}}
+		}
+
+		for _, v := range values {
+			switch {
+			case v.kind == fmScalar:
+				meta = append(meta, &metaNode{key: f.key, value: v.text, pos: v.pos})
+			case v.kind == fmTable && (f.key == "author" || f.key == "contributor"):
+				if m := ctx.personMeta(f.key, v); m != nil {
+					meta = append(meta, m)
+				}
+			default:
+				ctx.warnAt(v.pos, "front matter key %s cannot have nested values, ignored", f.key)
+			}
+		}
+	}
+	return meta
+}
+
+// personMeta returns the meta node of an author or contributor given as a
+// table, or nil.
+func (ctx *parseContext) personMeta(key string, v *fmValue) *metaNode {
+	m := &metaNode{key: key, pos: v.pos, attrs: map[string]string{}}
+	for _, f := range v.fields {
+		switch {
+		case !personFields[f.key]:
+			ctx.warnAt(f.pos, "unknown %s field %q ignored", key, f.key)
+		case f.value.kind != fmScalar:
+			ctx.warnAt(f.pos, "%s field %s must be text, ignored", key, f.key)
+		case f.key == "name":
+			m.value = f.value.text
+		default:
+			m.attrs[f.key] = f.value.text
+		}
+	}
+	if m.value == "" {
+		ctx.warnAt(v.pos, "%s without name ignored", key)
+		return nil
+	}
+	return m
+}
+
+// yamlParser parses the block structure of YAML by indentation.
+type yamlParser struct {
+	lines []sourceLine
+	i     int // the line being parsed
+}
+
+// parseYAML parses the lines of YAML front matter. After an error, it
+// returns the fields read before it, too.
+func parseYAML(lines []sourceLine) (*fmValue, error) {
+	// The lines are copied, list items are rewritten while parsing.
+	p := &yamlParser{lines: append([]sourceLine(nil), lines...)}
+	p.skipBlank()
+	if p.done() {
+		return &fmValue{kind: fmTable}, nil
+	}
+	l := p.lines[p.i]
+	if n := indentOf(l.text); n > 0 || isYAMLItem(l.text) {
+		return nil, fmErrorf(l.pos.shift(n), "expected key: value")
+	}
+	root, err := p.mapping(0)
+	if err != nil {
+		return root, err
+	}
+	if p.skipBlank(); !p.done() {
+		l := p.lines[p.i]
+		return root, fmErrorf(l.pos.shift(indentOf(l.text)), "unexpected indentation")
+	}
+	return root, nil
+}
+
+func (p *yamlParser) done() bool { return p.i >= len(p.lines) }
+
+// skipBlank skips blank lines and comment lines.
+func (p *yamlParser) skipBlank() {
+	for !p.done() {
+		t := strings.TrimSpace(p.lines[p.i].text)
+		if t != "" && !strings.HasPrefix(t, "#") {
+			return
+		}
+		p.i++
+	}
+}
+
+// block parses the list or table starting at the current line.
+func (p *yamlParser) block() (*fmValue, error) {
+	l := p.lines[p.i]
+	if strings.HasPrefix(strings.TrimLeft(l.text, " "), "\t") {
+		return nil, fmErrorf(l.pos, "tabs cannot indent YAML")
+	}
+	n := indentOf(l.text)
+	if isYAMLItem(l.text[n:]) {
+		return p.sequence(n)
+	}
+	return p.mapping(n)
+}
+
+// sequence parses the "- item" lines indented by n.
+func (p *yamlParser) sequence(n int) (*fmValue, error) {
+	l := p.lines[p.i]
+	v := &fmValue{kind: fmList, pos: l.pos.shift(n)}
+	for p.skipBlank(); !p.done(); p.skipBlank() {
+		l = p.lines[p.i]
+		if indentOf(l.text) != n || !isYAMLItem(l.text[n:]) {
+			break
+		}
+		rest := strings.TrimLeft(l.text[n+1:], " ")
+		col := len(l.text) - len(rest)
+		var item *fmValue
+		var err error
+		switch {
+		case rest == "":
+			p.i++
+			if p.skipBlank(); !p.done() && indentOf(p.lines[p.i].text) > n {
+				item, err = p.block()
+			} else {
+				item = &fmValue{pos: l.pos.shift(n)}
+			}
+		case isYAMLItem(rest) || yamlKey(rest) != "":
+			// A nested list or table starts on the line of the item: the
+			// dash becomes indentation.
+			p.lines[p.i].text = strings.Repeat(" ", col) + rest
+			item, err = p.block()
+		default:
+			item, err = yamlScalar(rest, l.pos.shift(col))
+			p.i++
+		}
+		if err != nil {
+			return v, err
+		}
+		v.list = append(v.list, item)
+	}
+	return v, nil
+}
+
+// mapping parses the "key: value" lines indented by n.
+func (p *yamlParser) mapping(n int) (*fmValue, error) {
+	v := &fmValue{kind: fmTable, pos: p.lines[p.i].pos.shift(n)}
+	for p.skipBlank(); !p.done(); p.skipBlank() {
+		l := p.lines[p.i]
+		indent := indentOf(l.text)
+		if indent < n {
+			break
+		}
+		if strings.HasPrefix(l.text[indent:], "\t") {
+			return v, fmErrorf(l.pos.shift(indent), "tabs cannot indent YAML")
+		}
+		if indent > n {
+			return v, fmErrorf(l.pos.shift(indent), "unexpected indentation")
+		}
+		key := yamlKey(l.text[n:])
+		if key == "" {
+			return v, fmErrorf(l.pos.shift(n), "expected key: value")
+		}
+		keyPos := l.pos.shift(n)
+		rest := strings.TrimSpace(l.text[n+len(key)+1:])
+		col := len(l.text) - len(strings.TrimLeft(l.text[n+len(key)+1:], " "))
+		key = strings.TrimSpace(key)
+		p.i++
+
+		var value *fmValue
+		var err error
+		switch {
+		case rest == "" || strings.HasPrefix(rest, "#"):
+			p.skipBlank()
+			switch {
+			case p.done():
+				value = &fmValue{pos: keyPos}
+			case indentOf(p.lines[p.i].text) > n:
+				value, err = p.block()
+			case indentOf(p.lines[p.i].text) == n && isYAMLItem(p.lines[p.i].text[n:]):
+				value, err = p.sequence(n) // a list may be indented like its key
+			default:
+				value = &fmValue{pos: keyPos}
+			}
+		case strings.TrimRight(rest, "+-") == "|" || strings.TrimRight(rest, "+-") == ">":
+			value = p.blockScalar(n, rest[0] == '>', l.pos.shift(col))
+		default:
+			value, err = yamlScalar(rest, l.pos.shift(col))
+		}
+		if err != nil {
+			return v, err
+		}
+		if err := v.set(key, value, keyPos); err != nil {
+			return v, err
+		}
+	}
+	return v, nil
+}
+
+// blockScalar parses the lines of a | or > block indented deeper than n.
+// A > block folds its lines into one, a blank line starting a new one.
+func (p *yamlParser) blockScalar(n int, folded bool, pos sourcePos) *fmValue {
+	var lines []string
+	indent := -1
+	for ; !p.done(); p.i++ {
+		text := p.lines[p.i].text
+		if strings.TrimSpace(text) == "" {
+			lines = append(lines, "")
+			continue
+		}
+		m := indentOf(text)
+		if m <= n {
+			break
+		}
+		if indent < 0 {
+			indent = m
+		}
+		lines = append(lines, text[min(m, indent):])
+	}
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	if !folded {
+		return &fmValue{text: strings.Join(lines, "\n"), pos: pos}
+	}
+	var b strings.Builder
+	for i, line := range lines {
+		switch {
+		case line == "":
+			b.WriteString("\n")
+		case i > 0 && lines[i-1] != "":
+			b.WriteString(" " + line)
+		default:
+			b.WriteString(line)
+		}
+	}
+	return &fmValue{text: b.String(), pos: pos}
+}
+
+func indentOf(s string) int {
+	return len(s) - len(strings.TrimLeft(s, " "))
+}
+
+func isYAMLItem(s string) bool {
+	return s == "-" || strings.HasPrefix(s, "- ")
+}
+
+// yamlKey returns the key of a "key: value" line, or "".
+func yamlKey(s string) string {
+	if s == "" || strings.ContainsRune(`"'[{#-`, rune(s[0])) {
+		return ""
+	}
+	for i := 0; i < len(s); i++ {
+		if s[i] == ':' && (i+1 == len(s) || s[i+1] == ' ') {
+			return s[:i]
+		}
+	}
+	return ""
+}
+
+// yamlScalar parses the value after "key:" or "- ", which may also be a
+// [flow, list] or a {flow: table}.
+func yamlScalar(s string, pos sourcePos) (*fmValue, error) {
+	if s[0] == '[' || s[0] == '{' || s[0] == '"' || s[0] == '\'' {
+		v, i, err := yamlFlow(s, 0, pos)
+		if err != nil {
+			return nil, err
+		}
+		if rest := strings.TrimSpace(s[i:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, fmErrorf(pos.shift(i), "unexpected %q after the value", rest)
+		}
+		return v, nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = s[:i]
+	}
+	return &fmValue{text: strings.TrimSpace(s), pos: pos}, nil
+}
+
+// yamlFlow parses the flow value at s[i:] and returns it with the index
+// after it.
+func yamlFlow(s string, i int, pos sourcePos) (*fmValue, int, error) {
+	for i < len(s) && s[i] == ' ' {
+		i++
+	}
+	at := pos.shift(i)
+	if i == len(s) {
+		return nil, i, fmErrorf(at, "missing value")
+	}
+	switch s[i] {
+	case '"', '\'':
+		text, n, err := quotedString(s[i:], at)
+		return &fmValue{text: text, pos: at}, i + n, err
+	case '[', '{':
+		closing := byte(']')
+		v := &fmValue{kind: fmList, pos: at}
+		if s[i] == '{' {
+			closing, v.kind = '}', fmTable
+		}
+		i++
+		for {
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			if i < len(s) && s[i] == closing {
+				return v, i + 1, nil
+			}
+			if v.kind == fmTable {
+				colon := strings.IndexByte(s[i:], ':')
+				if colon <= 0 {
+					return nil, i, fmErrorf(pos.shift(i), "expected key: value")
+				}
+				key := strings.TrimSpace(s[i : i+colon])
+				item, next, err := yamlFlow(s, i+colon+1, pos)
+				if err != nil {
+					return nil, next, err
+				}
+				if err := v.set(key, item, pos.shift(i)); err != nil {
+					return nil, next, err
+				}
+				i = next
+			} else {
+				item, next, err := yamlFlow(s, i, pos)
+				if err != nil {
+					return nil, next, err
+				}
+				v.list = append(v.list, item)
+				i = next
+			}
+			for i < len(s) && s[i] == ' ' {
+				i++
+			}
+			switch {
+			case i < len(s) && s[i] == ',':
+				i++
+			case i < len(s) && s[i] == closing:
+			default:
+				return nil, i, fmErrorf(pos.shift(i), "expected , or %c", closing)
+			}
+		}
+	}
+	end := i
+	for end < len(s) && !strings.ContainsRune(",]}", rune(s[end])) {
+		end++
+	}
+	return &fmValue{text: strings.TrimSpace(s[i:end]), pos: at}, end, nil
+}
+
+// quotedString parses the string in double or single quotes at the start
+// of s and returns it with its length in s. Double quotes know backslash
+// escapes; in single quotes, a doubled quote stands for one.
+func quotedString(s string, pos sourcePos) (string, int, error) {
+	q := s[0]
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch {
+		case s[i] == q && q == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case s[i] == q:
+			return b.String(), i + 1, nil
+		case s[i] == '\\' && q == '"' && i+1 < len(s):
+			r, n, err := unescapeChar(s[i:])
+			if err != nil {
+				return "", i, fmErrorf(pos.shift(i), "%v", err)
+			}
+			b.WriteString(r)
+			i += n - 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", len(s), fmErrorf(pos, "string is not closed")
+}
+
+// unescapeString resolves the backslash escapes in s.
+func unescapeString(s string, pos sourcePos) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		r, n, err := unescapeChar(s[i:])
+		if err != nil {
+			return "", fmErrorf(pos, "%v", err)
+		}
+		b.WriteString(r)
+		i += n - 1
+	}
+	return b.String(), nil
+}
+
+// unescapeChar resolves the backslash escape at the start of s and returns
+// it with its length.
+func unescapeChar(s string) (string, int, error) {
+	switch s[1] {
+	case 'n':
+		return "\n", 2, nil
+	case 't':
+		return "\t", 2, nil
+	case '"', '\\', '/', '\'':
+		return s[1:2], 2, nil
+	case 'u', 'U':
+		n := 4
+		if s[1] == 'U' {
+			n = 8
+		}
+		if len(s) >= 2+n {
+			if r, err := strconv.ParseUint(s[2:2+n], 16, 32); err == nil {
+				return string(rune(r)), 2 + n, nil
+			}
+		}
+	}
+	return "", 0, fmt.Errorf("invalid escape %s", s[:2])
+}
+
+// tomlParser parses TOML character by character; values may span lines.
+type tomlParser struct {
+	lines []sourceLine
+	l, c  int // line and byte of the next character
+}
+
+// parseTOML parses the lines of TOML front matter. After an error, it
+// returns the values read before it, too.
+func parseTOML(lines []sourceLine) (*fmValue, error) {
+	p := &tomlParser{lines: lines}
+	root := &fmValue{kind: fmTable}
+	table := root
+	for p.skipBlank(); !p.done(); p.skipBlank() {
+		pos := p.pos()
+		if p.peek() == '[' {
+			p.next()
+			array := p.peek() == '['
+			if array {
+				p.next()
+			}
+			p.skipSpace()
+			key, err := p.key()
+			if err != nil {
+				return root, err
+			}
+			p.skipSpace()
+			if !p.accept(']') || (array && !p.accept(']')) {
+				return root, fmErrorf(p.pos(), "expected ]")
+			}
+			table = &fmValue{kind: fmTable, pos: pos}
+			if array {
+				list := root.field(key)
+				if list == nil {
+					list = &fmValue{kind: fmList, pos: pos}
+					root.fields = append(root.fields, fmField{key: key, value: list, pos: pos})
+				} else if list.kind != fmList {
+					return root, fmErrorf(pos, "key %s given twice", key)
+				}
+				list.list = append(list.list, table)
+			} else if err := root.set(key, table, pos); err != nil {
+				return root, err
+			}
+		} else {
+			key, err := p.key()
+			if err != nil {
+				return root, err
+			}
+			p.skipSpace()
+			if !p.accept('=') {
+				return root, fmErrorf(p.pos(), "expected = after %s", key)
+			}
+			p.skipSpace()
+			value, err := p.value()
+			if err != nil {
+				return root, err
+			}
+			if err := table.set(key, value, pos); err != nil {
+				return root, err
+			}
+		}
+		if err := p.endOfLine(); err != nil {
+			return root, err
+		}
+	}
+	return root, nil
+}
+
+func (p *tomlParser) done() bool { return p.l >= len(p.lines) }
+
+// peek returns the next character, '\n' at the end of a line and 0 at the
+// end of the input.
+func (p *tomlParser) peek() byte {
+	switch {
+	case p.done():
+		return 0
+	case p.c >= len(p.lines[p.l].text):
+		return '\n'
+	}
+	return p.lines[p.l].text[p.c]
+}
+
+func (p *tomlParser) next() {
+	if p.c >= len(p.lines[p.l].text) {
+		p.l, p.c = p.l+1, 0
+	} else {
+		p.c++
+	}
+}
+
+func (p *tomlParser) accept(c byte) bool {
+	if p.peek() != c {
+		return false
+	}
+	p.next()
+	return true
+}
+
+func (p *tomlParser) pos() sourcePos {
+	if p.done() {
+		return p.lines[len(p.lines)-1].pos
+	}
+	return p.lines[p.l].pos.shift(p.c)
+}
+
+func (p *tomlParser) skipSpace() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.next()
+	}
+}
+
+// skipBlank skips whitespace, line ends and comments.
+func (p *tomlParser) skipBlank() {
+	for {
+		switch p.peek() {
+		case ' ', '\t', '\n', '\r':
+			p.next()
+		case '#':
+			p.c = len(p.lines[p.l].text)
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine accepts the rest of the line if it is blank or a comment.
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	switch p.peek() {
+	case '#', '\n', '\r', 0:
+		if !p.done() {
+			p.l, p.c = p.l+1, 0
+		}
+		return nil
+	}
+	return fmErrorf(p.pos(), "unexpected %q at the end of the line", p.lines[p.l].text[p.c:])
+}
+
+func (p *tomlParser) key() (string, error) {
+	if c := p.peek(); c == '"' || c == '\'' {
+		line := p.lines[p.l].text
+		key, n, err := quotedString(line[p.c:], p.pos())
+		p.c += n
+		return key, err
+	}
+	start := p.c
+	for c := p.peek(); c == '_' || c == '-' || isIdentByte(c); c = p.peek() {
+		p.next()
+	}
+	if p.c == start {
+		return "", fmErrorf(p.pos(), "expected a key")
+	}
+	return p.lines[p.l].text[start:p.c], nil
+}
+
+func (p *tomlParser) value() (*fmValue, error) {
+	pos := p.pos()
+	if p.done() {
+		return nil, fmErrorf(pos, "missing value")
+	}
+	rest := p.lines[p.l].text[p.c:]
+	switch {
+	case strings.HasPrefix(rest, `"""`), strings.HasPrefix(rest, `'''`):
+		return p.multilineString(rest[:3])
+	case rest == "":
+		return nil, fmErrorf(pos, "missing value")
+	case rest[0] == '"':
+		text, n, err := quotedString(rest, pos)
+		p.c += n
+		return &fmValue{text: text, pos: pos}, err
+	case rest[0] == '\'':
+		// Literal strings know no escapes.
+		end := strings.IndexByte(rest[1:], '\'')
+		if end < 0 {
+			return nil, fmErrorf(pos, "string is not closed")
+		}
+		p.c += end + 2
+		return &fmValue{text: rest[1 : end+1], pos: pos}, nil
+	case rest[0] == '[':
+		p.next()
+		v := &fmValue{kind: fmList, pos: pos}
+		for {
+			p.skipBlank()
+			if p.accept(']') {
+				return v, nil
+			}
+			item, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			v.list = append(v.list, item)
+			p.skipBlank()
+			if !p.accept(',') && p.peek() != ']' {
+				return nil, fmErrorf(p.pos(), "expected , or ]")
+			}
+		}
+	case rest[0] == '{':
+		p.next()
+		v := &fmValue{kind: fmTable, pos: pos}
+		for {
+			p.skipSpace()
+			if p.accept('}') {
+				return v, nil
+			}
+			keyPos := p.pos()
+			key, err := p.key()
+			if err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if !p.accept('=') {
+				return nil, fmErrorf(p.pos(), "expected = after %s", key)
+			}
+			p.skipSpace()
+			item, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			if err := v.set(key, item, keyPos); err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			if !p.accept(',') && p.peek() != '}' {
+				return nil, fmErrorf(p.pos(), "expected , or }")
+			}
+		}
+	}
+	// Numbers, booleans and dates are kept as written.
+	end := strings.IndexAny(rest, ",]}#")
+	if end < 0 {
+		end = len(rest)
+	}
+	p.c += end
+	return &fmValue{text: strings.TrimSpace(rest[:end]), pos: pos}, nil
+}
+
+// multilineString parses a triple-quoted string, which may span lines. A line
+// end directly after the opening quotes is not part of the string.
+func (p *tomlParser) multilineString(quotes string) (*fmValue, error) {
+	pos := p.pos()
+	p.c += 3
+	var lines []string
+	for first := true; !p.done(); first = false {
+		line := p.lines[p.l].text[p.c:]
+		if end := strings.Index(line, quotes); end >= 0 {
+			lines = append(lines, line[:end])
+			p.c += end + 3
+			text := strings.Join(lines, "\n")
+			if quotes == `"""` {
+				var err error
+				if text, err = unescapeString(text, pos); err != nil {
+					return nil, err
+				}
+			}
+			return &fmValue{text: text, pos: pos}, nil
+		}
+		if !first || line != "" {
+			lines = append(lines, line)
+		}
+		p.l, p.c = p.l+1, 0
+	}
+	return nil, fmErrorf(pos, "string is not closed")
+}
@@ -0,0 +1,210 @@
+package spell
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// dumpFM writes v in a compact form: scalars quoted, [lists] and
+// {key: tables}.
+func dumpFM(v *fmValue) string {
+	switch v.kind {
+	case fmList:
+		items := make([]string, len(v.list))
+		for i, item := range v.list {
+			items[i] = dumpFM(item)
+		}
+		return "[" + strings.Join(items, ", ") + "]"
+	case fmTable:
+		fields := make([]string, len(v.fields))
+		for i, f := range v.fields {
+			fields[i] = f.key + ": " + dumpFM(f.value)
+		}
+		return "{" + strings.Join(fields, ", ") + "}"
+	}
+	return strconv.Quote(v.text)
+}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"scalars", "title: The Lantern\nlanguage: en", `{title: "The Lantern", language: "en"}`},
+		{"empty", "", `{}`},
+		{"colon in value", "title: Part 1: The Lantern", `{title: "Part 1: The Lantern"}`},
+		{"url value", "source: https://example.com/x", `{source: "https://example.com/x"}`},
+		{"comments", "# the book\ntitle: Lantern # working title\n\n  # indented comment\nlanguage: en",
+			`{title: "Lantern", language: "en"}`},
+		{"hash in word", "title: C#", `{title: "C#"}`},
+		{"double quotes", `title: "A \"lit\" lamp: \u00e9\tend # no comment"`, `{title: "A \"lit\" lamp: é\tend # no comment"}`},
+		{"single quotes", `title: 'It''s \n here'`, `{title: "It's \\n here"}`},
+		{"block list", "author:\n  - Jane Doe\n  - Joe Bloggs", `{author: ["Jane Doe", "Joe Bloggs"]}`},
+		{"list indented like key", "subject:\n- FIC000000\n- FIC028000\nlanguage: en",
+			`{subject: ["FIC000000", "FIC028000"], language: "en"}`},
+		{"flow list", `subject: [FIC000000, "Fiction, general", 'x']`, `{subject: ["FIC000000", "Fiction, general", "x"]}`},
+		{"flow table", "author: {name: Jane Doe, role: aut}", `{author: {name: "Jane Doe", role: "aut"}}`},
+		{"nested flow", "a: [{name: x}, [y, z], []]", `{a: [{name: "x"}, ["y", "z"], []]}`},
+		{"list of tables", "author:\n  - name: Jane Doe\n    sort-name: Doe, Jane\n  - Joe Bloggs",
+			`{author: [{name: "Jane Doe", sort-name: "Doe, Jane"}, "Joe Bloggs"]}`},
+		{"nested table", "a:\n  b:\n    c: d\n  e: f", `{a: {b: {c: "d"}, e: "f"}}`},
+		{"empty value", "title:\nlanguage: en", `{title: "", language: "en"}`},
+		{"literal block", "description: |\n  One line.\n    Indented.\n\n  Last.\nlanguage: en",
+			`{description: "One line.\n  Indented.\n\nLast.", language: "en"}`},
+		{"folded block", "description: >-\n  One\n  line.\n\n  Two.\n", `{description: "One line.\nTwo."}`},
+		{"dashes in item", "- a", ``},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := parseYAML(splitLines(tt.src, "fm.md"))
+			if tt.want == "" {
+				if err == nil {
+					t.Errorf("got %s, want an error", dumpFM(v))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := dumpFM(v); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseTOML(t *testing.T) {
+	tests := []struct {
+		name, src, want string
+	}{
+		{"scalars", "title = \"The Lantern\"\nyear = 1923\ndraft = false", `{title: "The Lantern", year: "1923", draft: "false"}`},
+		{"comments", "# the book\ntitle = \"Lantern\" # working title\n\nlanguage = 'en'", `{title: "Lantern", language: "en"}`},
+		{"escapes", `title = "A \"lit\" lamp\u00e9\n"`, `{title: "A \"lit\" lampé\n"}`},
+		{"literal string", `path = 'C:\books\x'`, `{path: "C:\\books\\x"}`},
+		{"quoted key", `"sort-name" = "x"`, `{sort-name: "x"}`},
+		{"list", `subject = ["FIC000000", "Fiction, general"]`, `{subject: ["FIC000000", "Fiction, general"]}`},
+		{"list over lines", "subject = [\n  \"a\", # first\n  \"b\",\n]", `{subject: ["a", "b"]}`},
+		{"inline table", `author = { name = "Jane Doe", role = "aut" }`, `{author: {name: "Jane Doe", role: "aut"}}`},
+		{"table", "title = \"x\"\n[series]\nname = \"y\"\nnumber = 2", `{title: "x", series: {name: "y", number: "2"}}`},
+		{"array of tables", "[[author]]\nname = \"Jane Doe\"\n\n[[author]]\nname = \"Joe Bloggs\"\nrole = \"edt\"",
+			`{author: [{name: "Jane Doe"}, {name: "Joe Bloggs", role: "edt"}]}`},
+		{"multi-line basic", "description = \"\"\"\nOne\\tline.\nTwo.\"\"\"", `{description: "One\tline.\nTwo."}`},
+		{"multi-line literal", "description = '''\nC:\\x\n'''", `{description: "C:\\x\n"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := parseTOML(splitLines(tt.src, "fm.md"))
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := dumpFM(v); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFrontMatterErrors(t *testing.T) {
+	tests := []struct {
+		name, src, pos, msg string
+	}{
+		{"yaml list at top", "- a", "fm.md:1:1", "expected key: value"},
+		{"yaml indented first key", "  title: x", "fm.md:1:3", "expected key: value"},
+		{"yaml no colon", "title: x\nlanguage en", "fm.md:2:1", "expected key: value"},
+		{"yaml indentation", "title: x\n  language: en", "fm.md:2:3", "unexpected indentation"},
+		{"yaml key twice", "title: x\ntitle: y", "fm.md:2:1", "key title given twice"},
+		{"yaml tab", "author:\n\t- x", "fm.md:2:1", "tabs cannot indent YAML"},
+		{"yaml unclosed string", `title: "x`, "fm.md:1:8", "string is not closed"},
+		{"yaml bad escape", `title: "a\qb"`, "fm.md:1:10", `invalid escape \q`},
+		{"yaml after string", `title: "x" y`, "fm.md:1:11", `unexpected "y" after the value`},
+		{"yaml flow list", "subject: [a b", "fm.md:1:14", "expected , or ]"},
+		{"yaml flow table", "author: {name}", "fm.md:1:10", "expected key: value"},
+		{"toml no equals", "title \"x\"", "fm.md:1:7", "expected = after title"},
+		{"toml missing value", "title =", "fm.md:1:8", "missing value"},
+		{"toml after value", `title = "x" y`, "fm.md:1:13", `unexpected "y" at the end of the line`},
+		{"toml key twice", "[a]\nb = 1\n[a]", "fm.md:3:1", "key a given twice"},
+		{"toml unclosed table", "[a", "fm.md:1:3", "expected ]"},
+		{"toml unclosed multi-line", "d = \"\"\"\nx", "fm.md:1:5", "string is not closed"},
+		{"toml inline table", `a = {b = "1" c = 2}`, "fm.md:1:14", "expected , or }"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			parse := parseYAML
+			if strings.HasPrefix(tt.name, "toml") {
+				parse = parseTOML
+			}
+			_, err := parse(splitLines(tt.src, "fm.md"))
+			e, ok := err.(*fmError)
+			if !ok {
+				t.Fatalf("got error %v, want an fmError", err)
+			}
+			if e.pos.String() != tt.pos || e.msg != tt.msg {
+				t.Errorf("got %s: %s, want %s: %s", e.pos, e.msg, tt.pos, tt.msg)
+			}
+		})
+	}
+}
+
+func TestFrontMatterKeepsValuesBeforeError(t *testing.T) {
+	for _, md := range []string{
+		"---\ntitle: The Lantern\nlanguage: en\nauthor: [Jane\n---\n# One\n",
+		"+++\ntitle = \"The Lantern\"\nlanguage = \"en\"\nauthor = \n+++\n# One\n",
+	} {
+		var diags bytes.Buffer
+		ctx := newTestContext(nil, &diags)
+		rest := ctx.parseFrontMatter(splitLines(md, "main.md"))
+		if !strings.Contains(diags.String(), "main.md:4:") || !strings.Contains(diags.String(), "error: invalid front matter") {
+			t.Errorf("diagnostics %q, want an error on line 4", diags.String())
+		}
+		if len(rest) != 2 || rest[0].text != "# One" {
+			t.Errorf("lines after the front matter: %q", texts(rest))
+		}
+		var got []string
+		for _, b := range ctx.frontMatter {
+			m := b.(*metaNode)
+			got = append(got, m.key+"="+m.value)
+		}
+		if strings.Join(got, " ") != "title=The Lantern language=en" {
+			t.Errorf("kept %q, want title and language", got)
+		}
+	}
+}
+
+func TestFrontMatterMeta(t *testing.T) {
+	md := "---\ntitle: The Lantern\nauthor:\n  - name: Jane Doe\n    sort-name: Doe, Jane\n    born: 1970\n  - Joe Bloggs\n  - role: edt\n" +
+		"quotes: [«, », ‹, ›]\nsubtitle: x\nsubject: [[a]]\n---\n"
+	var diags bytes.Buffer
+	ctx := newTestContext(nil, &diags)
+	ctx.parseFrontMatter(splitLines(md, "main.md"))
+	var got []string
+	for _, b := range ctx.frontMatter {
+		m := b.(*metaNode)
+		got = append(got, m.key+"="+m.value+dumpAttrs(m.attrs))
+	}
+	want := "title=The Lantern author=Jane Doe{sort-name=Doe, Jane} author=Joe Bloggs quotes=«,»,‹,›"
+	if strings.Join(got, " ") != want {
+		t.Errorf("got  %s\nwant %s", strings.Join(got, " "), want)
+	}
+	for _, w := range []string{
+		`main.md:6:5: warning: unknown author field "born" ignored`,
+		"main.md:8:5: warning: author without name ignored",
+		`main.md:10:1: warning: unknown front matter key "subtitle" ignored`,
+		"main.md:11:11: warning: front matter key subject cannot have nested values, ignored",
+	} {
+		if !strings.Contains(diags.String(), w) {
+			t.Errorf("missing %q in\n%s", w, diags.String())
+		}
+	}
+}
+
+func dumpAttrs(attrs map[string]string) string {
+	if len(attrs) == 0 {
+		return ""
+	}
+	var s []string
+	for k, v := range attrs {
+		s = append(s, k+"="+v)
+	}
+	return "{" + strings.Join(s, ",") + "}"
+}
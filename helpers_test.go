@@ -0,0 +1,145 @@
+package spell
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// testBook is a SpellBook that keeps what it is given in memory, so tests
+// can look at the chapters without an EPUB or AZW3 writer.
+type testBook struct {
+	chapters    []testChapter
+	stylesheets map[string]string // path → content
+	meta        []string          // "method value" for every metadata call
+}
+
+type testChapter struct {
+	file, title, content string
+}
+
+type testNavpoint struct{}
+
+func (testNavpoint) AddNavpoint(label, filename string, order int) NavpointAdder {
+	return testNavpoint{}
+}
+
+func (b *testBook) addMeta(method, value string) { b.meta = append(b.meta, method+" "+value) }
+
+func (b *testBook) SetTitle(title string)                                 { b.addMeta("SetTitle", title) }
+func (b *testBook) AddAuthor(author string)                               { b.addMeta("AddAuthor", author) }
+func (b *testBook) AddLanguage(lang string) error                         { b.addMeta("AddLanguage", lang); return nil }
+func (b *testBook) SetSeries(s string) error                              { b.addMeta("SetSeries", s); return nil }
+func (b *testBook) SetSet(s string) error                                 { b.addMeta("SetSet", s); return nil }
+func (b *testBook) SetEntryNumber(n string) error                         { b.addMeta("SetEntryNumber", n); return nil }
+func (b *testBook) SetUUID(uu string) error                               { b.addMeta("SetUUID", uu); return nil }
+func (b *testBook) AddDate(date string)                                   { b.addMeta("AddDate", date) }
+func (b *testBook) AddRights(rights string)                               { b.addMeta("AddRights", rights) }
+func (b *testBook) AddSource(source string)                               { b.addMeta("AddSource", source) }
+func (b *testBook) AddRelation(rel string)                                { b.addMeta("AddRelation", rel) }
+func (b *testBook) AddType(t string)                                      { b.addMeta("AddType", t) }
+func (b *testBook) SetISBN(isbn string) error                             { b.addMeta("SetISBN", isbn); return nil }
+func (b *testBook) SetPublisher(p string)                                 { b.addMeta("SetPublisher", p) }
+func (b *testBook) SetDescription(d string)                               { b.addMeta("SetDescription", d) }
+func (b *testBook) AddSubject(s string)                                   { b.addMeta("AddSubject", s) }
+func (b *testBook) SetTitleSort(t string)                                 { b.addMeta("SetTitleSort", t) }
+func (b *testBook) SetAuthorSort(a string)                                { b.addMeta("SetAuthorSort", a) }
+func (b *testBook) SetCoverImage(id string)                               {}
+func (b *testBook) SetStartReading(filename string)                       {}
+func (b *testBook) Write(filename string) error                           { return nil }
+func (b *testBook) AddImageFile(source, dest string) (string, error)      { return dest, nil }
+func (b *testBook) AddImage(path string, contents []byte) (string, error) { return path, nil }
+
+func (b *testBook) AddContributor(name, role, sortName string) {
+	b.addMeta("AddContributor", name+"|"+role+"|"+sortName)
+}
+
+func (b *testBook) AddXHTML(filename, title, content string, order int) (string, error) {
+	b.chapters = append(b.chapters, testChapter{file: filename, title: title, content: content})
+	return filename, nil
+}
+
+func (b *testBook) AddStylesheet(path, content string) {
+	if b.stylesheets == nil {
+		b.stylesheets = map[string]string{}
+	}
+	b.stylesheets[path] = content
+}
+
+func (b *testBook) AddNavpoint(label, filename string, order int) NavpointAdder {
+	return testNavpoint{}
+}
+
+// body returns the content of all chapters.
+func (b *testBook) body() string {
+	var s strings.Builder
+	for _, c := range b.chapters {
+		s.WriteString(c.content)
+	}
+	return s.String()
+}
+
+// testConversion is the outcome of converting markdown in a test.
+type testConversion struct {
+	book  *testBook
+	diags string // the diagnostics, one per line
+	err   error
+}
+
+// convertFiles converts main.md of files, with c configuring the Converter
+// if not nil.
+func convertFiles(t *testing.T, files map[string]string, c *Converter) testConversion {
+	t.Helper()
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	if c == nil {
+		c = &Converter{}
+	}
+	var diags bytes.Buffer
+	c.FS = fsys
+	c.Logger = log.New(&diags, "", 0)
+	book := &testBook{}
+	err := c.ProcessMarkdownFile(book, "main.md", nil)
+	return testConversion{book: book, diags: diags.String(), err: err}
+}
+
+// convertMarkdown converts main.md with the content md.
+func convertMarkdown(t *testing.T, md string) testConversion {
+	t.Helper()
+	return convertFiles(t, map[string]string{"main.md": md}, nil)
+}
+
+// newTestContext returns a parse context reading from files, with the
+// diagnostics going to diags.
+func newTestContext(files map[string]string, diags *bytes.Buffer) *parseContext {
+	fsys := fstest.MapFS{}
+	for name, content := range files {
+		fsys[name] = &fstest.MapFile{Data: []byte(content)}
+	}
+	c := &Converter{FS: fsys, Logger: log.New(diags, "", 0)}
+	return newParseContext(c, &testBook{}, ".")
+}
+
+// texts returns the text of lines.
+func texts(lines []sourceLine) []string {
+	out := make([]string, len(lines))
+	for i, l := range lines {
+		out[i] = l.text
+	}
+	return out
+}
+
+// convertAs converts md like convertMarkdown, but renders it as format.
+func convertAs(t *testing.T, format outputFormat, md string) testConversion {
+	t.Helper()
+	var diags bytes.Buffer
+	ctx := newTestContext(map[string]string{"main.md": md}, &diags)
+	ctx.format = format
+	ctx.parseMarkdown(ctx.replaceAllIncludes(ctx.parseFrontMatter(splitLines(md, "main.md"))), nil)
+	err := ctx.result()
+	return testConversion{book: ctx.book.(*testBook), diags: diags.String(), err: err}
+}
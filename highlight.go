@@ -0,0 +1,252 @@
+package spell
+
+import (
+	"strings"
+)
+
+// language describes what the highlighter needs to know about a
+// programming language. The highlighter is a simple lexer: it finds
+// comments, strings, numbers, keywords and type names, which is enough to
+// make code readable, also in grayscale.
+type language struct {
+	lineComments  []string  // e.g. "//" or "#"
+	blockComment  [2]string // start and end, e.g. "/*" and "*/"; empty if none
+	quotes        string    // characters that delimit strings
+	rawQuotes     string    // string delimiters without escapes, spanning lines
+	tripleQuotes  bool      // """ and ''' strings, as in Python
+	caseSensitive bool
+	keywords      map[string]bool
+	types         map[string]bool
+}
+
+func words(s string) map[string]bool {
+	m := map[string]bool{}
+	for _, w := range strings.Fields(s) {
+		m[w] = true
+	}
+	return m
+}
+
+var cStyleComments = [2]string{"/*", "*/"}
+
+// languages maps the fence tags spell highlights to their description.
+var languages = map[string]*language{
+	"go": {
+		lineComments: []string{"//"}, blockComment: cStyleComments, quotes: `"'`, rawQuotes: "`", caseSensitive: true,
+		keywords: words("break case chan const continue default defer else fallthrough for func go goto if import interface map package range return select struct switch type var nil true false iota"),
+		types:    words("bool byte complex64 complex128 error float32 float64 int int8 int16 int32 int64 rune string uint uint8 uint16 uint32 uint64 uintptr any comparable append cap close copy delete len make new panic print println recover min max clear"),
+	},
+	"python": {
+		lineComments: []string{"#"}, quotes: `"'`, tripleQuotes: true, caseSensitive: true,
+		keywords: words("False None True and as assert async await break class continue def del elif else except finally for from global if import in is lambda nonlocal not or pass raise return try while with yield match case"),
+		types:    words("bool bytes dict float int list object set str tuple len print range open super self type isinstance enumerate zip map filter sorted"),
+	},
+	"javascript": {
+		lineComments: []string{"//"}, blockComment: cStyleComments, quotes: `"'`, rawQuotes: "`", caseSensitive: true,
+		keywords: words("async await break case catch class const continue debugger default delete do else export extends finally for from function if import in instanceof let new of return static super switch this throw try typeof var void while with yield null undefined true false"),
+		types:    words("Array Boolean Date Error JSON Map Math Number Object Promise RegExp Set String Symbol console"),
+	},
+	"typescript": {
+		lineComments: []string{"//"}, blockComment: cStyleComments, quotes: `"'`, rawQuotes: "`", caseSensitive: true,
+		keywords: words("abstract as async await break case catch class const continue declare default delete do else enum export extends finally for from function if implements import in instanceof interface let namespace new of private protected public readonly return static super switch this throw try type typeof var void while yield null undefined true false"),
+		types:    words("any boolean never number object string symbol unknown void Array Promise Record Partial"),
+	},
+	"java": {
+		lineComments: []string{"//"}, blockComment: cStyleComments, quotes: `"'`, caseSensitive: true,
+		keywords: words("abstract assert break case catch class continue default do else enum extends final finally for if implements import instanceof interface native new package private protected public return static super switch synchronized this throw throws try var void volatile while null true false"),
+		types:    words("boolean byte char double float int long short String Object Integer List Map"),
+	},
+	"c": {
+		lineComments: []string{"//"}, blockComment: cStyleComments, quotes: `"'`, caseSensitive: true,
+		keywords: words("break case const continue default do else enum extern for goto if inline register restrict return sizeof static struct switch typedef union volatile while NULL true false #include #define #ifdef #ifndef #endif #if #else #pragma"),
+		types:    words("bool char double float int long short signed unsigned void size_t uint8_t uint16_t uint32_t uint64_t int8_t int16_t int32_t int64_t FILE"),
+	},
+	"cpp": {
+		lineComments: []string{"//"}, blockComment: cStyleComments, quotes: `"'`, caseSensitive: true,
+		keywords: words("auto break case catch class const constexpr continue default delete do else enum explicit export extern for friend goto if inline namespace new noexcept nullptr operator private protected public return sizeof static struct switch template this throw try typedef typename union using virtual volatile while true false #include #define #ifdef #ifndef #endif #if #else #pragma"),
+		types:    words("bool char double float int long short signed unsigned void size_t string vector map std"),
+	},
+	"rust": {
+		lineComments: []string{"//"}, blockComment: cStyleComments, quotes: `"`, caseSensitive: true,
+		keywords: words("as async await break const continue crate dyn else enum extern false fn for if impl in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe use where while"),
+		types:    words("bool char f32 f64 i8 i16 i32 i64 i128 isize str u8 u16 u32 u64 u128 usize String Vec Option Result Box Some None Ok Err"),
+	},
+	"shell": {
+		lineComments: []string{"#"}, quotes: `"'`, caseSensitive: true,
+		keywords: words("if then else elif fi for while until do done case esac in function return local export exit"),
+		types:    words("echo cd ls cat grep sed awk printf read test set unset source"),
+	},
+	"sql": {
+		lineComments: []string{"--"}, blockComment: cStyleComments, quotes: `'"`,
+		keywords: words("select from where and or not insert into values update set delete create table drop alter index join left right inner outer on group by order having limit as distinct union all null is in like between primary key foreign references default"),
+		types:    words("int integer bigint smallint varchar char text boolean date timestamp numeric decimal float real serial"),
+	},
+	"json": {
+		quotes: `"`, caseSensitive: true,
+		keywords: words("true false null"),
+	},
+	"yaml": {
+		lineComments: []string{"#"}, quotes: `"'`, caseSensitive: true,
+		keywords: words("true false null yes no on off"),
+	},
+	"css": {
+		blockComment: cStyleComments, quotes: `"'`,
+		keywords: words("important inherit initial none auto"),
+	},
+}
+
+// languageAliases maps further fence tags to the names in languages.
+var languageAliases = map[string]string{
+	"golang": "go", "py": "python", "js": "javascript", "ts": "typescript",
+	"h": "c", "cc": "cpp", "cxx": "cpp", "hpp": "cpp", "rs": "rust",
+	"sh": "shell", "bash": "shell", "zsh": "shell", "yml": "yaml",
+}
+
+// lookupLanguage returns the language for a fence tag, or nil.
+func lookupLanguage(tag string) *language {
+	tag = strings.ToLower(tag)
+	if alias, ok := languageAliases[tag]; ok {
+		tag = alias
+	}
+	return languages[tag]
+}
+
+// token is a piece of highlighted code; class is "" for plain code.
+type token struct {
+	class string
+	text  string
+}
+
+// Token classes, styled by the highlight themes.
+const (
+	tokComment = "com"
+	tokString  = "str"
+	tokNumber  = "num"
+	tokKeyword = "kw"
+	tokType    = "typ"
+)
+
+// tokenize splits src into tokens. Comments and strings may span lines.
+func (lang *language) tokenize(src string) []token {
+	var tokens []token
+	plain := 0 // start of the pending plain text
+	emit := func(start, end int, class string) {
+		if plain < start {
+			tokens = append(tokens, token{text: src[plain:start]})
+		}
+		tokens = append(tokens, token{class: class, text: src[start:end]})
+		plain = end
+	}
+
+	for i := 0; i < len(src); {
+		rest := src[i:]
+		c := rest[0]
+		switch {
+		case lang.startsLineComment(rest):
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			emit(i, i+end, tokComment)
+			i += end
+		case lang.blockComment[0] != "" && strings.HasPrefix(rest, lang.blockComment[0]):
+			end := strings.Index(rest[len(lang.blockComment[0]):], lang.blockComment[1])
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(lang.blockComment[0]) + len(lang.blockComment[1])
+			}
+			emit(i, i+end, tokComment)
+			i += end
+		case lang.tripleQuotes && (strings.HasPrefix(rest, `"""`) || strings.HasPrefix(rest, `'''`)):
+			end := strings.Index(rest[3:], rest[:3])
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += 6
+			}
+			emit(i, i+end, tokString)
+			i += end
+		case strings.IndexByte(lang.rawQuotes, c) >= 0:
+			end := strings.IndexByte(rest[1:], c)
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += 2
+			}
+			emit(i, i+end, tokString)
+			i += end
+		case strings.IndexByte(lang.quotes, c) >= 0:
+			end := quotedEnd(rest)
+			emit(i, i+end, tokString)
+			i += end
+		case isDigit(c) && (i == 0 || !isIdentByte(src[i-1])):
+			end := 1
+			for end < len(rest) && (isIdentByte(rest[end]) || rest[end] == '.') {
+				end++
+			}
+			emit(i, i+end, tokNumber)
+			i += end
+		case isIdentStart(c) || c == '#':
+			end := 1
+			for end < len(rest) && isIdentByte(rest[end]) {
+				end++
+			}
+			word := rest[:end]
+			if !lang.caseSensitive {
+				word = strings.ToLower(word)
+			}
+			switch {
+			case i > 0 && isIdentByte(src[i-1]):
+			case lang.keywords[word]:
+				emit(i, i+end, tokKeyword)
+			case lang.types[word]:
+				emit(i, i+end, tokType)
+			}
+			i += end
+		default:
+			i++
+		}
+	}
+	if plain < len(src) {
+		tokens = append(tokens, token{text: src[plain:]})
+	}
+	return tokens
+}
+
+func (lang *language) startsLineComment(s string) bool {
+	for _, prefix := range lang.lineComments {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// quotedEnd returns the length of the string literal at the start of s,
+// which ends at the matching quote or, unterminated, at the end of the line.
+func quotedEnd(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case s[0]:
+			return i + 1
+		case '\n':
+			return i
+		}
+	}
+	return len(s)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentByte(c byte) bool {
+	return isIdentStart(c) || isDigit(c)
+}
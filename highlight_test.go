@@ -0,0 +1,147 @@
+package spell
+
+import (
+	"bytes"
+	"log"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// classified returns the tokens of src in lang that have a class, as
+// "class:text".
+func classified(lang, src string) []string {
+	var out []string
+	for _, t := range lookupLanguage(lang).tokenize(src) {
+		if t.class != "" {
+			out = append(out, t.class+":"+t.text)
+		}
+	}
+	return out
+}
+
+func TestTokenize(t *testing.T) {
+	tests := []struct {
+		lang, src string
+		want      []string
+	}{
+		{"go", `x := "a\"b" // note`, []string{`str:"a\"b"`, "com:// note"}},
+		{"go", "func fortune() string", []string{"kw:func", "typ:string"}},
+		{"go", "x1 := 0x1F + 2.5", []string{"num:0x1F", "num:2.5"}},
+		{"go", "s := `a\nb` + 'c'", []string{"str:`a\nb`", "str:'c'"}},
+		{"go", "/* one\ntwo */ var", []string{"com:/* one\ntwo */", "kw:var"}},
+		{"go", "/* open\nto the end", []string{"com:/* open\nto the end"}},
+		{"go", "\"open\nreturn", []string{`str:"open`, "kw:return"}},
+		{"go", `"\\" + "x"`, []string{`str:"\\"`, `str:"x"`}},
+		{"python", "def f(): # comment\n    return '''a\nb'''", []string{"kw:def", "com:# comment", "kw:return", "str:'''a\nb'''"}},
+		{"python", `s = "x # y"`, []string{`str:"x # y"`}},
+		{"sql", "SELECT name FROM t -- all", []string{"kw:SELECT", "kw:FROM", "com:-- all"}},
+		{"c", "#include <stdio.h>\nint main(void)", []string{"kw:#include", "typ:int", "typ:void"}},
+		{"shell", "echo $HOME # home", []string{"typ:echo", "com:# home"}},
+		{"json", `{"a": true, "b": 12}`, []string{`str:"a"`, "kw:true", `str:"b"`, "num:12"}},
+		{"rust", "let c = 'x';", []string{"kw:let"}},
+	}
+	for _, tt := range tests {
+		if got := classified(tt.lang, tt.src); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s %q: got %q, want %q", tt.lang, tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestTokenizeKeepsSource(t *testing.T) {
+	src := "package main\n\n// x\nfunc main() { s := \"a\" + `b\nc` /* d */ }\n"
+	var b strings.Builder
+	for _, t := range lookupLanguage("go").tokenize(src) {
+		b.WriteString(t.text)
+	}
+	if b.String() != src {
+		t.Errorf("tokens give %q, want %q", b.String(), src)
+	}
+}
+
+func TestLookupLanguage(t *testing.T) {
+	tests := []struct {
+		tag, want string
+	}{
+		{"go", "go"}, {"GoLang", "go"}, {"py", "python"}, {"bash", "shell"}, {"yml", "yaml"},
+		{"ts", "typescript"}, {"cc", "cpp"}, {"cobol", ""}, {"", ""},
+	}
+	for _, tt := range tests {
+		got := lookupLanguage(tt.tag)
+		if got != languages[tt.want] {
+			t.Errorf("lookupLanguage(%q) is not %q", tt.tag, tt.want)
+		}
+	}
+}
+
+func TestHighlightLines(t *testing.T) {
+	tokens := lookupLanguage("go").tokenize("x /* a\nb */ < 1")
+	want := []string{`x <span class="com">/* a</span>`, `<span class="com">b */</span> &lt; <span class="num">1</span>`}
+	if got := highlightLines(tokens); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestHighlightStylesheet(t *testing.T) {
+	const link = `href="../css/_spellHighlight.css"`
+	tests := []struct {
+		name, theme, code string
+		shipped           bool
+	}{
+		{name: "language", code: "```go\nvar x int\n```", shipped: true},
+		{name: "emphasized lines", code: "``` {hl=1}\nplain\n```", shipped: true},
+		{name: "plain fence", code: "```\nplain\n```"},
+		{name: "unknown language", code: "```cobol\nDISPLAY 'X'.\n```"},
+		{name: "theme none", theme: "none", code: "```go\nvar x int\n```"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			md := "# One\n\ntext\n\n# Two\n\n" + tt.code + "\n"
+			c := convertFiles(t, map[string]string{"main.md": md}, &Converter{HighlightTheme: tt.theme})
+			if c.err != nil {
+				t.Fatalf("unexpected error: %v\n%s", c.err, c.diags)
+			}
+			_, shipped := c.book.stylesheets[highlightStylesheet]
+			if shipped != tt.shipped {
+				t.Errorf("highlight stylesheet shipped: %v, want %v", shipped, tt.shipped)
+			}
+			if len(c.book.chapters) != 2 {
+				t.Fatalf("got %d chapters, want 2", len(c.book.chapters))
+			}
+			if strings.Contains(c.book.chapters[0].content, link) {
+				t.Error("the chapter without code links the highlight stylesheet")
+			}
+			if got := strings.Contains(c.book.chapters[1].content, link); got != tt.shipped {
+				t.Errorf("the chapter with code links the highlight stylesheet: %v, want %v", got, tt.shipped)
+			}
+		})
+	}
+}
+
+func TestHighlightStylesheetOrder(t *testing.T) {
+	fsys := fstest.MapFS{
+		"main.md":    {Data: []byte("# One\n\n```go\nvar x int\n```\n")},
+		"custom.css": {Data: []byte("pre.code { color: red }")},
+	}
+	var diags bytes.Buffer
+	c := &Converter{FS: fsys, Logger: log.New(&diags, "", 0)}
+	book := &testBook{}
+	if err := c.ProcessMarkdownFile(book, "main.md", []string{"custom.css"}); err != nil {
+		t.Fatalf("unexpected error: %v\n%s", err, diags.String())
+	}
+	content := book.chapters[0].content
+	def := strings.Index(content, "_spellDefault.css")
+	hl := strings.Index(content, "_spellHighlight.css")
+	custom := strings.Index(content, "custom.css")
+	if def < 0 || hl < 0 || custom < 0 || !(def < hl && hl < custom) {
+		t.Errorf("stylesheets not linked as default, highlight, custom:\n%s", content)
+	}
+}
+
+func TestUnknownHighlightTheme(t *testing.T) {
+	c := convertFiles(t, map[string]string{"main.md": "# One\n\n```go\nvar x int\n```\n"}, &Converter{HighlightTheme: "neon"})
+	if c.err == nil || !strings.Contains(c.diags, `unknown highlight theme "neon"`) {
+		t.Errorf("got error %v, diagnostics %q, want an unknown theme error", c.err, c.diags)
+	}
+}
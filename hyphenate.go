@@ -0,0 +1,261 @@
+package spell
+
+import (
+	"embed"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// hyphenationFiles holds the TeX hyphenation patterns of the hyph-utf8
+// project, see hyphenationLanguages.
+//
+//go:embed hyphenation/*.tex
+var hyphenationFiles embed.FS
+
+// hyphenationLanguage names the pattern file of a language and the shortest
+// parts it breaks a word into, as typeset by TeX.
+type hyphenationLanguage struct {
+	file        string
+	left, right int
+}
+
+// hyphenationLanguages maps primary language tags to their patterns.
+var hyphenationLanguages = map[string]hyphenationLanguage{
+	"en": {"hyph-en-us.tex", 2, 3},
+	"de": {"hyph-de-1996.tex", 2, 2},
+}
+
+// softHyphen is inserted where a word may be broken.
+const softHyphen = "&#173;"
+
+// defaultMinHyphenLength is the shortest word that is hyphenated.
+const defaultMinHyphenLength = 6
+
+// hyphenator breaks words with Liang's algorithm, as TeX does: the digits of
+// every pattern found in a word give the break points between its letters,
+// odd values allow a break and the highest value wins.
+type hyphenator struct {
+	patterns   map[string][]int // letters → value before each letter and after the last
+	exceptions map[string][]int // word → break positions
+	maxLen     int              // letters of the longest pattern
+	left       int              // letters kept before the first break
+	right      int              // letters kept after the last break
+}
+
+var (
+	hyphenatorsMu sync.Mutex
+	hyphenators   = map[string]*hyphenator{}
+)
+
+// lookupHyphenator returns the hyphenator for a language tag like de-DE,
+// or nil if there are no patterns for it. Patterns are parsed once.
+func lookupHyphenator(tag string) *hyphenator {
+	primary, _, _ := strings.Cut(strings.ToLower(strings.ReplaceAll(tag, "_", "-")), "-")
+	hyphenatorsMu.Lock()
+	defer hyphenatorsMu.Unlock()
+	if h, ok := hyphenators[primary]; ok {
+		return h
+	}
+	var h *hyphenator
+	if lang, ok := hyphenationLanguages[primary]; ok {
+		if data, err := hyphenationFiles.ReadFile("hyphenation/" + lang.file); err == nil {
+			h = parsePatterns(string(data))
+			h.left, h.right = lang.left, lang.right
+		}
+	}
+	hyphenators[primary] = h
+	return h
+}
+
+// parsePatterns reads the \patterns and \hyphenation groups of a TeX
+// pattern file.
+func parsePatterns(src string) *hyphenator {
+	h := &hyphenator{patterns: map[string][]int{}, exceptions: map[string][]int{}, left: 2, right: 2}
+	var group string
+	for _, line := range strings.Split(src, "\n") {
+		line, _, _ = strings.Cut(line, "%")
+		for _, field := range strings.Fields(line) {
+			switch {
+			case strings.HasPrefix(field, `\patterns{`), strings.HasPrefix(field, `\hyphenation{`):
+				group, _, _ = strings.Cut(field[1:], "{")
+				field = field[len(group)+2:]
+			}
+			if strings.HasSuffix(field, "}") {
+				h.add(group, strings.TrimSuffix(field, "}"))
+				group = ""
+				continue
+			}
+			h.add(group, field)
+		}
+	}
+	return h
+}
+
+// add adds a pattern like 1tra or an exception like ta-ble to group.
+func (h *hyphenator) add(group, field string) {
+	switch {
+	case field == "":
+	case group == "patterns":
+		letters, values := splitPattern(field)
+		for i, v := range h.patterns[letters] {
+			values[i] = max(values[i], v)
+		}
+		h.patterns[letters] = values
+		h.maxLen = max(h.maxLen, utf8.RuneCountInString(letters))
+	case group == "hyphenation":
+		word, breaks := parseException(field)
+		h.exceptions[word] = breaks
+	}
+}
+
+// parseException reads a word with its break points marked by hyphens, like
+// ta-ble, and returns it in lower case without them. A word without hyphens
+// is never broken.
+func parseException(s string) (string, []int) {
+	var word strings.Builder
+	var breaks []int
+	n := 0
+	for _, c := range strings.ToLower(s) {
+		if c == '-' {
+			breaks = append(breaks, n)
+			continue
+		}
+		word.WriteRune(c)
+		n++
+	}
+	return word.String(), breaks
+}
+
+// splitPattern separates the letters of a pattern from its digits:
+// values[i] is the digit before the i-th letter, the last one the digit
+// after the last letter.
+func splitPattern(p string) (string, []int) {
+	var letters strings.Builder
+	values := []int{0}
+	for _, c := range p {
+		if c >= '0' && c <= '9' {
+			values[len(values)-1] = int(c - '0')
+			continue
+		}
+		letters.WriteRune(c)
+		values = append(values, 0)
+	}
+	return letters.String(), values
+}
+
+// breaks returns the positions in word, counted in letters, where it may be
+// broken.
+func (h *hyphenator) breaks(word string) []int {
+	lower := strings.ToLower(word)
+	if breaks, ok := h.exceptions[lower]; ok {
+		return breaks
+	}
+	letters := []rune("." + lower + ".")
+	values := make([]int, len(letters)+1)
+	for i := range letters {
+		for j := i + 1; j <= len(letters) && j-i <= h.maxLen; j++ {
+			pattern, ok := h.patterns[string(letters[i:j])]
+			if !ok {
+				continue
+			}
+			for k, v := range pattern {
+				values[i+k] = max(values[i+k], v)
+			}
+		}
+	}
+	// values[k] is the value before letters[k]; the word starts at letters[1].
+	var breaks []int
+	n := len(letters) - 2
+	for pos := h.left; pos <= n-h.right; pos++ {
+		if values[pos+1]%2 == 1 {
+			breaks = append(breaks, pos)
+		}
+	}
+	return breaks
+}
+
+// hyphenate inserts soft hyphens into the words of s that have at least
+// minLength letters. Words in URLs and mail addresses are left alone.
+func (h *hyphenator) hyphenate(s string, minLength int, exceptions map[string][]int) string {
+	var b strings.Builder
+	for _, field := range strings.SplitAfter(s, " ") {
+		if strings.ContainsAny(field, "/@\\") {
+			b.WriteString(field)
+			continue
+		}
+		start := -1
+		for j, c := range field + " " {
+			if unicode.IsLetter(c) {
+				if start < 0 {
+					start = j
+				}
+				continue
+			}
+			if start >= 0 {
+				b.WriteString(h.hyphenateWord(field[start:j], minLength, exceptions))
+				start = -1
+			}
+			if j < len(field) {
+				b.WriteRune(c)
+			}
+		}
+	}
+	return b.String()
+}
+
+// hyphenate inserts soft hyphens into paragraph text, if hyphenation is on
+// and there are patterns for the book language.
+func (r *renderer) hyphenate(s string) string {
+	h := lookupHyphenator(r.language)
+	if !r.hyphens || r.raw || r.plain || h == nil {
+		return s
+	}
+	minLength := r.MinHyphenLength
+	if minLength <= 0 {
+		minLength = defaultMinHyphenLength
+	}
+	return outsideReferences(s, func(s string) string { return h.hyphenate(s, minLength, r.hyphenExceptions) })
+}
+
+// addHyphenExceptions applies a $[hyphenation] line: words separated by
+// commas or spaces, with hyphens where they may be broken.
+func (r *renderer) addHyphenExceptions(m *metaNode) {
+	for _, field := range strings.FieldsFunc(m.value, func(c rune) bool { return c == ',' || unicode.IsSpace(c) }) {
+		word, breaks := parseException(field)
+		r.hyphenExceptions[word] = breaks
+	}
+}
+
+// linkText renders the text of a link, which is never hyphenated.
+func (r *renderer) linkText(nodes []inline) string {
+	hyphens := r.hyphens
+	r.hyphens = false
+	defer func() { r.hyphens = hyphens }()
+	return r.renderInline(nodes)
+}
+
+// hyphenateWord returns word with soft hyphens at its break points.
+func (h *hyphenator) hyphenateWord(word string, minLength int, exceptions map[string][]int) string {
+	letters := []rune(word)
+	if len(letters) < minLength {
+		return word
+	}
+	breaks, ok := exceptions[strings.ToLower(word)]
+	if !ok {
+		breaks = h.breaks(word)
+	}
+	if len(breaks) == 0 {
+		return word
+	}
+	var b strings.Builder
+	last := 0
+	for _, pos := range breaks {
+		b.WriteString(string(letters[last:pos]))
+		b.WriteString(softHyphen)
+		last = pos
+	}
+	b.WriteString(string(letters[last:]))
+	return b.String()
+}
@@ -0,0 +1,102 @@
+package spell
+
+import (
+	"strings"
+	"testing"
+)
+
+// hyphenated returns word with a hyphen at every break point h finds.
+func hyphenated(h *hyphenator, word string) string {
+	letters := []rune(word)
+	var b strings.Builder
+	last := 0
+	for _, pos := range h.breaks(word) {
+		b.WriteString(string(letters[last:pos]) + "-")
+		last = pos
+	}
+	b.WriteString(string(letters[last:]))
+	return b.String()
+}
+
+func TestHyphenationPatterns(t *testing.T) {
+	// The breaks of the dictionaries; TeX patterns find most of them, and
+	// none that are wrong.
+	tests := map[string][]string{
+		"en": {
+			"home-made", "for-ever", "some-one", "base-ball", "house-hold", "some-where",
+			"ta-ble", "al-go-rithm", "hy-phen-a-tion", "ty-pog-ra-phy", "char-ac-ter",
+			"dic-tio-nary", "chil-dren", "im-por-tant", "beau-ti-ful", "Some-where",
+			"present", "project",
+		},
+		"de": {
+			"Zu-sam-men-ar-beit", "Sil-ben-tren-nung", "Schiff-fahrt", "Wahr-schein-lich-keit",
+			"Bü-cher", "La-ter-ne", "Stra-ße", "Häu-ser", "Kin-der-gar-ten", "Ge-müt-lich-keit",
+			"Fuß-ball", "Über-set-zung",
+		},
+	}
+	for lang, words := range tests {
+		h := lookupHyphenator(lang)
+		if h == nil {
+			t.Fatalf("no patterns for %s", lang)
+		}
+		for _, want := range words {
+			if got := hyphenated(h, strings.ReplaceAll(want, "-", "")); got != want {
+				t.Errorf("%s: got %s, want %s", lang, got, want)
+			}
+		}
+	}
+}
+
+func TestLookupHyphenator(t *testing.T) {
+	tests := []struct {
+		tag         string
+		left, right int
+	}{
+		{"en", 2, 3}, {"en-GB", 2, 3}, {"en_US", 2, 3}, {"de", 2, 2}, {"de-CH", 2, 2}, {"tlh", 0, 0},
+	}
+	for _, tt := range tests {
+		h := lookupHyphenator(tt.tag)
+		switch {
+		case tt.left == 0 && h != nil:
+			t.Errorf("%s: got patterns, want none", tt.tag)
+		case tt.left > 0 && (h == nil || h.left != tt.left || h.right != tt.right):
+			t.Errorf("%s: got %+v, want hyphenmins %d and %d", tt.tag, h, tt.left, tt.right)
+		}
+	}
+}
+
+func TestParsePatterns(t *testing.T) {
+	h := parsePatterns("% comment\n\\patterns{ % x\n1ba 2b1\n.ab4\n}\n\\hyphenation{ta-ble\nkeep}\n")
+	if got, want := len(h.patterns), 3; got != want {
+		t.Errorf("got %d patterns, want %d", got, want)
+	}
+	if v := h.patterns["b"]; len(v) != 2 || v[0] != 2 || v[1] != 1 {
+		t.Errorf("pattern 2b1 gives %v", v)
+	}
+	if b, ok := h.exceptions["table"]; !ok || len(b) != 1 || b[0] != 2 {
+		t.Errorf("exception ta-ble gives %v", b)
+	}
+	if b, ok := h.exceptions["keep"]; !ok || len(b) != 0 {
+		t.Errorf("exception keep gives %v, %v", b, ok)
+	}
+}
+
+func TestHyphenate(t *testing.T) {
+	tests := []struct {
+		front, md, want string
+	}{
+		{"$[language](en)\n", "Somewhere, a household.", "Some-where, a house-hold."},
+		{"$[language](en)\n", "A short table.", "A short ta-ble."},
+		{"$[language](de)\n", "Die Zusammenarbeit", "Die Zu-sam-men-ar-beit"},
+		{"$[language](en)\n$[hyphenation](Ur-in-stinkt, Spell, some-where)\n", "Somewhere Urinstinkt Spellbook",
+			"Some-where Ur-in-stinkt Spell-book"},
+		{"$[language](en)\n", "See https://example.com/household or [household](#x)", "See https://example.com/household or"},
+		{"$[language](tlh)\n", "Somewhere", "Somewhere"},
+	}
+	for _, tt := range tests {
+		got := paragraphs(t, &Converter{Hyphenate: true, MinHyphenLength: 5}, tt.front, tt.md)
+		if len(got) != 1 || !strings.HasPrefix(strings.ReplaceAll(got[0], softHyphen, "-"), tt.want) {
+			t.Errorf("%s%s: got %q, want %q", tt.front, tt.md, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package spell
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// reInclude matches ![include](uri/uri.md "text"){options}; the text and the
+// options are optional.
+var reInclude = regexp.MustCompile(`\!\[include\]\(([^ \)]+)\s*(\"([^\"]*)\")?\)(\{((?:[^}"]|"[^"]*")*)\})?`)
+
+// maxIncludeDepth limits how deeply includes may be nested.
+const maxIncludeDepth = 16
+
+// includeOptions are the options of an include, given in braces after it:
+//
+//	shift=1            add one # to every heading, so a chapter becomes a section
+//	lines=10-20        only lines 10 to 20; 10- and -20 leave one end open
+//	from="x" to="y"    only the lines between the lines containing x and y
+//	verbatim[=lang]    include the file as a code fence, lang defaulting to the extension
+type includeOptions struct {
+	shift       int
+	first, last int // line range, 1-based and inclusive; 0 leaves that end open
+	from, to    string
+	verbatim    bool
+	lang        string
+}
+
+func parseIncludeOptions(s string) (includeOptions, error) {
+	var opts includeOptions
+	attrs, err := parseAttributes(s)
+	if err != nil {
+		return opts, err
+	}
+	for key, value := range attrs {
+		switch key {
+		case "shift":
+			if opts.shift, err = strconv.Atoi(value); err != nil {
+				return opts, fmt.Errorf("shift must be a number, got %q", value)
+			}
+		case "lines":
+			if opts.first, opts.last, err = parseLineRange(value); err != nil {
+				return opts, err
+			}
+		case "from":
+			opts.from = value
+		case "to":
+			opts.to = value
+		case "verbatim":
+			opts.verbatim = true
+			opts.lang = value
+		default:
+			return opts, fmt.Errorf("unknown option %s", key)
+		}
+	}
+	if opts.first+opts.last > 0 && opts.from+opts.to != "" {
+		return opts, fmt.Errorf("lines cannot be combined with from and to")
+	}
+	return opts, nil
+}
+
+// parseLineRange parses a line range like 10-20, 10-, -20 or 10.
+func parseLineRange(s string) (first, last int, err error) {
+	lo, hi, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hi = lo
+	}
+	if lo == "" && hi == "" {
+		return 0, 0, fmt.Errorf("invalid line range %q", s)
+	}
+	if lo != "" {
+		if first, err = strconv.Atoi(lo); err != nil || first < 1 {
+			return 0, 0, fmt.Errorf("invalid line range %q", s)
+		}
+	}
+	if hi != "" {
+		if last, err = strconv.Atoi(hi); err != nil || last < 1 || last < first {
+			return 0, 0, fmt.Errorf("invalid line range %q", s)
+		}
+	}
+	return first, last, nil
+}
+
+// Replace all includes of md files using markdown syntax for images like
+// ![include](uri/uri.md "text") or
+// ![include](uri/uri.md)
+// text is optional and ignored, you can use it as internal reference
+//
+// Included files may include further files; their paths are relative to the
+// including file. A file including itself, directly or through others, is
+// an error, as is nesting deeper than maxIncludeDepth.
+func (ctx *parseContext) replaceAllIncludes(lines []sourceLine) []sourceLine {
+	var chain []string
+	if len(lines) > 0 {
+		// Joining cleans the name, as for the included files.
+		chain = []string{ctx.joinPath("", lines[0].pos.file)}
+	}
+	return ctx.expandIncludes(lines, ctx.baseDir, chain)
+}
+
+// expandIncludes replaces the includes in lines, which were read from the
+// last file of chain, resolving their paths against dir.
+//
+// Every line keeps the position it came from. An include in the middle of a
+// line splices the file in: its first line continues the text before the
+// include, its last line is continued by the text after it.
+func (ctx *parseContext) expandIncludes(lines []sourceLine, dir string, chain []string) []sourceLine {
+	var out []sourceLine
+	for _, l := range lines {
+		found := reInclude.FindAllStringIndex(l.text, -1)
+		if found == nil {
+			out = append(out, l)
+			continue
+		}
+		cur := sourceLine{pos: l.pos}
+		last := 0
+		for _, loc := range found {
+			cur.text += l.text[last:loc[0]]
+			last = loc[1]
+
+			// Extract includes and parameters
+			matches := reInclude.FindStringSubmatch(l.text[loc[0]:loc[1]])
+			included := ctx.include(l.pos.shift(loc[0]), matches, dir, chain)
+			if included == nil {
+				continue // reported; the include is dropped
+			}
+			if cur.text == "" {
+				cur.pos = included[0].pos
+			}
+			cur.text += included[0].text
+			if n := len(included); n > 1 {
+				out = append(out, cur)
+				out = append(out, included[1:n-1]...)
+				cur = included[n-1]
+			}
+		}
+		cur.text += l.text[last:]
+		out = append(out, cur)
+	}
+	return out
+}
+
+// include returns the lines of the include matched by reInclude at pos. A
+// glob pattern includes every matching file in natural sort order, except
+// the files in chain. It returns nil after reporting the error if nothing
+// can be included.
+func (ctx *parseContext) include(pos sourcePos, matches []string, dir string, chain []string) []sourceLine {
+	target := matches[1]
+	opts, err := parseIncludeOptions(matches[5])
+	if err != nil {
+		ctx.errorAt(pos, problemParse, "cannot include %s: %v", target, err)
+		return nil
+	}
+	if !strings.ContainsAny(target, "*?[") {
+		return ctx.includeFile(pos, target, ctx.joinPath(dir, target), matches[3], opts, chain)
+	}
+
+	files, err := ctx.glob(ctx.joinPath(dir, target))
+	if err != nil {
+		ctx.errorAt(pos, problemParse, "cannot include %s: %v", target, err)
+		return nil
+	}
+	sort.Slice(files, func(i, j int) bool { return naturalLess(files[i], files[j]) })
+	var lines []sourceLine
+	for _, filename := range files {
+		if inChain(chain, filename) {
+			continue
+		}
+		lines = append(lines, ctx.includeFile(pos, filename, filename, matches[3], opts, chain)...)
+	}
+	if lines == nil {
+		ctx.errorAt(pos, problemAsset, "cannot include %s: no matching files", target)
+	}
+	return lines
+}
+
+// includeFile reads the file filename, included as target at pos from the
+// last file of chain. Markdown files have their own includes expanded,
+// verbatim files become a code fence. It returns nil after reporting the
+// error if the file cannot be included.
+func (ctx *parseContext) includeFile(pos sourcePos, target, filename, text string, opts includeOptions, chain []string) []sourceLine {
+	if !opts.verbatim && !strings.EqualFold(filepath.Ext(target), ".md") {
+		ctx.errorAt(pos, problemParse, "cannot include %s: not a markdown (.md) file, use {verbatim} for source code", target)
+		return nil
+	}
+	if inChain(chain, filename) {
+		ctx.errorAt(pos, problemParse, "include cycle: %s -> %s", strings.Join(chain, " -> "), filename)
+		return nil
+	}
+	if len(chain) >= maxIncludeDepth {
+		ctx.errorAt(pos, problemParse, "cannot include %s: includes nested deeper than %d: %s", target, maxIncludeDepth, strings.Join(chain, " -> "))
+		return nil
+	}
+
+	includeContent, err := ctx.readFile(filename)
+	if err != nil {
+		ctx.errorAt(pos, problemAsset, "cannot include %s: %v", target, err)
+		return nil
+	}
+
+	ctx.logMsg(LogVerbose, "Including file %s (%s)", filename, text)
+	lines, err := selectLines(splitLines(string(includeContent), filename), opts)
+	if err != nil {
+		ctx.errorAt(pos, problemParse, "cannot include %s: %v", target, err)
+		return nil
+	}
+
+	if opts.verbatim {
+		lang := opts.lang
+		if lang == "" {
+			lang = strings.TrimPrefix(filepath.Ext(filename), ".")
+		}
+		// A trailing newline does not make an empty last line of code.
+		if n := len(lines); n > 1 && lines[n-1].text == "" {
+			lines = lines[:n-1]
+		}
+		fenced := []sourceLine{{text: "```" + lang, pos: pos}}
+		fenced = append(fenced, lines...)
+		return append(fenced, sourceLine{text: "```", pos: pos}, sourceLine{pos: pos})
+	}
+
+	// Shifting after the expansion moves the headings of nested includes
+	// too, on top of their own shift.
+	lines = ctx.expandIncludes(lines, ctx.dirName(filename), append(chain[:len(chain):len(chain)], filename))
+	shiftHeadings(lines, opts.shift)
+	return lines
+}
+
+// selectLines returns the part of lines chosen by the lines, from and to
+// options.
+func selectLines(lines []sourceLine, opts includeOptions) ([]sourceLine, error) {
+	switch {
+	case opts.first > 0 || opts.last > 0:
+		first, last := opts.first, opts.last
+		if first == 0 {
+			first = 1
+		}
+		if last == 0 || last > len(lines) {
+			last = len(lines)
+		}
+		if first > last {
+			return nil, fmt.Errorf("line %d is past the end of the file", first)
+		}
+		return lines[first-1 : last], nil
+	case opts.from != "" || opts.to != "":
+		start, end := 0, len(lines)
+		if opts.from != "" {
+			start = indexOfLine(lines, 0, opts.from)
+			if start < 0 {
+				return nil, fmt.Errorf("marker %q not found", opts.from)
+			}
+			start++
+		}
+		if opts.to != "" {
+			end = indexOfLine(lines, start, opts.to)
+			if end < 0 {
+				return nil, fmt.Errorf("marker %q not found", opts.to)
+			}
+		}
+		return lines[start:end], nil
+	}
+	return lines, nil
+}
+
+// indexOfLine returns the index of the first line from start on that
+// contains marker, or -1.
+func indexOfLine(lines []sourceLine, start int, marker string) int {
+	for i := start; i < len(lines); i++ {
+		if strings.Contains(lines[i].text, marker) {
+			return i
+		}
+	}
+	return -1
+}
+
+// reHeadingMarks matches the # of a chapter or heading line.
+var reHeadingMarks = regexp.MustCompile(`^\s*(#+)`)
+
+// shiftHeadings adds shift levels to every chapter and heading outside code
+// fences, keeping them between 1 and 6.
+func shiftHeadings(lines []sourceLine, shift int) {
+	if shift == 0 {
+		return
+	}
+	inFence := false
+	for i, l := range lines {
+		switch {
+		case reBlockQuote.MatchString(l.text):
+			inFence = !inFence
+		case inFence || !(reChapter.MatchString(l.text) || reHeadlines.MatchString(l.text)):
+		default:
+			m := reHeadingMarks.FindStringSubmatchIndex(l.text)
+			level := min(max(m[3]-m[2]+shift, 1), 6)
+			lines[i].text = l.text[:m[2]] + strings.Repeat("#", level) + l.text[m[3]:]
+		}
+	}
+}
+
+// glob returns the files matching pattern, on FS or the local file system.
+func (c *Converter) glob(pattern string) ([]string, error) {
+	if c.FS != nil {
+		return fs.Glob(c.FS, pattern)
+	}
+	return filepath.Glob(pattern)
+}
+
+func inChain(chain []string, filename string) bool {
+	for _, f := range chain {
+		if f == filename {
+			return true
+		}
+	}
+	return false
+}
+
+// naturalLess compares strings with runs of digits compared by their
+// value, so that chapter2.md sorts before chapter10.md.
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := leadingDigits(a), leadingDigits(b)
+		if da != "" && db != "" {
+			na, nb := strings.TrimLeft(da, "0"), strings.TrimLeft(db, "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[len(da):], b[len(db):]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+func leadingDigits(s string) string {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return s[:i]
+}
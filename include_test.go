@@ -0,0 +1,318 @@
+package spell
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// expand returns the lines of main.md of files with all includes replaced,
+// and the diagnostics.
+func expand(files map[string]string) ([]sourceLine, string) {
+	var diags bytes.Buffer
+	ctx := newTestContext(files, &diags)
+	return ctx.replaceAllIncludes(splitLines(files["main.md"], "main.md")), diags.String()
+}
+
+func TestIncludeRelativeToIncludingFile(t *testing.T) {
+	lines, diags := expand(map[string]string{
+		"main.md":         "start\n![include](part/one.md)\nend",
+		"part/one.md":     "one\n![include](sub/two.md)",
+		"part/sub/two.md": "two",
+		"sub/two.md":      "wrong two",
+	})
+	if diags != "" {
+		t.Errorf("diagnostics: %s", diags)
+	}
+	want := []string{"start", "one", "two", "end"}
+	if got := texts(lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIncludeKeepsPositions(t *testing.T) {
+	lines, _ := expand(map[string]string{
+		"main.md": "# Chapter\n\n![include](a.md)",
+		"a.md":    "first\n![include](b.md)",
+		"b.md":    "\nsecond",
+	})
+	want := []string{"main.md:1:1", "main.md:2:1", "a.md:1:1", "b.md:1:1", "b.md:2:1"}
+	var got []string
+	for _, l := range lines {
+		got = append(got, l.pos.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIncludeInsideLine(t *testing.T) {
+	lines, _ := expand(map[string]string{
+		"main.md": "before ![include](a.md) after",
+		"a.md":    "one\ntwo",
+	})
+	want := []string{"before one", "two after"}
+	if got := texts(lines); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  string
+	}{
+		{
+			name:  "missing file",
+			files: map[string]string{"main.md": "![include](missing.md)"},
+			want:  "main.md:1:1: error: cannot include missing.md:",
+		},
+		{
+			name:  "not markdown",
+			files: map[string]string{"main.md": "x ![include](a.txt)", "a.txt": ""},
+			want:  "main.md:1:3: error: cannot include a.txt: not a markdown (.md) file",
+		},
+		{
+			name:  "self",
+			files: map[string]string{"main.md": "![include](main.md)"},
+			want:  "main.md:1:1: error: include cycle: main.md -> main.md",
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.md": "![include](a/a.md)",
+				"a/a.md":  "![include](../b.md)",
+				"b.md":    "![include](a/a.md)",
+			},
+			want: "b.md:1:1: error: include cycle: main.md -> a/a.md -> b.md -> a/a.md",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lines, diags := expand(tt.files)
+			if !strings.HasPrefix(diags, tt.want) {
+				t.Errorf("got diagnostics %q, want %q", diags, tt.want)
+			}
+			for _, l := range lines {
+				if strings.Contains(l.text, "![include]") {
+					t.Errorf("include left in %q", l.text)
+				}
+			}
+		})
+	}
+}
+
+func TestIncludeDepth(t *testing.T) {
+	files := map[string]string{"main.md": "![include](f1.md)"}
+	for i := 1; i <= maxIncludeDepth; i++ {
+		files[fmt.Sprintf("f%d.md", i)] = fmt.Sprintf("%d ![include](f%d.md)", i, i+1)
+	}
+	files[fmt.Sprintf("f%d.md", maxIncludeDepth+1)] = "too deep"
+
+	lines, diags := expand(files)
+	want := fmt.Sprintf("f%d.md:1:4: error: cannot include f%d.md: includes nested deeper than %d", maxIncludeDepth-1, maxIncludeDepth, maxIncludeDepth)
+	if !strings.HasPrefix(diags, want) {
+		t.Errorf("got diagnostics %q, want %q", diags, want)
+	}
+	if strings.Contains(strings.Join(texts(lines), "\n"), "too deep") {
+		t.Error("the file past the depth limit was included")
+	}
+}
+
+func TestNaturalLess(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"chapter2.md", "chapter10.md", true},
+		{"chapter10.md", "chapter2.md", false},
+		{"chapter02.md", "chapter10.md", true},
+		{"chapter002.md", "chapter2.md", false},
+		{"chapter2.md", "chapter002.md", false},
+		{"a.md", "b.md", true},
+		{"a1b2.md", "a1b10.md", true},
+		{"part9/x.md", "part10/a.md", true},
+		{"abc", "abcd", true},
+		{"abcd", "abc", false},
+		{"", "a", true},
+		{"a", "a", false},
+	}
+	for _, tt := range tests {
+		if got := naturalLess(tt.a, tt.b); got != tt.want {
+			t.Errorf("naturalLess(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseLineRange(t *testing.T) {
+	tests := []struct {
+		s           string
+		first, last int
+		err         bool
+	}{
+		{s: "10-20", first: 10, last: 20},
+		{s: "10-", first: 10},
+		{s: "-20", last: 20},
+		{s: "7", first: 7, last: 7},
+		{s: "5-5", first: 5, last: 5},
+		{s: "20-10", err: true},
+		{s: "0-3", err: true},
+		{s: "-0", err: true},
+		{s: "a-3", err: true},
+		{s: "3-b", err: true},
+		{s: "", err: true},
+		{s: "-", err: true},
+		{s: "1-2-3", err: true},
+	}
+	for _, tt := range tests {
+		first, last, err := parseLineRange(tt.s)
+		if (err != nil) != tt.err || first != tt.first || last != tt.last {
+			t.Errorf("parseLineRange(%q) = %d, %d, %v; want %d, %d, error %v", tt.s, first, last, err, tt.first, tt.last, tt.err)
+		}
+	}
+}
+
+func TestParseIncludeOptions(t *testing.T) {
+	tests := []struct {
+		s    string
+		want includeOptions
+		err  string
+	}{
+		{s: "", want: includeOptions{}},
+		{s: "shift=2", want: includeOptions{shift: 2}},
+		{s: "shift=-1", want: includeOptions{shift: -1}},
+		{s: "lines=3-4", want: includeOptions{first: 3, last: 4}},
+		{s: `from="// start" to="// end"`, want: includeOptions{from: "// start", to: "// end"}},
+		{s: "verbatim", want: includeOptions{verbatim: true}},
+		{s: "verbatim=go shift=1", want: includeOptions{verbatim: true, lang: "go", shift: 1}},
+		{s: "shift=x", err: `shift must be a number, got "x"`},
+		{s: "lines=9-1", err: `invalid line range "9-1"`},
+		{s: "wrap", err: "unknown option wrap"},
+		{s: `lines=1-2 from="x"`, err: "lines cannot be combined with from and to"},
+	}
+	for _, tt := range tests {
+		got, err := parseIncludeOptions(tt.s)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("parseIncludeOptions(%q) error = %v, want %q", tt.s, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseIncludeOptions(%q) = %+v, %v; want %+v", tt.s, got, err, tt.want)
+		}
+	}
+}
+
+func TestSelectLines(t *testing.T) {
+	lines := splitLines("one\n// start\ntwo\nthree\n// end\nfour", "a.md")
+	tests := []struct {
+		opts includeOptions
+		want []string
+		err  string
+	}{
+		{opts: includeOptions{}, want: []string{"one", "// start", "two", "three", "// end", "four"}},
+		{opts: includeOptions{first: 2, last: 3}, want: []string{"// start", "two"}},
+		{opts: includeOptions{first: 5}, want: []string{"// end", "four"}},
+		{opts: includeOptions{last: 1}, want: []string{"one"}},
+		{opts: includeOptions{first: 6, last: 100}, want: []string{"four"}},
+		{opts: includeOptions{first: 7}, err: "line 7 is past the end of the file"},
+		{opts: includeOptions{from: "// start", to: "// end"}, want: []string{"two", "three"}},
+		{opts: includeOptions{from: "// end"}, want: []string{"four"}},
+		{opts: includeOptions{to: "// start"}, want: []string{"one"}},
+		{opts: includeOptions{from: "// start", to: "// start"}, err: `marker "// start" not found`},
+		{opts: includeOptions{from: "nothing"}, err: `marker "nothing" not found`},
+		{opts: includeOptions{to: "nothing"}, err: `marker "nothing" not found`},
+	}
+	for _, tt := range tests {
+		got, err := selectLines(lines, tt.opts)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("selectLines(%+v) error = %v, want %q", tt.opts, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(texts(got), tt.want) {
+			t.Errorf("selectLines(%+v) = %q, %v; want %q", tt.opts, texts(got), err, tt.want)
+		}
+	}
+	if got, _ := selectLines(lines, includeOptions{first: 3}); got[0].pos.line != 3 {
+		t.Errorf("selected lines start at line %d, want 3", got[0].pos.line)
+	}
+}
+
+func TestShiftHeadings(t *testing.T) {
+	src := "# Chapter\n## Section\ntext # not a heading\n```go\n# comment\n```\n  ### Indented\n###### Six"
+	tests := []struct {
+		shift int
+		want  []string
+	}{
+		{0, []string{"# Chapter", "## Section", "text # not a heading", "```go", "# comment", "```", "  ### Indented", "###### Six"}},
+		{1, []string{"## Chapter", "### Section", "text # not a heading", "```go", "# comment", "```", "  #### Indented", "###### Six"}},
+		{-1, []string{"# Chapter", "# Section", "text # not a heading", "```go", "# comment", "```", "  ## Indented", "##### Six"}},
+		{9, []string{"###### Chapter", "###### Section", "text # not a heading", "```go", "# comment", "```", "  ###### Indented", "###### Six"}},
+	}
+	for _, tt := range tests {
+		lines := splitLines(src, "a.md")
+		shiftHeadings(lines, tt.shift)
+		if got := texts(lines); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("shift %d: got %q, want %q", tt.shift, got, tt.want)
+		}
+	}
+}
+
+func TestIncludeOptions(t *testing.T) {
+	files := map[string]string{
+		"main.md":            "![include](part.md){shift=1}",
+		"part.md":            "# Part\n![include](nested.md){shift=1}",
+		"nested.md":          "# Nested\n## Section",
+		"code/main.go":       "package main\n\n// start\nfunc main() {}\n// end\n",
+		"chapters/ch10.md":   "ten",
+		"chapters/ch2.md":    "two",
+		"chapters/ch1.md":    "one",
+		"chapters/notes.txt": "not markdown",
+	}
+	tests := []struct {
+		main string
+		want []string
+	}{
+		{"![include](part.md){shift=1}", []string{"## Part", "### Nested", "#### Section"}},
+		{"![include](code/main.go){verbatim}", []string{"```go", "package main", "", "// start", "func main() {}", "// end", "```", ""}},
+		{`![include](code/main.go){verbatim=golang from="// start" to="// end"}`, []string{"```golang", "func main() {}", "```", ""}},
+		{"![include](code/main.go){verbatim lines=1}", []string{"```go", "package main", "```", ""}},
+		{"![include](chapters/ch*.md)", []string{"one", "two", "ten"}},
+		{"![include](part.md){lines=1}", []string{"# Part"}},
+	}
+	for _, tt := range tests {
+		files["main.md"] = tt.main
+		lines, diags := expand(files)
+		if diags != "" {
+			t.Errorf("%s: diagnostics: %s", tt.main, diags)
+		}
+		if got := texts(lines); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.main, got, tt.want)
+		}
+	}
+}
+
+func TestIncludeOptionErrors(t *testing.T) {
+	tests := []struct {
+		main, want string
+	}{
+		{"![include](a.md){shift=x}", `main.md:1:1: error: cannot include a.md: shift must be a number, got "x"`},
+		{"![include](a.md){lines=9-}", "main.md:1:1: error: cannot include a.md: line 9 is past the end of the file"},
+		{`![include](a.md){from="nothing"}`, `main.md:1:1: error: cannot include a.md: marker "nothing" not found`},
+		{"![include](none/*.md)", "main.md:1:1: error: cannot include none/*.md: no matching files"},
+		{"![include](main*.md)", "main.md:1:1: error: cannot include main*.md: no matching files"},
+	}
+	for _, tt := range tests {
+		// The glob main*.md only matches main.md itself, which is left out.
+		_, diags := expand(map[string]string{"main.md": tt.main, "a.md": "one\ntwo"})
+		if !strings.HasPrefix(diags, tt.want) {
+			t.Errorf("%s: got diagnostics %q, want %q", tt.main, diags, tt.want)
+		}
+	}
+}
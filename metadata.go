@@ -0,0 +1,110 @@
+package spell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// marcRoles maps the names of the common MARC relator roles to their codes.
+// Roles may be given by name or by code.
+var marcRoles = map[string]string{
+	"adapter":                "adp",
+	"annotator":              "ann",
+	"artist":                 "art",
+	"author":                 "aut",
+	"author of afterword":    "aft",
+	"author of introduction": "aui",
+	"compiler":               "com",
+	"contributor":            "ctb",
+	"cover designer":         "cov",
+	"designer":               "dsr",
+	"editor":                 "edt",
+	"illustrator":            "ill",
+	"narrator":               "nrt",
+	"photographer":           "pht",
+	"proofreader":            "pfr",
+	"translator":             "trl",
+}
+
+// marcRole returns the MARC relator code of role, or "" if it is unknown.
+func marcRole(role string) string {
+	role = strings.ToLower(strings.TrimSpace(role))
+	if code, ok := marcRoles[role]; ok {
+		return code
+	}
+	for _, code := range marcRoles {
+		if code == role {
+			return code
+		}
+	}
+	return ""
+}
+
+// addPerson adds an author or contributor. A contributor line may name the
+// role before the name, as in $[contributor](editor: Jane Doe); authors and
+// contributors from the front matter have it in their attrs.
+func (r *renderer) addPerson(m *metaNode) {
+	name, role, sortName := m.value, m.attrs["role"], m.attrs["sort-name"]
+	if m.attrs == nil && m.key == "contributor" {
+		if prefix, rest, ok := strings.Cut(m.value, ":"); ok && marcRole(prefix) != "" {
+			role, name = prefix, strings.TrimSpace(rest)
+		}
+	}
+	fallback := "aut"
+	if m.key == "contributor" {
+		fallback = "ctb"
+	}
+	code := fallback
+	if role != "" {
+		if code = marcRole(role); code == "" {
+			r.warnAt(m.pos, "unknown role %q of %s, using %s", role, name, fallback)
+			code = fallback
+		}
+	}
+	if code == "aut" && sortName == "" {
+		r.book.AddAuthor(name)
+	} else {
+		r.book.AddContributor(name, code, sortName)
+	}
+}
+
+// normalizeISBN returns isbn without hyphens, spaces and an ISBN or
+// urn:isbn: prefix, after checking its check digit.
+func normalizeISBN(isbn string) (string, error) {
+	s := strings.ToUpper(strings.TrimSpace(isbn))
+	for _, prefix := range []string{"URN:ISBN:", "ISBN-13:", "ISBN-10:", "ISBN:", "ISBN"} {
+		s = strings.TrimSpace(strings.TrimPrefix(s, prefix))
+	}
+	s = strings.NewReplacer("-", "", " ", "").Replace(s)
+
+	sum := 0
+	switch len(s) {
+	case 10:
+		for i, c := range s {
+			d := int(c - '0')
+			switch {
+			case c == 'X' && i == 9:
+				d = 10
+			case c < '0' || c > '9':
+				return "", fmt.Errorf("invalid character %q", c)
+			}
+			sum += (10 - i) * d
+		}
+		if sum%11 != 0 {
+			return "", fmt.Errorf("wrong check digit")
+		}
+	case 13:
+		for i, c := range s {
+			if c < '0' || c > '9' {
+				return "", fmt.Errorf("invalid character %q", c)
+			}
+			sum += int(c-'0') * (1 + 2*(i%2))
+		}
+		if sum%10 != 0 {
+			return "", fmt.Errorf("wrong check digit")
+		}
+	default:
+		return "", fmt.Errorf("an ISBN has 10 or 13 digits")
+	}
+	return s, nil
+}
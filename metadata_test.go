@@ -0,0 +1,112 @@
+package spell
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeISBN(t *testing.T) {
+	tests := []struct {
+		isbn, want string // want "" for an invalid ISBN
+	}{
+		{"9780306406157", "9780306406157"},
+		{"978-0-306-40615-7", "9780306406157"},
+		{"ISBN 978 0 306 40615 7", "9780306406157"},
+		{"ISBN-13: 978-0-306-40615-7", "9780306406157"},
+		{"urn:isbn:9780306406157", "9780306406157"},
+		{"0-306-40615-2", "0306406152"},
+		{"ISBN-10: 0306406152", "0306406152"},
+		{"0-8044-2957-X", "080442957X"},
+		{"0-8044-2957-x", "080442957X"},
+		{"978-0-306-40615-8", ""},
+		{"0-306-40615-3", ""},
+		{"0-80X4-2957-4", ""},
+		{"978-0-306-4061A-7", ""},
+		{"978-0-306-40615", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got, err := normalizeISBN(tt.isbn)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("normalizeISBN(%q) = %q, want an error", tt.isbn, got)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("normalizeISBN(%q) = %q, %v, want %q", tt.isbn, got, err, tt.want)
+		}
+	}
+}
+
+func TestMarcRole(t *testing.T) {
+	tests := []struct{ role, want string }{
+		{"editor", "edt"},
+		{" Translator ", "trl"},
+		{"author of introduction", "aui"},
+		{"trl", "trl"},
+		{"EDT", "edt"},
+		{"ghostwriter", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := marcRole(tt.role); got != tt.want {
+			t.Errorf("marcRole(%q) = %q, want %q", tt.role, got, tt.want)
+		}
+	}
+}
+
+func TestAddPerson(t *testing.T) {
+	md := "$[author](Jane Doe)\n" +
+		"$[contributor](editor: Joe Bloggs)\n" +
+		"$[contributor](trl: Ann Other)\n" +
+		"$[contributor](Note: a name with a colon)\n" +
+		"$[contributor](Sam Smith)\n" +
+		"\n# One\n"
+	c := convertMarkdown(t, md)
+	want := []string{
+		"AddAuthor Jane Doe",
+		"AddContributor Joe Bloggs|edt|",
+		"AddContributor Ann Other|trl|",
+		"AddContributor Note: a name with a colon|ctb|",
+		"AddContributor Sam Smith|ctb|",
+	}
+	got := strings.Join(c.book.meta, "\n")
+	for _, w := range want {
+		if !strings.Contains(got, w) {
+			t.Errorf("missing %q in\n%s", w, got)
+		}
+	}
+}
+
+func TestAddPersonFromFrontMatter(t *testing.T) {
+	md := "---\nauthor:\n  - name: Jane Doe\n    sort-name: Doe, Jane\n  - name: Joe Bloggs\n    role: ghostwriter\n" +
+		"contributor:\n  - name: Ann Other\n    role: translator\n  - name: Sam Smith\n    role: muse\n---\n\n# One\n"
+	c := convertMarkdown(t, md)
+	got := strings.Join(c.book.meta, "\n")
+	for _, w := range []string{
+		"AddContributor Jane Doe|aut|Doe, Jane",
+		"AddAuthor Joe Bloggs",
+		"AddContributor Ann Other|trl|",
+		"AddContributor Sam Smith|ctb|",
+	} {
+		if !strings.Contains(got, w) {
+			t.Errorf("missing %q in\n%s", w, got)
+		}
+	}
+	for _, w := range []string{
+		`main.md:5:5: warning: unknown role "ghostwriter" of Joe Bloggs, using aut`,
+		`main.md:10:5: warning: unknown role "muse" of Sam Smith, using ctb`,
+	} {
+		if !strings.Contains(c.diags, w) {
+			t.Errorf("missing %q in\n%s", w, c.diags)
+		}
+	}
+}
+
+func TestISBNMeta(t *testing.T) {
+	c := convertMarkdown(t, "$[isbn](978-0-306-40615-7)\n$[isbn](978-0-306-40615-8)\n\n# One\n")
+	if got := strings.Join(c.book.meta, "\n"); !strings.Contains(got, "SetISBN 9780306406157") || strings.Contains(got, "40615-8") {
+		t.Errorf("ISBNs set:\n%s", got)
+	}
+	if want := "main.md:2:1: error: cannot set ISBN to 978-0-306-40615-8: wrong check digit"; !strings.Contains(c.diags, want) {
+		t.Errorf("missing %q in\n%s", want, c.diags)
+	}
+}
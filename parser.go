@@ -1,53 +1,26 @@
-package main
+package spell
 
 import (
 	"fmt"
-	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"unicode"
 )
 
-const (
-	BLOCKTYPE_NONE int = 0
-	BLOCKTYPE_CODE int = 1
-	BLOCKTYPE_CITE int = 2
-	BLOCKTYPE_NOTE int = 3
-	BLOCKTYPE_INFO int = 4
-	BLOCKTYPE_WARN int = 5
-)
-
-var (
-	currentChapterContent strings.Builder
-	currentChapterTitle   string
-	currentChapterNumber  [7]int
-	currentNavpoint       [7]NavpointAdder
-	currentImageId        int
-
-	firstparagraph bool = true
-	listStack      []listFrame
-	startReadingSet bool
-	inBlockType    int = 0
-
-	laquo  = "\""
-	raquo  = "\""
-	lsaquo = "'"
-	rsaquo = "'"
-)
+// headingTitle matches a heading title: no further #, except inside {#id}
+// anchor definitions.
+const headingTitle = `((?:[^#{]|\{#[a-zA-Z0-9_-]+\}|\{)+)`
 
 var (
-	reChapter    = regexp.MustCompile(`^\s*(#)\s*([^#]+)$`)
-	reHeadlines  = regexp.MustCompile(`^\s*(#{2,6})\s*([^#]+)$`)
-	reDivider    = regexp.MustCompile(`^\s*([\*\-]\s*)+$`)
-	rePagebreak  = regexp.MustCompile(`^\s*(_\s*)+$`)
-	reMeta       = regexp.MustCompile(`\$\[(title|author|series|set|entry|uuid|language|quotes|date|rights|source|relation|type)\]\(([^\)]+)\)`)
-	reCover      = regexp.MustCompile(`\!\[cover\]\(([^ \)]+)\s*(\"([^\"]*)\")?\)`)
-	reImage      = regexp.MustCompile(`\!\[([^\]]*)\]\(([^ \)]+)\s*(\"([^\"]*)\")?\)`)
-	reQuotes     = regexp.MustCompile(`(%"|"%|%'|'%)`)
-	reBold       = regexp.MustCompile(`\*\*([^\*]+)\*\*`)
-	reItalic     = regexp.MustCompile(`\*([^\*]+)\*`)
-	reCode       = regexp.MustCompile("`([^`]+)`")
-	reComment    = regexp.MustCompile(`(^|\s)//.*$`)
+	reChapter   = regexp.MustCompile(`^\s*(#)\s*` + headingTitle + `$`)
+	reHeadlines = regexp.MustCompile(`^\s*(#{2,6})\s*` + headingTitle + `$`)
+	reDivider   = regexp.MustCompile(`^\s*([\*\-]\s*)+$`)
+	rePagebreak = regexp.MustCompile(`^\s*(_\s*)+$`)
+	reMeta      = regexp.MustCompile(`\$\[(` + strings.Join(metaKeys, "|") + `)\]\(([^\)]+)\)`)
+	reCover     = regexp.MustCompile(`\!\[cover\]\(([^ \)]+)\s*(\"([^\"]*)\")?\)`)
+	reImage     = regexp.MustCompile(`\!\[([^\]]*)\]\(([^ \)]+)\s*(\"([^\"]*)\")?\)`)
 	// reListItem matches a bullet (-, *, +) or ordered (1. / 1)) list item.
 	// Group 1: leading indentation, group 2: bullet marker (empty if ordered),
 	// group 3: ordinal digits (empty if unordered), group 4: item content.
@@ -58,234 +31,633 @@ var (
 	reMidDash    = regexp.MustCompile(`\s+(--)\s+`)
 	reThreeDots  = regexp.MustCompile(`(\.\.\.)`)
 	reBlockQuote = regexp.MustCompile("\\s*```\\s*([a-zA-Z]*)")
-	reNewline    = regexp.MustCompile(`\r?\n`)
+	// reCodeFence matches the opening of a code fence with an optional
+	// language tag and attributes, in braces or not, e.g.
+	// ```go {linenos title="main.go"} or ```go title="main.go"
+	reCodeFence = regexp.MustCompile("^\\s*```\\s*([a-zA-Z][a-zA-Z0-9_+#-]*)?(?:\\s*\\{(.*)\\}|\\s+([^\\s{].*?))?\\s*$")
+	reFenceEnd  = regexp.MustCompile("^\\s*```\\s*$")
+	reNewline   = regexp.MustCompile(`\r?\n`)
 )
 
-// parseContext carries the book and base directory through the handler pipeline.
+// metaKeys are the keys of $[key](value) lines and the front matter.
+var metaKeys = []string{
+	"title", "author", "series", "set", "entry", "uuid", "language", "quotes", "typography", "hyphenation", "figure-numbering", "date", "rights", "source", "relation", "type",
+	"isbn", "publisher", "description", "subject", "contributor", "title-sort", "author-sort",
+}
+
+func isMetaKey(key string) bool {
+	for _, k := range metaKeys {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// parseContext carries the book, the base directory and the collections of
+// Pass 1 through parsing and rendering. One parseContext is created for
+// every conversion, so independent books can be converted concurrently.
 type parseContext struct {
-	book               SpellBook
-	baseDir            string
-	customCSSPaths     []string // book-internal paths (e.g. ["css/a.css", "css/b.css"])
-	currentChapterFile string   // filename of the chapter currently being rendered
-	azw3Mode           bool     // true when producing AZW3: all chapters form one document, so cross-chapter hrefs are plain #id
+	*Converter
+
+	book           SpellBook
+	format         outputFormat // what differs between EPUB and AZW3 output
+	baseDir        string
+	customCSSPaths []string // book-internal paths (e.g. ["css/a.css", "css/b.css"])
+	blockRules     []blockRule
+	inlineRules    []inlineRule
+	summary        Summary // diagnostics reported so far
+	frontMatter    []block // metadata of the front matter, see parseFrontMatter
+
+	// Pass 1 collections, see anchors.go.
+	anchors      map[string]anchorEntry      // anchor id → chapter file
+	indexes      map[string][]indexEntry     // index name → ordered list of occurrences
+	tocEntries   []tocEntry                  // all headings in document order
+	footnoteDefs map[string]*footnoteDefNode // footnote id → definition
+	figures      []figureEntry               // all figures in document order
+	tables       []tableEntry                // all tables with a caption in document order
+
+	endnotesChapter *chapter // the %endnotes chapter, nil for footnotes at the end of each chapter
 }
 
-// lineHandler matches and transforms one line.
-// handle returns (output, done): if done the output is the final result,
-// otherwise output is the transformed line to pass back through the pipeline.
-type lineHandler struct {
-	match  func(line string, insideBlock bool) bool
-	handle func(ctx *parseContext, line string, insideBlock bool) (string, bool)
+// newParseContext returns a parseContext with empty collections and the
+// output format matching book.
+func newParseContext(c *Converter, book SpellBook, baseDir string) *parseContext {
+	var format outputFormat = epubFormat{}
+	switch b := book.(type) {
+	case *azw3Book:
+		format = azw3Format{}
+		b.verbose = func(format string, args ...any) { c.logMsg(LogVerbose, format, args...) }
+	case *epubBook:
+		format = epubFormat{epub2: b.version < 3}
+		b.verbose = func(format string, args ...any) { c.logMsg(LogVerbose, format, args...) }
+	}
+	return &parseContext{
+		Converter:    c,
+		book:         book,
+		format:       format,
+		baseDir:      baseDir,
+		blockRules:   c.blockRules(),
+		inlineRules:  c.inlineRules(),
+		anchors:      map[string]anchorEntry{},
+		indexes:      map[string][]indexEntry{},
+		footnoteDefs: map[string]*footnoteDefNode{},
+	}
 }
 
-// replaceAndRecurse creates a handler that applies a regex substitution and continues the pipeline.
-func replaceAndRecurse(re *regexp.Regexp, replacement string) lineHandler {
-	return lineHandler{
-		match: func(line string, _ bool) bool { return re.MatchString(line) },
-		handle: func(_ *parseContext, line string, _ bool) (string, bool) {
-			return re.ReplaceAllString(line, replacement), false
-		},
+// blockParser builds the document tree line by line.
+type blockParser struct {
+	ctx        *parseContext
+	doc        *document
+	chapter    *chapter        // chapter being filled; nil in the preamble
+	para       *paragraphNode  // paragraph still accepting lines, nil if none
+	fence      *blockquoteNode // open ```cite/note/info/warn block, nil if none
+	fencePara  *paragraphNode  // paragraph inside the open ``` block
+	code       *codeBlockNode  // open code fence, nil if none
+	listStack  []listFrame     // open list levels, innermost last
+	headingNum [7]int          // per-level heading counters for the label<level>_<n> ids
+	table      *tableNode      // table still accepting rows, nil if none
+	caption    *tableCaption   // Table: line waiting for the table after it
+	tableNum   int             // tables so far, for the table-<n> ids
+	figureNum  int             // figures so far, for the figure-<n> ids
+	imageLine  []inline        // the line matchImageLine parsed, for parseImageLine
+	lines      []sourceLine    // the whole input, for lookahead
+	index      int             // index of the line being parsed
+	pos        sourcePos       // start of the line being parsed
+}
+
+// parseDocument parses fully-included markdown into a document tree.
+func parseDocument(ctx *parseContext, lines []sourceLine) *document {
+	p := &blockParser{ctx: ctx, doc: &document{preamble: ctx.frontMatter}, lines: lines}
+	p.parseLines()
+	startChapterNumbers(p.doc)
+	return p.doc
+}
+
+// parseLines parses p.lines. A rule may consume the lines after the current
+// one by advancing p.index.
+func (p *blockParser) parseLines() {
+	for p.index = 0; p.index < len(p.lines); p.index++ {
+		p.pos = p.lines[p.index].pos
+		p.parseLine(p.lines[p.index].text)
 	}
 }
 
-// staticResult creates a handler that returns a fixed HTML string for any matching line.
-func staticResult(re *regexp.Regexp, result string) lineHandler {
-	return lineHandler{
-		match:  func(line string, _ bool) bool { return re.MatchString(line) },
-		handle: func(_ *parseContext, _ string, _ bool) (string, bool) { return result, true },
+// peek returns the text of the line n lines after the current one, or ""
+// past the end of the input.
+func (p *blockParser) peek(n int) string {
+	if i := p.index + n; i < len(p.lines) {
+		return p.lines[i].text
 	}
+	return ""
 }
 
-// backtickSegments splits line into alternating non-code and code segments.
-// Even indices are outside backticks; odd indices are inside (including the backticks).
-func backtickSegments(line string) []string {
-	var segs []string
-	for len(line) > 0 {
-		tick := strings.Index(line, "`")
-		if tick == -1 {
-			segs = append(segs, line)
-			break
+// add appends b to the current chapter, or to the preamble before the first one.
+func (p *blockParser) add(b block) {
+	if p.chapter != nil {
+		p.chapter.blocks = append(p.chapter.blocks, b)
+	} else {
+		p.doc.preamble = append(p.doc.preamble, b)
+	}
+}
+
+// startChapter begins a new chapter; all following blocks belong to it.
+func (p *blockParser) startChapter(c *chapter) {
+	p.doc.chapters = append(p.doc.chapters, c)
+	p.chapter = c
+	p.para = nil
+}
+
+// blockRule is one step of the block pipeline: the first rule whose match
+// accepts a line parses it. Custom block commands are inserted into the
+// pipeline as rules of their own, see Command.
+type blockRule struct {
+	name  string
+	match func(p *blockParser, line string) bool
+	parse func(p *blockParser, line string)
+}
+
+// matchLine adapts a regexp to a blockRule match.
+func matchLine(re *regexp.Regexp) func(*blockParser, string) bool {
+	return func(_ *blockParser, line string) bool { return re.MatchString(line) }
+}
+
+// builtinBlockRules are the block constructs in the order they are tried.
+var builtinBlockRules = []blockRule{
+	{"fence", matchLine(reBlockQuote), (*blockParser).parseFence},
+	{"chapter", matchLine(reChapter), (*blockParser).parseChapter},
+	{"heading", matchLine(reHeadlines), (*blockParser).parseHeading},
+	{"meta", matchLine(reMeta), (*blockParser).parseMeta},
+	{"cover", matchLine(reCover), (*blockParser).parseCover},
+	{"image", (*blockParser).matchImageLine, (*blockParser).parseImageLine},
+	{"index", matchLine(reIndexOutput), (*blockParser).parseIndexOutput},
+	{"toc", matchLine(reTocOutput), (*blockParser).parseTocOutput},
+	{"figures", matchLine(reFiguresOutput), (*blockParser).parseFiguresOutput},
+	{"tables", matchLine(reTablesOutput), (*blockParser).parseTablesOutput},
+	{"endnotes", matchLine(reEndnotesOutput), (*blockParser).parseEndnotesOutput},
+	{"footnote", matchLine(reFootnoteDef), (*blockParser).parseFootnoteDef},
+	{"table", (*blockParser).matchTable, (*blockParser).parseTable},
+	{"divider", matchLine(reDivider), func(p *blockParser, _ string) { p.addBlock(&dividerNode{}) }},
+	{"pagebreak", matchLine(rePagebreak), func(p *blockParser, _ string) { p.addBlock(&pagebreakNode{}) }},
+	{"list", matchLine(reListItem), (*blockParser).parseListItem},
+	{"html", (*blockParser).matchBlockElement, (*blockParser).parseRawBlock},
+}
+
+// parseLine adds one source line to the tree. The block rules are tried in
+// order; a line that none of them accepts is paragraph text.
+//
+// Consecutive text lines form one paragraph; a blank line or a block
+// construct ends it. Lines that produce no output of their own (meta, cover,
+// footnote definitions) leave the paragraph open, and blank lines leave an
+// open list open.
+func (p *blockParser) parseLine(line string) {
+	if p.code != nil {
+		if reFenceEnd.MatchString(line) {
+			p.code = nil
+		} else {
+			p.code.lines = append(p.code.lines, line)
 		}
-		segs = append(segs, line[:tick])
-		line = line[tick:]
-		end := strings.Index(line[1:], "`")
-		if end == -1 {
-			segs = append(segs, line)
-			break
+		return
+	}
+	if p.fence != nil {
+		p.parseFenceLine(line)
+		return
+	}
+	if strings.TrimSpace(line) == "" {
+		p.para = nil
+		p.table = nil
+		return
+	}
+
+	// Escaped block markers (\#, \-, \1.) must not be taken for structure.
+	line = resolveEscapes(line)
+
+	if !reListItem.MatchString(line) {
+		p.listStack = nil
+	}
+	if !reTableRow.MatchString(line) && !reTableCaption.MatchString(line) {
+		p.table = nil
+	}
+
+	for _, rule := range p.ctx.blockRules {
+		if rule.match(p, line) {
+			rule.parse(p, line)
+			return
 		}
-		segs = append(segs, line[:end+2])
-		line = line[end+2:]
 	}
-	return segs
+
+	if p.para == nil {
+		p.para = &paragraphNode{}
+		p.add(p.para)
+	}
+	p.para.lines = append(p.para.lines, p.inlineTrimmed(line, 0))
 }
 
-// matchOutsideBackticks returns true if re matches anywhere outside inline backtick spans.
-func matchOutsideBackticks(line string, re *regexp.Regexp) bool {
-	for i, seg := range backtickSegments(line) {
-		if i%2 == 0 && re.MatchString(seg) {
-			return true
-		}
+// inline parses s, which starts at byte offset in the current line.
+func (p *blockParser) inline(s string, offset int) []inline {
+	return smartQuotes(p.ctx.parseInline(s, p.pos.shift(offset)))
+}
+
+// inlineTrimmed parses s without surrounding whitespace, like inline.
+func (p *blockParser) inlineTrimmed(s string, offset int) []inline {
+	trimmed := strings.TrimLeftFunc(s, unicode.IsSpace)
+	return p.inline(strings.TrimRightFunc(trimmed, unicode.IsSpace), offset+len(s)-len(trimmed))
+}
+
+// addBlock adds a block that ends the current paragraph.
+func (p *blockParser) addBlock(b block) {
+	p.add(b)
+	p.para = nil
+}
+
+func (p *blockParser) parseFence(line string) {
+	m := reBlockQuote.FindStringSubmatch(line)
+	class := strings.ToLower(m[1])
+	if class != "cite" && class != "note" && class != "info" && class != "warn" {
+		p.parseCodeFence(line)
+		return
 	}
-	return false
+	p.fence = &blockquoteNode{class: class}
+	p.addBlock(p.fence)
+	p.ctx.logMsg(LogVerbose, "blockQuote opening: %s", class)
 }
 
-// replaceOutsideBackticks applies fn to every match of re, but only in segments of line
-// that are outside inline backtick spans. Backtick-delimited segments are passed through unchanged.
-func replaceOutsideBackticks(line string, re *regexp.Regexp, fn func([]string) string) string {
-	var result strings.Builder
-	for i, seg := range backtickSegments(line) {
-		if i%2 == 0 {
-			result.WriteString(re.ReplaceAllStringFunc(seg, func(m string) string {
-				return fn(re.FindStringSubmatch(m))
-			}))
-		} else {
-			result.WriteString(seg)
-		}
+func (p *blockParser) parseChapter(line string) {
+	m := reChapter.FindStringSubmatchIndex(line)
+	p.startChapter(&chapter{kind: chapterText, pos: p.pos, title: p.inline(line[m[4]:m[5]], m[4])})
+}
+
+func (p *blockParser) parseHeading(line string) {
+	m := reHeadlines.FindStringSubmatchIndex(line)
+	level := m[3] - m[2]
+	p.headingNum[level]++
+	p.addBlock(&headingNode{
+		level: level,
+		label: labelFor(level, p.headingNum[level]),
+		title: p.inline(line[m[4]:m[5]], m[4]),
+	})
+}
+
+func (p *blockParser) parseMeta(line string) {
+	m := reMeta.FindStringSubmatchIndex(line)
+	p.add(&metaNode{key: line[m[2]:m[3]], value: line[m[4]:m[5]], pos: p.pos.shift(m[0])})
+}
+
+func (p *blockParser) parseCover(line string) {
+	m := reCover.FindStringSubmatchIndex(line)
+	p.add(&coverNode{src: line[m[2]:m[3]], pos: p.pos.shift(m[0])})
+}
+
+func (p *blockParser) matchImageLine(line string) bool {
+	if !reImage.MatchString(line) {
+		return false
 	}
-	return result.String()
-}
-
-// replaceEachAndRecurse creates a handler that transforms each regex match via fn and continues the pipeline.
-// fn receives (ctx, captureGroup1).
-func replaceEachAndRecurse(re *regexp.Regexp, fn func(*parseContext, string) string) lineHandler {
-	return lineHandler{
-		match: func(line string, _ bool) bool { return re.MatchString(line) },
-		handle: func(ctx *parseContext, line string, _ bool) (string, bool) {
-			return re.ReplaceAllStringFunc(line, func(match string) string {
-				return fn(ctx, re.FindStringSubmatch(match)[1])
-			}), false
-		},
-	}
-}
-
-var handlers []lineHandler
-
-func init() {
-	handlers = []lineHandler{
-		escapeHandler(),
-		listCloseHandler(),
-		blockquoteFenceHandler(),
-		blockquoteContentHandler(),
-		chapterHandler(),
-		headlineHandler(),
-		metaHandler(),
-		coverHandler(),
-		imageHandler(),
-		indexOutputHandler(),
-		tocOutputHandler(),
-		footnoteDefHandler(),
-		anchorDefHandler(),
-		anchorLinkHandler(),
-		indexEntryHandler(),
-		linkHandler(),
-		footnoteRefHandler(),
-		dividerHandler(),
-		pagebreakHandler(),
-		quotesHandler(),
-		listItemHandler(),
-		boldHandler(),
-		italicHandler(),
-		codeSpanHandler(),
-		commentHandler(),
-		emDashHandler(),
-		enDashHandler(),
-		ellipsisHandler(),
-	}
-}
-
-// Add a chapter file to the book
-func addChapter(ctx *parseContext, chapterTitle string, chapterNumber int, chapterContent strings.Builder) error {
-	filename := fmt.Sprintf("xhtml/chapter_%05d.xhtml", chapterNumber)
-
-	var content string
-	if ctx.azw3Mode {
-		// AZW3: mobi chunks must be plain HTML fragments, not full documents.
-		// CSS is applied globally via AddStylesheet; no wrapper needed.
-		content = chapterContent.String()
-	} else {
-		var customCSSLinks string
-		for _, p := range ctx.customCSSPaths {
-			customCSSLinks += "\n\t\t<link rel=\"stylesheet\" href=\"../" + p + "\"/>"
+	p.imageLine = p.inline(line, 0)
+	return imagesOnly(p.imageLine)
+}
+
+func (p *blockParser) parseImageLine(string) {
+	content := p.imageLine
+	if f := p.figure(content); f != nil {
+		p.addBlock(f)
+		return
+	}
+	p.addBlock(&imageLineNode{content: content})
+}
+
+// parseImageAttributes applies the attribute block of an image to img: an
+// optional #id first, then width=N%, align=left|center|right,
+// float=left|right, icon and fullpage.
+func parseImageAttributes(img *imageNode, s string) error {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "#") {
+		id, rest, _ := strings.Cut(s[1:], " ")
+		if reAnchorDefAt.FindString("{#"+id+"}") != "{#"+id+"}" {
+			return fmt.Errorf("invalid id %q", id)
 		}
-		content = `<?xml version="1.0" encoding="utf-8"?>
-<!DOCTYPE html>
-<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
-    <head>
-        <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
-        <title>` + chapterTitle + `</title>` + customCSSLinks + `
-    </head>
-    <body>
-	` + chapterContent.String() + `
-	</body>
-</html>`
-	}
-	_, err := ctx.book.AddXHTML(filename, chapterTitle, content, 10)
+		img.id, s = id, rest
+	}
+	attrs, err := parseAttributes(s)
 	if err != nil {
 		return err
 	}
-	logMsg(LogDefault, "Add chapter %s as %s", chapterTitle, filename)
+	var a imageAttrs
+	for key, value := range attrs {
+		switch key {
+		case "width":
+			n, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+			if err != nil || !strings.HasSuffix(value, "%") || n < 1 || n > 100 {
+				return fmt.Errorf("width must be a percentage from 1%% to 100%%, got %q", value)
+			}
+			a.width = n
+		case "align":
+			switch value {
+			case "left", "center", "right":
+				a.align = value
+			default:
+				return fmt.Errorf("align must be left, center or right, got %q", value)
+			}
+		case "float":
+			switch value {
+			case "left", "right":
+				a.float = value
+			default:
+				return fmt.Errorf("float must be left or right, got %q", value)
+			}
+		case "icon":
+			a.icon = true
+		case "fullpage":
+			a.fullPage = true
+		default:
+			return fmt.Errorf("unknown attribute %s", key)
+		}
+	}
+	img.attrs = a
 	return nil
 }
 
-func addCover(book SpellBook, imageFile string, baseDir string, addCoverPage bool) error {
-	currentImage := fmt.Sprintf("img/cover%s", filepath.Ext(imageFile))
-	imageID, err := book.AddImageFile(filepath.Join(baseDir, imageFile), currentImage)
-	if err != nil {
-		return err
+// figure returns the figure an image line forms, or nil: an image alone on
+// its line, optionally followed by an {#id}, is a figure if it has a title
+// or an id. The id may also be given in the attribute block of the image.
+func (p *blockParser) figure(content []inline) *figureNode {
+	var img *imageNode
+	var anchor *anchorDefNode
+	for _, n := range content {
+		switch n := n.(type) {
+		case *imageNode:
+			if img != nil {
+				return nil
+			}
+			img = n
+		case *anchorDefNode:
+			if img == nil || anchor != nil {
+				return nil
+			}
+			anchor = n
+		case *textNode:
+			if strings.TrimSpace(n.text) != "" {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+	if img == nil || img.title == "" && img.id == "" && anchor == nil {
+		return nil
+	}
+	p.figureNum++
+	f := &figureNode{id: fmt.Sprintf("figure-%d", p.figureNum), image: img, pos: img.pos}
+	switch {
+	case anchor != nil:
+		f.id = anchor.id
+	case img.id != "":
+		f.id = img.id
 	}
-	book.SetCoverImage(imageID)
-	logMsg(LogVerbose, "Added cover image %s: %s", imageID, currentImage)
+	if img.title != "" {
+		f.caption = smartQuotes(p.ctx.parseInline(img.title, img.pos))
+	}
+	return f
+}
 
-	if addCoverPage {
-		isAZW3 := strings.Contains(imageID, "kindle:")
-		imgSrc := "../" + currentImage
-		if isAZW3 {
-			imgSrc = imageID
-		}
-		var htmlContent string
-		if isAZW3 {
-			htmlContent = `<div style="text-align:center;padding:0;margin:0;"><img src="` + imgSrc + `" style="max-width:100%;"/></div>`
+func (p *blockParser) parseIndexOutput(line string) {
+	m := reIndexOutput.FindStringSubmatch(line)
+	title := m[2]
+	if title == "" {
+		title = m[1]
+	}
+	opts := indexOptions{locators: "chapter"}
+	if m[3] != "" {
+		configured, err := parseIndexOptions(opts, m[3])
+		if err != nil {
+			p.ctx.warnAt(p.pos, "index options ignored: %v", err)
 		} else {
-			htmlContent = `<?xml version="1.0" encoding="utf-8"?>
-<!DOCTYPE xhtml>
-<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
-    <head>
-        <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
-        <title>Cover</title>
-		<style type="text/css">
-            @page {padding: 0pt; margin:0pt}
-            body { text-align: center; padding:0pt; margin: 0pt; }
-        </style>
-    </head>
-    <body>
-		<div>
-            <svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%" height="100%" viewBox="0 0 1240 1752" preserveAspectRatio="none">
-                <image width="1240" height="1752" xlink:href="` + imgSrc + `"/>
-            </svg>
-        </div>
-	</body>
-</html>`
+			opts = configured
+		}
+	}
+	p.startChapter(&chapter{kind: chapterIndex, pos: p.pos, indexName: m[1], index: opts, title: []inline{&textNode{text: title}}})
+}
+
+// parseIndexOptions applies the {options} of an %index command to opts:
+// jumpbar and locators=chapter|section|number.
+func parseIndexOptions(opts indexOptions, s string) (indexOptions, error) {
+	attrs, err := parseAttributes(s)
+	if err != nil {
+		return opts, err
+	}
+	for key, value := range attrs {
+		switch key {
+		case "jumpbar":
+			opts.jumpBar = true
+		case "locators":
+			switch value {
+			case "chapter", "section", "number":
+				opts.locators = value
+			default:
+				return opts, fmt.Errorf("locators must be chapter, section or number, got %q", value)
+			}
+		default:
+			return opts, fmt.Errorf("unknown option %s", key)
 		}
-		_, err = book.AddXHTML("xhtml/cover.xhtml", "Cover", htmlContent, 1)
+	}
+	return opts, nil
+}
+
+func (p *blockParser) parseTocOutput(line string) {
+	m := reTocOutput.FindStringSubmatch(line)
+	title := m[1]
+	if title == "" {
+		title = "Table of Contents"
+	}
+	p.startChapter(&chapter{kind: chapterTOC, pos: p.pos, title: []inline{&textNode{text: title}}})
+}
+
+func (p *blockParser) parseFiguresOutput(line string) {
+	m := reFiguresOutput.FindStringSubmatch(line)
+	title := m[1]
+	if title == "" {
+		title = "List of Figures"
+	}
+	p.startChapter(&chapter{kind: chapterFigures, pos: p.pos, title: []inline{&textNode{text: title}}})
+}
+
+func (p *blockParser) parseTablesOutput(line string) {
+	m := reTablesOutput.FindStringSubmatch(line)
+	title := m[1]
+	if title == "" {
+		title = "List of Tables"
+	}
+	p.startChapter(&chapter{kind: chapterTables, pos: p.pos, title: []inline{&textNode{text: title}}})
+}
+
+// parseEndnotesOutput starts the chapter that collects the footnotes of the
+// chapters before it. A book has one at most.
+func (p *blockParser) parseEndnotesOutput(line string) {
+	m := reEndnotesOutput.FindStringSubmatch(line)
+	if p.ctx.endnotesChapter != nil {
+		p.ctx.warnAt(p.pos, "%%endnotes given more than once, ignored")
+		return
+	}
+	title := m[1]
+	if title == "" {
+		title = "Notes"
+	}
+	numbering := "chapter"
+	if m[2] != "" {
+		configured, err := parseEndnotesOptions(numbering, m[2])
 		if err != nil {
-			return err
+			p.ctx.warnAt(p.pos, "endnotes options ignored: %v", err)
+		} else {
+			numbering = configured
 		}
-		logMsg(LogVerbose, "Add cover file cover.xhtml")
 	}
-	return nil
+	c := &chapter{kind: chapterEndnotes, pos: p.pos, numbering: numbering, title: []inline{&textNode{text: title}}}
+	p.ctx.endnotesChapter = c
+	p.startChapter(c)
+}
+
+// parseEndnotesOptions applies the {options} of an %endnotes command to
+// numbering: numbering=chapter|continuous.
+func parseEndnotesOptions(numbering, s string) (string, error) {
+	attrs, err := parseAttributes(s)
+	if err != nil {
+		return numbering, err
+	}
+	for key, value := range attrs {
+		switch key {
+		case "numbering":
+			switch value {
+			case "chapter", "continuous":
+				numbering = value
+			default:
+				return numbering, fmt.Errorf("numbering must be chapter or continuous, got %q", value)
+			}
+		default:
+			return numbering, fmt.Errorf("unknown option %s", key)
+		}
+	}
+	return numbering, nil
+}
+
+// parseFootnoteDef adds a footnote definition. As in CommonMark, the lines
+// indented by four spaces or a tab below it, blank lines between them
+// included, belong to the note and may hold further paragraphs, lists,
+// quotes or code.
+func (p *blockParser) parseFootnoteDef(line string) {
+	m := reFootnoteDef.FindStringSubmatchIndex(line)
+	lines := []sourceLine{{text: line[m[4]:m[5]], pos: p.pos.shift(m[4])}}
+	n := 0
+	for i := 1; ; i++ {
+		next := p.index + i
+		if next >= len(p.lines) {
+			break
+		}
+		text := p.lines[next].text
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		if !isIndentedContinuation(text) {
+			break
+		}
+		for _, l := range p.lines[p.index+n+1 : next+1] {
+			lines = append(lines, outdent(l))
+		}
+		n = i
+	}
+	d := &footnoteDefNode{id: line[m[2]:m[3]], pos: p.pos.shift(m[2] - 2), blocks: p.parseNested(lines)}
+	if n > 0 {
+		p.index += n
+		p.para = nil
+	}
+	p.add(d)
+}
+
+// isIndentedContinuation reports whether line is indented by at least four
+// columns, as the lines of a footnote below its first one.
+func isIndentedContinuation(line string) bool {
+	trimmed := strings.TrimLeft(line, " \t")
+	return indentWidth(line[:len(line)-len(trimmed)]) >= 4
+}
+
+// outdent removes up to four columns of leading whitespace from l.
+func outdent(l sourceLine) sourceLine {
+	i, w := 0, 0
+	for ; i < len(l.text) && w < 4; i++ {
+		switch l.text[i] {
+		case ' ':
+			w++
+		case '\t':
+			w += 4 - w%4
+		default:
+			return sourceLine{text: l.text[i:], pos: l.pos.shift(i)}
+		}
+	}
+	return sourceLine{text: l.text[i:], pos: l.pos.shift(i)}
+}
+
+// parseNested parses lines that belong to a block of their own, like the
+// lines of a footnote, and returns their blocks. Heading, table and figure numbers
+// go on from the enclosing document; chapters cannot start in them.
+func (p *blockParser) parseNested(lines []sourceLine) []block {
+	sub := &blockParser{ctx: p.ctx, doc: &document{}, lines: lines, headingNum: p.headingNum, tableNum: p.tableNum, figureNum: p.figureNum}
+	sub.parseLines()
+	p.headingNum, p.tableNum, p.figureNum = sub.headingNum, sub.tableNum, sub.figureNum
+	for _, c := range sub.doc.chapters {
+		p.ctx.warnAt(c.pos, "chapter inside a footnote ignored")
+	}
+	return sub.doc.preamble
+}
+
+func (p *blockParser) matchBlockElement(line string) bool {
+	return isBlockElement(strings.TrimSpace(line))
 }
 
-func parseLine(ctx *parseContext, line string, insideBlock bool) string {
-	for _, h := range handlers {
-		if h.match(line, insideBlock) {
-			output, done := h.handle(ctx, line, insideBlock)
-			if done {
-				return output
+func (p *blockParser) parseRawBlock(line string) {
+	p.addBlock(&rawBlockNode{content: p.inline(line, 0)})
+}
+
+// parseFenceLine handles a line inside an open ``` block: another fence
+// closes it, a blank line starts a new paragraph, anything else is content.
+func (p *blockParser) parseFenceLine(line string) {
+	line = resolveEscapes(line)
+	switch {
+	case reBlockQuote.MatchString(line):
+		p.fence = nil
+		p.fencePara = nil
+	case strings.TrimSpace(line) == "":
+		p.fencePara = nil
+	default:
+		if p.fencePara == nil {
+			p.fencePara = &paragraphNode{}
+			p.fence.paragraphs = append(p.fence.paragraphs, p.fencePara)
+		}
+		p.fencePara.lines = append(p.fencePara.lines, p.inline(line, 0))
+	}
+}
+
+// imagesOnly reports whether nodes hold at least one image and nothing else
+// but spaces, {#id} anchors and links around images. An image among text
+// stays in its paragraph.
+func imagesOnly(nodes []inline) bool {
+	found := false
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *imageNode:
+			found = true
+		case *anchorDefNode:
+		case *linkNode:
+			if !imagesOnly(n.children) {
+				return false
 			}
-			return parseLine(ctx, output, insideBlock)
+			found = true
+		case *textNode:
+			if strings.TrimSpace(n.text) != "" {
+				return false
+			}
+		default:
+			return false
 		}
 	}
-	return line
+	return found
 }
 
 // isBlockElement returns true when s is a block-level HTML element that must
@@ -304,82 +676,33 @@ func isBlockElement(s string) bool {
 	return false
 }
 
-// Parse chapters and other Markdown commands
-func parseMarkdown(book SpellBook, content string, baseDir string, customCSSFile string) error {
-	// Pass 1: collect all anchors and index entries before rendering.
-	resetAnchors()
-	listStack = nil
-	startReadingSet = false
-	scanAnchorsAndIndex(content)
+// Parse chapters and other Markdown commands. All state lives in ctx, so
+// conversions of different books may run concurrently.
+func (ctx *parseContext) parseMarkdown(lines []sourceLine, customCSS []string) {
+	addDefaultTemplate(ctx)
 
-	// split contents by lines
-	lines := reNewline.Split(content, -1)
-
-	addDefaultTemplate(book)
-
-	_, isAZW3 := book.(*azw3Book)
-	ctx := &parseContext{book: book, baseDir: baseDir, azw3Mode: isAZW3}
-	if !isAZW3 {
+	if _, isAZW3 := ctx.format.(azw3Format); !isAZW3 {
 		ctx.customCSSPaths = append(ctx.customCSSPaths, "css/_spellDefault.css")
 	}
-	for _, cssFile := range strings.FieldsFunc(customCSSFile, func(r rune) bool { return r == ',' }) {
-		cssFile = strings.TrimSpace(cssFile)
-		cssContent, err := os.ReadFile(cssFile)
+	for _, cssFile := range customCSS {
+		cssContent, err := ctx.readFile(cssFile)
 		if err != nil {
-			logMsg(LogDefault, "WARNING: Could not read custom CSS file '%s': %v", cssFile, err)
+			ctx.errorAt(sourcePos{file: cssFile}, problemAsset, "could not read custom CSS file: %v", err)
 			continue
 		}
 		internalPath := "css/" + filepath.Base(cssFile)
-		book.AddStylesheet(internalPath, string(cssContent))
+		ctx.book.AddStylesheet(internalPath, string(cssContent))
 		ctx.customCSSPaths = append(ctx.customCSSPaths, internalPath)
-		logMsg(LogDefault, "Added custom stylesheet %s", internalPath)
+		ctx.logMsg(LogDefault, "Added custom stylesheet %s", internalPath)
 	}
 
-	// Pass 2: render.
-	// Consecutive non-blank lines are accumulated into a single <p>; a blank line
-	// or a block-level element flushes the accumulator first.
-	var paraAccum []string
+	doc := parseDocument(ctx, lines)
 
-	flushParagraph := func() {
-		if len(paraAccum) == 0 {
-			return
-		}
-		text := strings.Join(paraAccum, " ")
-		paraAccum = nil
-		if firstparagraph {
-			firstparagraph = false
-			currentChapterContent.WriteString("<p class=\"firstparagraph\">" + text + "</p>\n")
-		} else {
-			currentChapterContent.WriteString("<p>" + text + "</p>\n")
-		}
-	}
-
-	for _, line := range lines {
-		if strings.TrimSpace(line) == "" {
-			flushParagraph()
-			continue
-		}
-		newline := parseLine(ctx, line, false)
-		trimmed := strings.TrimSpace(newline)
-		if trimmed == "" {
-			continue
-		}
-		if isBlockElement(trimmed) {
-			flushParagraph()
-			currentChapterContent.WriteString(newline)
-		} else {
-			paraAccum = append(paraAccum, trimmed)
-		}
-	}
-	flushParagraph()
-	// Close any list still open at end of input.
-	currentChapterContent.WriteString(closeAllLists())
-
-	// Add last chapter
-	if currentChapterTitle != "" {
-		appendPendingFootnotes(ctx)
-		addChapter(ctx, currentChapterTitle, currentChapterNumber[1], currentChapterContent)
-	}
+	// Pass 1: collect all anchors and index entries before rendering.
+	scanAnchorsAndIndex(ctx, doc)
+	numberChapters(ctx, doc)
+	numberFigures(ctx, doc)
 
-	return nil
+	// Pass 2: render.
+	newRenderer(ctx).renderDocument(doc)
 }
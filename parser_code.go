@@ -0,0 +1,86 @@
+package spell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseCodeFence opens a code fence. The fence tag names the language, the
+// attributes after it, in braces or not, configure the block:
+//
+//	title="main.go"    caption shown above the code
+//	tabs=8             expand tabs to every 8th column instead of every 4th
+//	wrap               wrap long lines instead of letting them run off
+//	linenos[=start]    number the lines, starting at 1 or start
+//	hl=2,4-6           emphasize lines 2 and 4 to 6, counted like the line numbers
+func (p *blockParser) parseCodeFence(line string) {
+	var lang, attributes string
+	if m := reCodeFence.FindStringSubmatch(line); m != nil {
+		lang, attributes = m[1], m[2]+m[3]
+	} else {
+		lang = reBlockQuote.FindStringSubmatch(line)[1]
+		p.ctx.warnAt(p.pos, "text around the code fence ignored, expected ```lang {options}")
+	}
+	lang = strings.ToLower(lang)
+	if lang == "code" {
+		lang = "" // ```code is a plain code fence
+	}
+
+	p.code = &codeBlockNode{lang: lang, tabWidth: 4, start: 1, pos: p.pos}
+	configured := *p.code
+	if err := configured.setOptions(attributes); err != nil {
+		p.ctx.warnAt(p.pos, "code block options ignored: %v", err)
+	} else {
+		*p.code = configured
+	}
+	p.addBlock(p.code)
+	p.ctx.logMsg(LogVerbose, "code block opening: %s", lang)
+}
+
+func (code *codeBlockNode) setOptions(s string) error {
+	attrs, err := parseAttributes(s)
+	if err != nil {
+		return err
+	}
+	for key, value := range attrs {
+		switch key {
+		case "title":
+			code.title = value
+		case "tabs":
+			if code.tabWidth, err = strconv.Atoi(value); err != nil || code.tabWidth < 1 {
+				return fmt.Errorf("tabs must be a positive number, got %q", value)
+			}
+		case "wrap":
+			code.wrap = true
+		case "linenos":
+			code.lineNumbers = true
+			if value != "" {
+				if code.start, err = strconv.Atoi(value); err != nil || code.start < 0 {
+					return fmt.Errorf("linenos must be a line number, got %q", value)
+				}
+			}
+		case "hl":
+			for _, r := range strings.Split(value, ",") {
+				first, last, err := parseLineRange(strings.TrimSpace(r))
+				if err != nil {
+					return err
+				}
+				code.highlight = append(code.highlight, lineRange{first, last})
+			}
+		default:
+			return fmt.Errorf("unknown option %s", key)
+		}
+	}
+	return nil
+}
+
+// highlighted reports whether line n, counted from start, is emphasized.
+func (code *codeBlockNode) highlighted(n int) bool {
+	for _, r := range code.highlight {
+		if n >= r.first && (r.last == 0 || n <= r.last) {
+			return true
+		}
+	}
+	return false
+}
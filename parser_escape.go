@@ -1,4 +1,4 @@
-package main
+package spell
 
 import (
 	"fmt"
@@ -19,8 +19,7 @@ func isASCIIPunct(r rune) bool {
 // A backslash before an ASCII punctuation character is replaced by that
 // character's numeric HTML entity (e.g. \* -> &#42;). The entity is inert to
 // every downstream regex (which match the literal character) and already
-// renders as the intended character, so no later un-masking is needed — the
-// same trick codeSpanHandler uses for spell's own trigger characters.
+// renders as the intended character, so no later un-masking is needed.
 //
 // Backticks are tracked so that escapes inside inline code are left literal
 // (Markdown does not process escapes inside code spans). Because an escaped
@@ -49,28 +48,3 @@ func resolveEscapes(line string) string {
 	}
 	return b.String()
 }
-
-// escapeHandler resolves backslash escapes before any other handler runs, so
-// that escaped block markers (\#, \-, \1.) are not mistaken for structure and
-// escaped inline markers (\*, \%, \[) are not interpreted. It is skipped
-// inside verbatim code fences, where backslashes are literal.
-//
-// match reports true only when resolution would actually change the line;
-// this both avoids needless work and guarantees termination, since after one
-// pass no resolvable escape remains and the handler no longer matches.
-func escapeHandler() lineHandler {
-	return lineHandler{
-		match: func(line string, _ bool) bool {
-			if inBlockType == BLOCKTYPE_CODE {
-				return false
-			}
-			if strings.IndexByte(line, '\\') < 0 {
-				return false
-			}
-			return resolveEscapes(line) != line
-		},
-		handle: func(ctx *parseContext, line string, insideBlock bool) (string, bool) {
-			return parseLine(ctx, resolveEscapes(line), insideBlock), true
-		},
-	}
-}
@@ -1,79 +1,238 @@
-package main
+package spell
 
 import (
-	"fmt"
+	"regexp"
 	"strings"
 )
 
-func quotesHandler() lineHandler {
-	return replaceEachAndRecurse(reQuotes, func(_ *parseContext, marker string) string {
-		switch marker {
-		case `%"`:
-			return laquo
-		case `"%`:
-			return raquo
-		case `%'`:
-			return lsaquo
-		case `'%`:
-			return rsaquo
-		default:
-			return marker
-		}
-	})
+// anchored returns re restricted to match at the start of the input, so the
+// inline scanner can try each construct at its current position.
+func anchored(re *regexp.Regexp) *regexp.Regexp {
+	return regexp.MustCompile(`^(?:` + re.String() + `)`)
 }
 
-// linkHandler renders inline links [text](url) and [text](url "title") as
-// external hyperlinks. Internal fragment links [text](#id) are handled
-// earlier by anchorLinkHandler; images ![alt](url) by imageHandler. Matches
-// inside backtick code spans are left untouched.
-func linkHandler() lineHandler {
-	return lineHandler{
-		match: func(line string, _ bool) bool { return matchOutsideBackticks(line, reLink) },
-		handle: func(ctx *parseContext, line string, insideBlock bool) (string, bool) {
-			out := replaceOutsideBackticks(line, reLink, func(sub []string) string {
-				if sub[3] != "" {
-					return fmt.Sprintf(`<a href="%s" title="%s">%s</a>`, sub[2], sub[3], sub[1])
-				}
-				return fmt.Sprintf(`<a href="%s">%s</a>`, sub[2], sub[1])
-			})
-			return parseLine(ctx, out, insideBlock), true
-		},
+var (
+	reAnchorDefAt   = anchored(reAnchorDef)
+	reAnchorLinkAt  = anchored(reAnchorLink)
+	reIndexEntryAt  = anchored(reIndexEntry)
+	reIndexXrefAt   = anchored(reIndexXref)
+	reLinkAt        = anchored(reLink)
+	reFootnoteRefAt = anchored(reFootnoteRef)
+	reImageAt       = anchored(reImage)
+	reFigureRefAt   = anchored(reFigureRef)
+	reImageAttrsAt  = regexp.MustCompile(`^\{([^{}]*)\}`)
+)
+
+// inlineRule is one step of the inline pipeline. parse looks at s[i:], which
+// starts at source position at, and returns the node found there and the
+// number of bytes it covers; a width of 0 means no match. A nil node with a width consumes the text without
+// output. Custom inline commands are inserted as rules of their own, see
+// Command.
+type inlineRule struct {
+	name  string
+	parse func(ctx *parseContext, s string, i int, at sourcePos) (inline, int)
+}
+
+// builtinInlineRules are the inline constructs in the order they are tried.
+// Code spans come first, so nothing inside backticks is ever interpreted.
+var builtinInlineRules = []inlineRule{
+	{"code", parseCodeSpan},
+	{"anchor", func(_ *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '{' {
+			return nil, 0
+		}
+		if m := reAnchorDefAt.FindStringSubmatch(s[i:]); m != nil {
+			return &anchorDefNode{id: m[1], pos: at}, len(m[0])
+		}
+		return nil, 0
+	}},
+	{"image", func(ctx *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '!' {
+			return nil, 0
+		}
+		m := reImageAt.FindStringSubmatch(s[i:])
+		if m == nil {
+			return nil, 0
+		}
+		img := &imageNode{alt: m[1], src: m[2], title: m[4], source: m[0], pos: at}
+		// An attribute block right after the image belongs to it; a lone
+		// {#id} is left to the anchor rule.
+		a := reImageAttrsAt.FindStringSubmatch(s[i+len(m[0]):])
+		if a == nil || reAnchorDefAt.FindString(a[0]) == a[0] {
+			return img, len(m[0])
+		}
+		if err := parseImageAttributes(img, a[1]); err != nil {
+			ctx.warnAt(at.shift(len(m[0])), "image attributes ignored: %v", err)
+		}
+		return img, len(m[0]) + len(a[0])
+	}},
+	{"index-term", func(ctx *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '%' {
+			return nil, 0
+		}
+		if m := reIndexEntryAt.FindStringSubmatchIndex(s[i:]); m != nil {
+			rest := s[i:]
+			term := rest[m[2]:m[3]]
+			canonical := term
+			if m[6] >= 0 && m[6] < m[7] {
+				canonical = rest[m[6]:m[7]]
+			}
+			return &indexTermNode{index: rest[m[4]:m[5]], canonical: canonical, children: ctx.parseInline(term, at.shift(m[2]))}, m[1]
+		}
+		return nil, 0
+	}},
+	{"index-xref", func(_ *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '%' {
+			return nil, 0
+		}
+		if m := reIndexXrefAt.FindStringSubmatch(s[i:]); m != nil {
+			return &indexXrefNode{index: m[3], term: m[2], target: m[4], also: m[1] == "seealso", pos: at}, len(m[0])
+		}
+		return nil, 0
+	}},
+	{"quote", parseQuote},
+	{"figure-ref", func(_ *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '[' {
+			return nil, 0
+		}
+		if m := reFigureRefAt.FindStringSubmatch(s[i:]); m != nil {
+			return &figureRefNode{id: m[1], pos: at}, len(m[0])
+		}
+		return nil, 0
+	}},
+	{"anchor-link", func(ctx *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '[' {
+			return nil, 0
+		}
+		if m := reAnchorLinkAt.FindStringSubmatch(s[i:]); m != nil {
+			return &anchorLinkNode{id: m[2], pos: at, children: ctx.parseInline(m[1], at.shift(1))}, len(m[0])
+		}
+		return nil, 0
+	}},
+	{"link", func(ctx *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '[' {
+			return nil, 0
+		}
+		if m := reLinkAt.FindStringSubmatch(s[i:]); m != nil {
+			return &linkNode{href: m[2], title: m[3], children: ctx.parseInline(m[1], at.shift(1))}, len(m[0])
+		}
+		return nil, 0
+	}},
+	{"footnote-ref", func(_ *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] != '[' {
+			return nil, 0
+		}
+		if m := reFootnoteRefAt.FindStringSubmatch(s[i:]); m != nil {
+			return &footnoteRefNode{id: m[1], pos: at}, len(m[0])
+		}
+		return nil, 0
+	}},
+	{"bold", func(ctx *parseContext, s string, i int, at sourcePos) (inline, int) {
+		rest := s[i:]
+		if strings.HasPrefix(rest, "**") {
+			if end := strings.Index(rest[2:], "**"); end > 0 {
+				return &boldNode{children: ctx.parseInline(rest[2:end+2], at.shift(2))}, end + 4
+			}
+		}
+		return nil, 0
+	}},
+	{"italic", func(ctx *parseContext, s string, i int, at sourcePos) (inline, int) {
+		if s[i] == '*' {
+			if end := italicClose(s[i:]); end > 1 {
+				return &italicNode{children: ctx.parseInline(s[i+1:i+end], at.shift(1))}, end + 1
+			}
+		}
+		return nil, 0
+	}},
+	{"comment", func(_ *parseContext, s string, i int, _ sourcePos) (inline, int) {
+		// A // at the start of the line or after whitespace starts a
+		// comment that runs to the end of the line.
+		if strings.HasPrefix(s[i:], "//") && (i == 0 || isSpace(s[i-1])) {
+			return nil, len(s) - i
+		}
+		return nil, 0
+	}},
+}
+
+func parseCodeSpan(_ *parseContext, s string, i int, _ sourcePos) (inline, int) {
+	if s[i] == '`' {
+		if end := strings.IndexByte(s[i+1:], '`'); end > 0 {
+			return &codeSpanNode{text: s[i+1 : i+1+end]}, end + 2
+		}
 	}
+	return nil, 0
 }
 
-func boldHandler() lineHandler {
-	return replaceEachAndRecurse(reBold, func(ctx *parseContext, inner string) string {
-		return "<b>" + parseLine(ctx, inner, true) + "</b>"
-	})
+// parseQuote recognises the explicit quote markers %" "% %' '%. A closing
+// marker directly followed by an index entry is left to the index entry.
+func parseQuote(_ *parseContext, s string, i int, _ sourcePos) (inline, int) {
+	rest := s[i:]
+	if len(rest) < 2 {
+		return nil, 0
+	}
+	switch {
+	case rest[0] == '%' && (rest[1] == '"' || rest[1] == '\''):
+		return &quoteNode{marker: rest[:2]}, 2
+	case (rest[0] == '"' || rest[0] == '\'') && rest[1] == '%' && !reIndexEntryAt.MatchString(rest[1:]):
+		return &quoteNode{marker: rest[:2]}, 2
+	}
+	return nil, 0
 }
 
-func italicHandler() lineHandler {
-	return replaceEachAndRecurse(reItalic, func(ctx *parseContext, inner string) string {
-		return "<i>" + parseLine(ctx, inner, true) + "</i>"
-	})
+// parseInline turns one line of (escape-resolved) markdown into inline
+// nodes. The line is scanned left to right; at every position the inline
+// rules are tried in order and the first match wins, anything else is
+// running text. Constructs that contain text (links, index terms, bold,
+// italic) parse their content recursively. at is the source position of
+// s[0]; nodes that can fail later remember theirs for diagnostics.
+func (ctx *parseContext) parseInline(s string, at sourcePos) []inline {
+	var out []inline
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			out = append(out, &textNode{text: text.String()})
+			text.Reset()
+		}
+	}
+
+scan:
+	for i := 0; i < len(s); {
+		for _, rule := range ctx.inlineRules {
+			if n, width := rule.parse(ctx, s, i, at.shift(i)); width > 0 {
+				flush()
+				if n != nil {
+					out = append(out, n)
+				}
+				i += width
+				continue scan
+			}
+		}
+		text.WriteByte(s[i])
+		i++
+	}
+	flush()
+	return out
 }
 
-func codeSpanHandler() lineHandler {
-	return replaceEachAndRecurse(reCode, func(_ *parseContext, inner string) string {
-		// Encode spell-specific trigger characters so that downstream handlers
-		// cannot match content that was written as inline code. The backslash
-		// is encoded first (it is a backslash-escape trigger, and encoding it
-		// keeps escapes literal inside code); its replacement introduces no
-		// further trigger characters.
-		inner = strings.ReplaceAll(inner, "\\", "&#92;")
-		inner = strings.ReplaceAll(inner, "%", "&#37;")
-		inner = strings.ReplaceAll(inner, "{", "&#123;")
-		inner = strings.ReplaceAll(inner, "}", "&#125;")
-		inner = strings.ReplaceAll(inner, "[", "&#91;")
-		inner = strings.ReplaceAll(inner, "]", "&#93;")
-		return `<span class="code">` + inner + "</span>"
-	})
+// italicClose returns the index of the * closing the italic span opened by
+// s[0], or -1. Complete **bold** spans inside are skipped, so that
+// *a **b** c* nests instead of closing at the first star of the bold span.
+func italicClose(s string) int {
+	for j := 1; j < len(s); j++ {
+		if s[j] != '*' {
+			continue
+		}
+		if j > 1 && strings.HasPrefix(s[j:], "**") {
+			if end := strings.Index(s[j+2:], "**"); end > 0 {
+				j += end + 3
+				continue
+			}
+		}
+		return j
+	}
+	return -1
 }
 
-// Numeric character references, not named HTML entities: an EPUB3 XHTML document
-// is parsed as XML, where only &lt; &gt; &amp; &quot; &apos; are predefined, so
-// &nbsp; and friends are undeclared-entity errors under epubcheck.
-func commentHandler() lineHandler  { return replaceAndRecurse(reComment, "$1") }
-func emDashHandler() lineHandler   { return replaceAndRecurse(reLongDash, "&#160;&#8212;&#160;") }
-func enDashHandler() lineHandler   { return replaceAndRecurse(reMidDash, "&#160;&#8211;&#160;") }
-func ellipsisHandler() lineHandler { return replaceAndRecurse(reThreeDots, "&#8230;") }
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v'
+}
@@ -0,0 +1,154 @@
+package spell
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// reTableRow matches a row of a pipe table, which must start with |.
+	reTableRow = regexp.MustCompile(`^\s*\|`)
+	// reTableDelimiter matches the row setting the column alignment, e.g.
+	// |:---|:---:|---:|
+	reTableDelimiter = regexp.MustCompile(`^\s*\|\s*:?-+:?\s*(\|\s*:?-+:?\s*)*\|?\s*$`)
+	// reTableCaption matches a caption line directly before or after a
+	// table: Table: caption text {#id}
+	reTableCaption = regexp.MustCompile(`^\s*Table:\s*(.*?)\s*(?:\{#([a-zA-Z0-9_-]+)\})?\s*$`)
+)
+
+// tableCaption is a parsed Table: line.
+type tableCaption struct {
+	title []inline
+	id    string
+}
+
+// matchTable accepts the rows and the caption of a pipe table. A table
+// starts with a header row followed by the delimiter row, or with the
+// delimiter row alone for a table without header.
+func (p *blockParser) matchTable(line string) bool {
+	switch {
+	case p.table != nil:
+		return reTableRow.MatchString(line) || reTableCaption.MatchString(line)
+	case reTableCaption.MatchString(line):
+		return startsTable(p.peek(1), p.peek(2))
+	}
+	return startsTable(line, p.peek(1))
+}
+
+// startsTable reports whether line is the first row of a table, given the
+// line after it.
+func startsTable(line, next string) bool {
+	if reTableDelimiter.MatchString(line) {
+		return true
+	}
+	if !reTableRow.MatchString(line) || !reTableDelimiter.MatchString(next) {
+		return false
+	}
+	header, _ := splitTableRow(line)
+	delimiter, _ := splitTableRow(next)
+	return len(header) == len(delimiter)
+}
+
+func (p *blockParser) parseTable(line string) {
+	if reTableCaption.MatchString(line) {
+		caption := p.parseTableCaption(line)
+		if p.table == nil {
+			p.caption = caption // the table follows on the next line
+			return
+		}
+		if p.table.caption == nil {
+			p.table.caption = caption.title
+			if caption.id != "" {
+				p.table.id = caption.id
+			}
+		}
+		p.table = nil // a caption after the table ends it
+		return
+	}
+
+	cells, offsets := splitTableRow(line)
+	switch {
+	case p.table == nil:
+		p.tableNum++
+		p.table = &tableNode{id: fmt.Sprintf("table-%d", p.tableNum), pos: p.pos}
+		if p.caption != nil {
+			p.table.caption = p.caption.title
+			if p.caption.id != "" {
+				p.table.id = p.caption.id
+			}
+			p.caption = nil
+		}
+		p.addBlock(p.table)
+		if reTableDelimiter.MatchString(line) {
+			p.table.align = tableAlignment(cells)
+		} else {
+			p.table.header = p.tableCells(cells, offsets)
+		}
+	case p.table.align == nil:
+		p.table.align = tableAlignment(cells)
+	default:
+		p.table.rows = append(p.table.rows, p.tableCells(cells, offsets))
+	}
+}
+
+func (p *blockParser) parseTableCaption(line string) *tableCaption {
+	m := reTableCaption.FindStringSubmatchIndex(line)
+	caption := &tableCaption{title: p.inline(line[m[2]:m[3]], m[2])}
+	if m[4] >= 0 {
+		caption.id = line[m[4]:m[5]]
+	}
+	return caption
+}
+
+// tableCells parses the cells of a row; rows are padded or cut to the
+// number of columns.
+func (p *blockParser) tableCells(cells []string, offsets []int) [][]inline {
+	columns := len(p.table.align)
+	if columns == 0 {
+		columns = len(cells) // the header row, before the delimiter row
+	}
+	row := make([][]inline, columns)
+	for i := range row {
+		if i < len(cells) {
+			row[i] = p.inlineTrimmed(cells[i], offsets[i])
+		}
+	}
+	return row
+}
+
+// tableAlignment returns the column alignment given by the cells of a
+// delimiter row.
+func tableAlignment(cells []string) []string {
+	align := make([]string, len(cells))
+	for i, c := range cells {
+		c = strings.TrimSpace(c)
+		left, right := strings.HasPrefix(c, ":"), strings.HasSuffix(c, ":")
+		switch {
+		case left && right:
+			align[i] = "center"
+		case left:
+			align[i] = "left"
+		case right:
+			align[i] = "right"
+		}
+	}
+	return align
+}
+
+// splitTableRow splits a row at its pipes and returns the cells with their
+// byte offsets in line. An escaped pipe \| has become an entity by now and
+// stays in its cell.
+func splitTableRow(line string) (cells []string, offsets []int) {
+	start := strings.IndexByte(line, '|') + 1
+	end := len(strings.TrimRight(line, " \t"))
+	if end > start && line[end-1] == '|' {
+		end--
+	}
+	for _, cell := range strings.Split(line[start:end], "|") {
+		cells = append(cells, cell)
+		offsets = append(offsets, start)
+		start += len(cell) + 1
+	}
+	return cells, offsets
+}
@@ -0,0 +1,116 @@
+package spell
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTableAlignment(t *testing.T) {
+	cells, _ := splitTableRow("|:---|:---:| ---: |---|")
+	want := []string{"left", "center", "right", ""}
+	if got := tableAlignment(cells); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestSplitTableRow(t *testing.T) {
+	tests := []struct {
+		line    string
+		cells   []string
+		offsets []int
+	}{
+		{"| a | b |", []string{" a ", " b "}, []int{1, 5}},
+		{"|a|b", []string{"a", "b"}, []int{1, 3}},
+		{"  | a |  ", []string{" a "}, []int{3}},
+		{"| a &#124; b | c |", []string{" a &#124; b ", " c "}, []int{1, 14}},
+		{"| | x |", []string{" ", " x "}, []int{1, 3}},
+	}
+	for _, tt := range tests {
+		cells, offsets := splitTableRow(tt.line)
+		if !reflect.DeepEqual(cells, tt.cells) || !reflect.DeepEqual(offsets, tt.offsets) {
+			t.Errorf("splitTableRow(%q) = %q, %v; want %q, %v", tt.line, cells, offsets, tt.cells, tt.offsets)
+		}
+	}
+}
+
+func TestStartsTable(t *testing.T) {
+	tests := []struct {
+		line, next string
+		want       bool
+	}{
+		{"| a | b |", "|---|---|", true},
+		{"| a | b |", "|:--|--:|", true},
+		{"|---|---|", "| a | b |", true},
+		{"| a | b |", "|---|", false},
+		{"| a | b |", "| c | d |", false},
+		{"a | b", "---|---", false},
+		{"| a |", "", false},
+		{"text", "|---|", false},
+	}
+	for _, tt := range tests {
+		if got := startsTable(tt.line, tt.next); got != tt.want {
+			t.Errorf("startsTable(%q, %q) = %v, want %v", tt.line, tt.next, got, tt.want)
+		}
+	}
+}
+
+func TestRenderTable(t *testing.T) {
+	tests := []struct {
+		name, md string
+		want     []string
+	}{
+		{
+			name: "header and alignment",
+			md:   "| Name | Qty | Price |\n|:-----|:---:|------:|\n| Tea | 2 | 3.50 |\n| Milk | 1 |",
+			want: []string{
+				`<table id="table-1" class="table">`,
+				`<thead>` + "\n" + `<tr><th class="align-left">Name</th><th class="align-center">Qty</th><th class="align-right">Price</th></tr>`,
+				`<tr><td class="align-left">Tea</td><td class="align-center">2</td><td class="align-right">3.50</td></tr>`,
+				`<tr><td class="align-left">Milk</td><td class="align-center">1</td><td class="align-right"></td></tr>`,
+			},
+		},
+		{
+			name: "without header",
+			md:   "|---|---|\n| a | b | c |",
+			want: []string{`<table id="table-1" class="table">` + "\n<tbody>\n<tr><td>a</td><td>b</td></tr>"},
+		},
+		{
+			name: "caption before",
+			md:   "Table: Prices of *tea* {#prices}\n| a |\n|---|\n| 1 |",
+			want: []string{`<table id="prices" class="table">` + "\n<caption>Prices of <i>tea</i></caption>"},
+		},
+		{
+			name: "caption after",
+			md:   "| a |\n|---|\n| 1 |\nTable: After",
+			want: []string{`<table id="table-1" class="table">` + "\n<caption>After</caption>"},
+		},
+		{
+			name: "escaped pipe and inline markup",
+			md:   "| a |\n|---|\n| x \\| **y** |",
+			want: []string{`<td>x &#124; <b>y</b></td>`},
+		},
+		{
+			name: "numbering",
+			md:   "| a |\n|---|\n\n| b |\n|---|",
+			want: []string{`<table id="table-1" class="table">`, `<table id="table-2" class="table">`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := convertMarkdown(t, "# Chapter\n\n"+tt.md+"\n").book.body()
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("missing %q in\n%s", want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestTableWithoutDelimiterIsText(t *testing.T) {
+	got := convertMarkdown(t, "# Chapter\n\n| a | b |\n| c | d |\n").book.body()
+	if strings.Contains(got, "<table") {
+		t.Errorf("rows without a delimiter row became a table:\n%s", got)
+	}
+}
@@ -0,0 +1,179 @@
+package spell
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// quoteSet holds the characters of one typographic convention: double and
+// single opening and closing quotes.
+type quoteSet [4]string
+
+// quotePresets are the quote conventions by language tag. "ch" is the Swiss
+// convention, which also applies to de-ch.
+var quotePresets = map[string]quoteSet{
+	"en":    {"“", "”", "‘", "’"},
+	"en-gb": {"‘", "’", "“", "”"},
+	"de":    {"„", "“", "‚", "‘"},
+	"ch":    {"«", "»", "‹", "›"},
+	"de-ch": {"«", "»", "‹", "›"},
+	"fr":    {"«", "»", "‹", "›"},
+	"it":    {"«", "»", "“", "”"},
+	"es":    {"«", "»", "“", "”"},
+	"pt":    {"«", "»", "“", "”"},
+	"nl":    {"“", "”", "‘", "’"},
+	"da":    {"»", "«", "›", "‹"},
+	"sv":    {"”", "”", "’", "’"},
+	"fi":    {"”", "”", "’", "’"},
+	"no":    {"«", "»", "‘", "’"},
+	"nb":    {"«", "»", "‘", "’"},
+	"pl":    {"„", "”", "«", "»"},
+	"cs":    {"„", "“", "‚", "‘"},
+	"ru":    {"«", "»", "„", "“"},
+}
+
+// apostrophe is the typographic apostrophe of smart quotes.
+const apostrophe = "’"
+
+// lookupQuotes returns the preset for a language tag like de-CH or en_US,
+// falling back to the primary language.
+func lookupQuotes(tag string) (quoteSet, bool) {
+	tag = strings.ReplaceAll(strings.ToLower(strings.TrimSpace(tag)), "_", "-")
+	if q, ok := quotePresets[tag]; ok {
+		return q, true
+	}
+	primary, _, _ := strings.Cut(tag, "-")
+	q, ok := quotePresets[primary]
+	return q, ok
+}
+
+// setQuotes makes q the characters of the quote markers.
+func (r *renderer) setQuotes(q quoteSet) {
+	r.laquo, r.raquo, r.lsaquo, r.rsaquo = q[0], q[1], q[2], q[3]
+}
+
+// smartQuoter finds the straight quotes of running text and decides whether
+// each opens or closes a quote or is an apostrophe. It works on the nodes of
+// one line, so that a quote after *italic* text knows what came before.
+type smartQuoter struct {
+	prev    rune // last character before the current position, ' ' at the start
+	singles int  // single quotes opened and not closed yet
+}
+
+// smartQuotes replaces the straight quotes in the text of nodes by quote
+// nodes marked auto. Whether they are rendered as typographic quotes is
+// decided by the renderer.
+func smartQuotes(nodes []inline) []inline {
+	q := &smartQuoter{prev: ' '}
+	return q.apply(nodes)
+}
+
+func (q *smartQuoter) apply(nodes []inline) []inline {
+	var out []inline
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *textNode:
+			out = append(out, q.text(n.text)...)
+			continue
+		case *codeSpanNode:
+			q.after(n.text)
+		case *quoteNode:
+			// An explicit opening marker acts like the start of the text.
+			if strings.HasPrefix(n.marker, "%") {
+				q.prev = ' '
+			} else {
+				q.prev = '"'
+			}
+		case *boldNode:
+			n.children = q.apply(n.children)
+		case *italicNode:
+			n.children = q.apply(n.children)
+		case *linkNode:
+			n.children = q.apply(n.children)
+		case *anchorLinkNode:
+			n.children = q.apply(n.children)
+		case *indexTermNode:
+			n.children = q.apply(n.children)
+		case *imageNode:
+			q.prev = 'x'
+		}
+		out = append(out, n)
+	}
+	return out
+}
+
+// text splits s into text and quote nodes. Character references, like the
+// &#34; of an escaped \", are left alone.
+func (q *smartQuoter) text(s string) []inline {
+	var out []inline
+	start := 0
+	for i := 0; i < len(s); {
+		c, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case c == '&':
+			if ref := reEntity.FindString(s[i:]); ref != "" {
+				i += len(ref)
+				q.prev = 'x'
+				continue
+			}
+		case c == '"' || c == '\'':
+			next, _ := utf8.DecodeRuneInString(s[i+1:])
+			if i+1 == len(s) {
+				next = ' '
+			}
+			if i > start {
+				out = append(out, &textNode{text: s[start:i]})
+			}
+			marker := q.quote(c, next)
+			out = append(out, &quoteNode{marker: marker, auto: true})
+			i++
+			start = i
+			if marker[0] == '%' {
+				q.prev = ' '
+			} else {
+				q.prev = c
+			}
+			continue
+		}
+		q.prev = c
+		i += size
+	}
+	if start < len(s) {
+		out = append(out, &textNode{text: s[start:]})
+	}
+	return out
+}
+
+// quote returns the marker for the straight quote c followed by next: one
+// of the explicit markers, or "'" for an apostrophe.
+func (q *smartQuoter) quote(c, next rune) string {
+	opening := unicode.IsSpace(q.prev) || strings.ContainsRune("([{-/–—", q.prev)
+	if c == '"' {
+		if opening {
+			return `%"`
+		}
+		return `"%`
+	}
+	word := unicode.IsLetter(q.prev) || unicode.IsDigit(q.prev)
+	switch {
+	case word && unicode.IsLetter(next):
+		return "'" // don't, l'homme
+	case opening && unicode.IsDigit(next):
+		return "'" // the '90s
+	case opening:
+		q.singles++
+		return `%'`
+	case q.singles > 0:
+		q.singles--
+		return `'%`
+	}
+	return "'" // the dogs' bowls
+}
+
+// after notes that s was written, for the next quote to look at.
+func (q *smartQuoter) after(s string) {
+	if c, _ := utf8.DecodeLastRuneInString(s); c != utf8.RuneError {
+		q.prev = c
+	}
+}
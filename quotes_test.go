@@ -0,0 +1,89 @@
+package spell
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestLookupQuotes(t *testing.T) {
+	tests := []struct {
+		tag  string
+		want quoteSet
+		ok   bool
+	}{
+		{"en", quoteSet{"“", "”", "‘", "’"}, true},
+		{"en-US", quoteSet{"“", "”", "‘", "’"}, true},
+		{"en_GB", quoteSet{"‘", "’", "“", "”"}, true},
+		{"de", quoteSet{"„", "“", "‚", "‘"}, true},
+		{"de-AT", quoteSet{"„", "“", "‚", "‘"}, true},
+		{" de-CH ", quoteSet{"«", "»", "‹", "›"}, true},
+		{"ch", quoteSet{"«", "»", "‹", "›"}, true},
+		{"tlh", quoteSet{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := lookupQuotes(tt.tag)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lookupQuotes(%q) = %q, %v, want %q, %v", tt.tag, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+var reParagraph = regexp.MustCompile(`<p[^>]*>(.*)</p>`)
+
+// paragraphs converts md, with the front lines prepended, and returns the
+// content of its paragraphs.
+func paragraphs(t *testing.T, c *Converter, front, md string) []string {
+	t.Helper()
+	conv := convertFiles(t, map[string]string{"main.md": front + "\n# One\n\n" + md + "\n"}, c)
+	if conv.err != nil {
+		t.Fatalf("unexpected error: %v\n%s", conv.err, conv.diags)
+	}
+	var out []string
+	for _, m := range reParagraph.FindAllStringSubmatch(conv.book.body(), -1) {
+		out = append(out, m[1])
+	}
+	return out
+}
+
+func TestSmartQuotes(t *testing.T) {
+	tests := []struct {
+		lang, md, want string
+	}{
+		{"en", `"Hello," she said.`, `“Hello,” she said.`},
+		{"en", `It's 'fine', isn't it?`, `It’s ‘fine’, isn’t it?`},
+		{"en", `In the '90s, l'amour.`, `In the ’90s, l’amour.`},
+		{"en", `The dogs' bowls.`, `The dogs’ bowls.`},
+		{"en", `He said: "She said 'no'."`, `He said: “She said ‘no’.”`},
+		{"en", `("round") ["square"] -"dash"`, `(“round”) [“square”] -“dash”`},
+		{"en", `"*Italic*" and *"inside"*`, `“<i>Italic</i>” and <i>“inside”</i>`},
+		{"en", `A "[link](https://example.com)"`, `A “<a href="https://example.com">link</a>”`},
+		{"en", "Code `\"x\"` stays \"straight\"", `Code <span class="code">"x"</span> stays “straight”`},
+		{"en", `Escaped \" stays`, `Escaped &#34; stays`},
+		{"en-GB", `"Hello," she said.`, `‘Hello,’ she said.`},
+		{"de", `"Hallo", sagte sie, "geht's?"`, `„Hallo“, sagte sie, „geht’s?“`},
+		{"de-CH", `"Grüezi" und 'so'`, `«Grüezi» und ‹so›`},
+		{"fr", `"Bonjour" et l'homme`, `«&#8239;Bonjour&#8239;» et l’homme`},
+	}
+	for _, tt := range tests {
+		got := paragraphs(t, &Converter{SmartQuotes: true}, "$[language]("+tt.lang+")\n", tt.md)
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("%s %s: got %q, want %q", tt.lang, tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestSmartQuotesOff(t *testing.T) {
+	got := paragraphs(t, &Converter{}, "$[language](de)\n$[quotes](de)\n", `"Hallo" and %"explicit"%`)
+	if want := `"Hallo" and „explicit“`; len(got) != 1 || got[0] != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestQuotesOverride(t *testing.T) {
+	for _, front := range []string{"$[quotes](ch)\n", "$[quotes](«,»,‹,›)\n"} {
+		got := paragraphs(t, &Converter{SmartQuotes: true}, "$[language](en)\n"+front, `"a 'b'"`)
+		if want := `«a ‹b›»`; len(got) != 1 || got[0] != want {
+			t.Errorf("%s: got %q, want %q", front, got, want)
+		}
+	}
+}
@@ -0,0 +1,611 @@
+package spell
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// outputFormat holds what differs between EPUB and AZW3 output. The renderer
+// asks it instead of checking the book type.
+type outputFormat interface {
+	// name returns FormatEPUB2, FormatEPUB3 or FormatAZW3.
+	name() string
+	// chapterDocument turns a rendered chapter body into the content handed
+	// to AddXHTML.
+	chapterDocument(title, body string, cssPaths []string) string
+	// href returns the link to id in file, as seen from fromFile.
+	href(file, id, fromFile string) string
+	// chapterHref returns the link to a chapter heading from the TOC.
+	chapterHref(file, label string) string
+	// epubType returns the epub:type attribute for t, including its leading
+	// space, or "" if the format does not use it.
+	epubType(t string) string
+	// element returns the element to write for an HTML5 element like
+	// section, figure or aside, or div if the format does not know it. The
+	// element has a class telling what it is, for the stylesheet.
+	element(tag string) string
+	// pagebreak returns the markup of a forced page break.
+	pagebreak() string
+}
+
+// renderer performs Pass 2: it writes the document tree into the book.
+type renderer struct {
+	*parseContext
+
+	chapter         *chapter // chapter being rendered
+	content         strings.Builder
+	currentNavpoint [7]NavpointAdder
+	currentImageId  int
+	firstparagraph  bool
+	startReadingSet bool
+	plain           bool   // render without ids and links, for titles and labels
+	raw             bool   // do not escape text, for HTML written by the author
+	language        string // first book language
+
+	laquo     string
+	raquo     string
+	lsaquo    string
+	rsaquo    string
+	quotesSet bool // $[quotes] was given, the language does not change them
+
+	typographyOverrides map[string]bool // rules turned on or off by $[typography]
+
+	hyphens          bool             // hyphenate text, set for paragraphs
+	hyphenExceptions map[string][]int // words of $[hyphenation] → break positions
+
+	// Per-chapter footnote state, reset whenever a chapter is finalized.
+	footnoteNum      int            // last number assigned in the current chapter
+	footnoteAssigned map[string]int // footnote id → number in the current chapter
+	pendingFootnotes []pendingNote
+
+	// Endnotes, see endnotesBody.
+	endnotes        []pendingNote // notes of the chapters before the %endnotes chapter
+	endnotesWritten bool          // the %endnotes chapter is rendered, later notes are footnotes
+	inEndnote       bool          // rendering the text of an endnote
+
+	// Highlighted code, see themeCode.
+	highlightTried bool            // addHighlightStylesheet was called
+	highlightCSS   bool            // the stylesheet of the highlight theme was added
+	themedFiles    map[string]bool // chapter files with highlighted code
+}
+
+// newRenderer returns a renderer with the default quote characters: straight
+// ones, or English ones for smart quotes until the language is known.
+func newRenderer(ctx *parseContext) *renderer {
+	r := &renderer{
+		parseContext:        ctx,
+		firstparagraph:      true,
+		laquo:               "\"",
+		raquo:               "\"",
+		lsaquo:              "'",
+		rsaquo:              "'",
+		footnoteAssigned:    map[string]int{},
+		typographyOverrides: map[string]bool{},
+		hyphenExceptions:    map[string][]int{},
+		themedFiles:         map[string]bool{},
+	}
+	if ctx.SmartQuotes {
+		r.setQuotes(quotePresets["en"])
+	}
+	return r
+}
+
+// renderDocument writes all chapters of doc. Before the first chapter only
+// meta and cover lines take effect.
+func (r *renderer) renderDocument(doc *document) {
+	for _, b := range doc.preamble {
+		switch b := b.(type) {
+		case *metaNode:
+			r.applyMeta(b)
+		case *coverNode:
+			r.renderCover(b)
+		}
+	}
+	for _, c := range doc.chapters {
+		r.renderChapter(c)
+	}
+}
+
+// renderChapter writes one chapter: its heading or generated body, the
+// blocks that follow it and the footnotes referenced in it.
+func (r *renderer) renderChapter(c *chapter) {
+	r.chapter = c
+	r.content.Reset()
+	r.firstparagraph = true
+
+	title := r.labelText(c.title)
+	r.currentNavpoint[1] = r.book.AddNavpoint(title, c.file, 10)
+
+	switch c.kind {
+	case chapterText:
+		// The first real chapter marks where body content begins.
+		if !r.startReadingSet {
+			r.book.SetStartReading(c.file)
+			r.startReadingSet = true
+		}
+		fmt.Fprintf(&r.content, "<h1 id=\"%s\">%s</h1>\n", labelFor(1, c.number), r.renderInline(c.title))
+	case chapterTOC:
+		r.content.WriteString(r.tocBody(r.plainInline(c.title)))
+	case chapterIndex:
+		r.content.WriteString(r.indexBody(r.plainInline(c.title)))
+	case chapterEndnotes:
+		r.content.WriteString(r.endnotesBody(r.plainInline(c.title)))
+	case chapterFigures:
+		r.content.WriteString(r.figuresBody(r.plainInline(c.title)))
+	case chapterTables:
+		r.content.WriteString(r.tablesBody(r.plainInline(c.title)))
+	}
+
+	r.renderBlocks(c.blocks)
+	r.appendPendingFootnotes()
+	r.addChapter(title)
+}
+
+// stylesheets returns the stylesheets the chapter file links. A chapter
+// with highlighted code links the highlight theme right after the default
+// stylesheet, so that custom CSS can override it.
+func (r *renderer) stylesheets(file string) []string {
+	if !r.themedFiles[file] || len(r.customCSSPaths) == 0 {
+		return r.customCSSPaths
+	}
+	return append(append(r.customCSSPaths[:1:1], highlightStylesheet), r.customCSSPaths[1:]...)
+}
+
+// addChapter adds the rendered chapter file to the book; title is plain
+// text.
+func (r *renderer) addChapter(title string) {
+	c := r.chapter
+	content := r.format.chapterDocument(escapeText(title), r.content.String(), r.stylesheets(c.file))
+	if _, err := r.book.AddXHTML(c.file, title, content, 10); err != nil {
+		r.errorAt(c.pos, problemWrite, "writing chapter %s: %v", c.file, err)
+		return
+	}
+	switch c.kind {
+	case chapterTOC:
+		r.logMsg(LogDefault, "Add table of contents %q as %s", title, c.file)
+	case chapterIndex:
+		r.logMsg(LogDefault, "Add index %q (%s) as %s", c.indexName, title, c.file)
+	case chapterEndnotes:
+		r.logMsg(LogDefault, "Add %d endnotes %q as %s", len(r.endnotes), title, c.file)
+	case chapterFigures:
+		r.logMsg(LogDefault, "Add list of figures %q as %s", title, c.file)
+	case chapterTables:
+		r.logMsg(LogDefault, "Add list of tables %q as %s", title, c.file)
+	default:
+		r.logMsg(LogDefault, "Add chapter %s as %s", title, c.file)
+	}
+}
+
+func (r *renderer) renderBlocks(blocks []block) {
+	for _, b := range blocks {
+		switch b := b.(type) {
+		case *headingNode:
+			r.renderHeading(b)
+		case *paragraphNode:
+			r.writeParagraph(b, "")
+		case *rawBlockNode:
+			// Block-level HTML written by the author is passed through.
+			r.raw = true
+			r.content.WriteString(r.renderInline(b.content))
+			r.raw = false
+		case *imageLineNode:
+			if img := singleImage(b.content); img != nil && len(img.attrs.classes()) > 0 {
+				fmt.Fprintf(&r.content, "<div class=\"%s\">%s</div>\n", strings.Join(img.attrs.classes(), " "), r.image(img, false))
+			} else {
+				r.content.WriteString("<div>" + r.renderInline(b.content) + "</div>\n")
+			}
+			r.firstparagraph = true
+		case *figureNode:
+			r.renderFigure(b)
+		case *blockquoteNode:
+			fmt.Fprintf(&r.content, "<blockquote class=\"%s\">\n", b.class)
+			for _, p := range b.paragraphs {
+				r.writeParagraph(p, "<br/>")
+			}
+			r.content.WriteString("</blockquote>\n")
+		case *codeBlockNode:
+			r.renderCodeBlock(b)
+		case *listNode:
+			r.renderList(b)
+		case *tableNode:
+			r.renderTable(b)
+		case *dividerNode:
+			r.content.WriteString("<hr/>\n")
+		case *pagebreakNode:
+			r.content.WriteString(r.format.pagebreak())
+		case *metaNode:
+			r.applyMeta(b)
+		case *coverNode:
+			r.renderCover(b)
+		case *footnoteDefNode:
+			// Emitted at the end of the chapter that references it.
+		case *commandNode:
+			r.content.WriteString(r.renderCommand(b.match))
+		}
+	}
+}
+
+// renderHeading writes a subchapter heading and adds its navpoint below
+// the most recent heading one level up.
+func (r *renderer) renderHeading(h *headingNode) {
+	r.firstparagraph = true
+	if parent := r.currentNavpoint[h.level-1]; parent != nil {
+		anchorname := r.chapter.file + "#" + h.label
+		r.currentNavpoint[h.level] = parent.AddNavpoint(r.labelText(h.title), anchorname, 0)
+		r.logMsg(LogVerbose, "Add subchapter %s as %s", inlineText(h.title), anchorname)
+	} else {
+		r.logMsg(LogVerbose, "Subchapter %s outside chapter", inlineText(h.title))
+	}
+	fmt.Fprintf(&r.content, "<h%d id=\"%s\">%s</h%d>\n", h.level, h.label, r.renderInline(h.title), h.level)
+}
+
+// writeParagraph writes the lines of p, each followed by suffix, as one
+// <p>. The first paragraph after a heading or image gets its own class.
+func (r *renderer) writeParagraph(p *paragraphNode, suffix string) {
+	r.hyphens = r.Hyphenate
+	defer func() { r.hyphens = false }()
+	var parts []string
+	for _, line := range p.lines {
+		if s := strings.TrimSpace(r.renderInline(line) + suffix); s != "" {
+			parts = append(parts, s)
+		}
+	}
+	if len(parts) == 0 {
+		return
+	}
+	text := strings.Join(parts, " ")
+	if r.firstparagraph {
+		r.firstparagraph = false
+		r.content.WriteString("<p class=\"firstparagraph\">" + text + "</p>\n")
+	} else {
+		r.content.WriteString("<p>" + text + "</p>\n")
+	}
+}
+
+// renderList writes a list; each sublist is nested inside the item it
+// belongs to, as required for valid HTML.
+func (r *renderer) renderList(l *listNode) {
+	kind := "ul"
+	if l.ordered {
+		kind = "ol"
+	}
+	r.content.WriteString(openListTag(kind, l.start))
+	for _, item := range l.items {
+		r.content.WriteString("  <li>" + r.renderInline(item.content))
+		for _, sub := range item.sublists {
+			r.renderList(sub)
+		}
+		r.content.WriteString("</li>\n")
+	}
+	r.content.WriteString("</" + kind + ">\n")
+}
+
+// openListTag returns the opening tag for a list, adding a start attribute
+// for ordered lists that do not begin at 1 (matching CommonMark).
+func openListTag(kind string, start int) string {
+	if kind == "ol" && start > 1 {
+		return fmt.Sprintf("<ol start=\"%d\">\n", start)
+	}
+	return "<" + kind + ">\n"
+}
+
+// plainInline renders nodes for a title or label: formatting is kept, but
+// nothing that carries an id or a link, so the text can be repeated in
+// navigation and generated chapters.
+func (r *renderer) plainInline(nodes []inline) string {
+	r.plain = true
+	defer func() { r.plain = false }()
+	return strings.TrimSpace(r.renderInline(nodes))
+}
+
+func (r *renderer) renderInline(nodes []inline) string {
+	var b strings.Builder
+	for i, n := range nodes {
+		switch n := n.(type) {
+		case *textNode:
+			text := r.hyphenate(r.typography(r.spacedText(nodes, i)))
+			if r.raw {
+				b.WriteString(text)
+			} else {
+				b.WriteString(escapeText(text))
+			}
+		case *codeSpanNode:
+			b.WriteString(`<span class="code">` + escapeCode(n.text) + "</span>")
+		case *boldNode:
+			b.WriteString("<b>" + r.renderInline(n.children) + "</b>")
+		case *italicNode:
+			b.WriteString("<i>" + r.renderInline(n.children) + "</i>")
+		case *quoteNode:
+			q := r.quoteText(n)
+			if !r.raw && r.typographyRule("guillemet-spacing") {
+				q = spaceGuillemets(q)
+			}
+			b.WriteString(q)
+		case *linkNode:
+			switch {
+			case r.plain:
+				b.WriteString(r.renderInline(n.children))
+			case n.title != "":
+				fmt.Fprintf(&b, `<a href="%s" title="%s">%s</a>`, escapeAttr(n.href), escapeAttr(n.title), r.linkText(n.children))
+			default:
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, escapeAttr(n.href), r.linkText(n.children))
+			}
+		case *anchorLinkNode:
+			if r.plain {
+				b.WriteString(r.renderInline(n.children))
+			} else {
+				href := resolveAnchorHref(r.parseContext, n.id, r.currentFile(), n.pos)
+				fmt.Fprintf(&b, `<a href="%s">%s</a>`, href, r.linkText(n.children))
+			}
+		case *anchorDefNode:
+			if !r.plain {
+				fmt.Fprintf(&b, `<span id="%s"></span>`, n.id)
+			}
+		case *indexTermNode:
+			if r.plain || n.id == "" {
+				b.WriteString(r.renderInline(n.children))
+			} else {
+				fmt.Fprintf(&b, `<span id="%s" class="index-entry"%s>%s</span>`, n.id, r.format.epubType("index-term"), r.renderInline(n.children))
+			}
+		case *footnoteRefNode:
+			if !r.plain {
+				b.WriteString(r.footnoteRef(n))
+			}
+		case *figureRefNode:
+			b.WriteString(r.figureRef(n))
+		case *commandNode:
+			b.WriteString(r.renderCommand(n.match))
+		case *imageNode:
+			if r.plain {
+				b.WriteString(escapeText(n.alt))
+			} else {
+				b.WriteString(r.image(n, true))
+			}
+		}
+	}
+	return b.String()
+}
+
+// Numeric character references, not named HTML entities: an EPUB3 XHTML document
+// is parsed as XML, where only &lt; &gt; &amp; &quot; &apos; are predefined, so
+// &nbsp; and friends are undeclared-entity errors under epubcheck.
+func typography(s string) string {
+	s = reLongDash.ReplaceAllString(s, "&#160;&#8212;&#160;")
+	s = reMidDash.ReplaceAllString(s, "&#160;&#8211;&#160;")
+	return reThreeDots.ReplaceAllString(s, "&#8230;")
+}
+
+// quote returns the configured quote character for a quote marker.
+func (r *renderer) quote(marker string) string {
+	switch marker {
+	case `%"`:
+		return r.laquo
+	case `"%`:
+		return r.raquo
+	case `%'`:
+		return r.lsaquo
+	case `'%`:
+		return r.rsaquo
+	case "'":
+		return apostrophe
+	}
+	return marker
+}
+
+// image adds the image file to the book and returns its <img> tag, or the
+// markdown source if the file cannot be included. An image in running text
+// carries its id and placement classes itself; an image on a line of its
+// own leaves them to its container.
+func (r *renderer) image(n *imageNode, inText bool) string {
+	r.currentImageId++
+	currentImage := fmt.Sprintf("img/image_%05d%s", r.currentImageId, filepath.Ext(n.src))
+	imageID, err := r.addImageFile(r.book, r.joinPath(r.baseDir, n.src), currentImage)
+	if err != nil {
+		r.errorAt(n.pos, problemAsset, "including image %s with URI %s: %v", n.source, r.joinPath(r.baseDir, n.src), err)
+		return escapeText(n.source)
+	}
+	r.logMsg(LogVerbose, "Including image %s: %s", imageID, currentImage)
+	imgSrc := "../" + currentImage
+	if strings.Contains(imageID, "kindle:") {
+		imgSrc = imageID
+	}
+	var attrs, classes []string
+	if n.attrs.icon {
+		classes = append(classes, "img-icon")
+	}
+	if inText {
+		if n.id != "" {
+			attrs = append(attrs, fmt.Sprintf(`id="%s"`, n.id))
+		}
+		classes = append(classes, n.attrs.classes()...)
+	}
+	attrs = append(attrs, fmt.Sprintf(`title="%s" alt="%s" src="%s"`, escapeAttr(n.title), escapeAttr(n.alt), imgSrc))
+	if len(classes) > 0 {
+		attrs = append(attrs, fmt.Sprintf(`class="%s"`, strings.Join(classes, " ")))
+	}
+	return "<img " + strings.Join(attrs, " ") + "/>"
+}
+
+// classes returns the classes of the default stylesheet that place an image
+// as its attributes ask: the width rounded to the nearest step of 5%, the
+// alignment or float and a page of its own. Style attributes would be
+// dropped by KF8.
+func (a imageAttrs) classes() []string {
+	var classes []string
+	if a.width > 0 {
+		classes = append(classes, "img-sized", fmt.Sprintf("img-w%d", max(5, (a.width+2)/5*5)))
+	}
+	if a.align != "" {
+		classes = append(classes, "img-"+a.align)
+	}
+	if a.float != "" {
+		classes = append(classes, "img-float-"+a.float)
+	}
+	if a.fullPage {
+		classes = append(classes, "img-page")
+	}
+	return classes
+}
+
+// singleImage returns the image of a line that holds only one image, or
+// nil.
+func singleImage(nodes []inline) *imageNode {
+	var img *imageNode
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *imageNode:
+			if img != nil {
+				return nil
+			}
+			img = n
+		case *textNode:
+			if strings.TrimSpace(n.text) != "" {
+				return nil
+			}
+		default:
+			return nil
+		}
+	}
+	return img
+}
+
+// applyMeta sets the book metadata of a $[key](value) line.
+func (r *renderer) applyMeta(m *metaNode) {
+	switch m.key {
+	case "title":
+		r.book.SetTitle(m.value)
+	case "author", "contributor":
+		r.addPerson(m)
+	case "series":
+		if err := r.book.SetSeries(m.value); err != nil {
+			r.errorAt(m.pos, problemParse, "cannot set series to %s: %v", m.value, err)
+		}
+	case "set":
+		if err := r.book.SetSet(m.value); err != nil {
+			r.errorAt(m.pos, problemParse, "cannot set set to %s: %v", m.value, err)
+		}
+	case "entry":
+		if err := r.book.SetEntryNumber(m.value); err != nil {
+			r.errorAt(m.pos, problemParse, "cannot set entry number to %s: %v", m.value, err)
+		}
+	case "uuid":
+		if err := r.book.SetUUID(m.value); err != nil {
+			r.errorAt(m.pos, problemParse, "cannot set UUID to %s: %v", m.value, err)
+		}
+	case "language":
+		if err := r.book.AddLanguage(m.value); err != nil {
+			r.errorAt(m.pos, problemParse, "cannot add language %s: %v", m.value, err)
+		}
+		if r.language == "" {
+			r.language = m.value
+			if r.Hyphenate && lookupHyphenator(m.value) == nil {
+				r.warnAt(m.pos, "no hyphenation patterns for language %s, text is not hyphenated", m.value)
+			}
+			if q, ok := lookupQuotes(m.value); ok && r.SmartQuotes && !r.quotesSet {
+				r.setQuotes(q)
+			}
+		}
+	case "date":
+		r.book.AddDate(m.value)
+	case "rights":
+		r.book.AddRights(m.value)
+	case "source":
+		r.book.AddSource(m.value)
+	case "relation":
+		r.book.AddRelation(m.value)
+	case "type":
+		r.book.AddType(m.value)
+	case "isbn":
+		isbn, err := normalizeISBN(m.value)
+		if err == nil {
+			err = r.book.SetISBN(isbn)
+		}
+		if err != nil {
+			r.errorAt(m.pos, problemParse, "cannot set ISBN to %s: %v", m.value, err)
+		}
+	case "publisher":
+		r.book.SetPublisher(m.value)
+	case "description":
+		r.book.SetDescription(m.value)
+	case "subject":
+		r.book.AddSubject(m.value)
+	case "title-sort":
+		r.book.SetTitleSort(m.value)
+	case "author-sort":
+		r.book.SetAuthorSort(m.value)
+	case "hyphenation":
+		r.addHyphenExceptions(m)
+	case "typography":
+		r.setTypography(m)
+	case "quotes":
+		r.quotesSet = true
+		if q, ok := lookupQuotes(m.value); ok {
+			r.setQuotes(q)
+			break
+		}
+		quotes := strings.Split(m.value, ",")
+		if len(quotes) != 4 {
+			r.errorAt(m.pos, problemParse, "quotes definition has to have 4 values seperated by a comma %s %v", m.value, quotes)
+		} else {
+			r.laquo = escapeText(quotes[0])
+			r.raquo = escapeText(quotes[1])
+			r.lsaquo = escapeText(quotes[2])
+			r.rsaquo = escapeText(quotes[3])
+		}
+	}
+}
+
+func (r *renderer) renderCover(c *coverNode) {
+	if err := r.addCover(c.src, r.GenerateCover); err != nil {
+		r.errorAt(c.pos, problemAsset, "including cover image %s with URI %s: %v", c.src, r.joinPath(r.baseDir, c.src), err)
+	}
+}
+
+func (r *renderer) addCover(imageFile string, addCoverPage bool) error {
+	currentImage := fmt.Sprintf("img/cover%s", filepath.Ext(imageFile))
+	imageID, err := r.addImageFile(r.book, r.joinPath(r.baseDir, imageFile), currentImage)
+	if err != nil {
+		return err
+	}
+	r.book.SetCoverImage(imageID)
+	r.logMsg(LogVerbose, "Added cover image %s: %s", imageID, currentImage)
+
+	if addCoverPage {
+		isAZW3 := strings.Contains(imageID, "kindle:")
+		imgSrc := "../" + currentImage
+		if isAZW3 {
+			imgSrc = imageID
+		}
+		var htmlContent string
+		if isAZW3 {
+			htmlContent = `<div style="text-align:center;padding:0;margin:0;"><img src="` + imgSrc + `" style="max-width:100%;"/></div>`
+		} else {
+			htmlContent = `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE xhtml>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+    <head>
+        <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+        <title>Cover</title>
+		<style type="text/css">
+            @page {padding: 0pt; margin:0pt}
+            body { text-align: center; padding:0pt; margin: 0pt; }
+        </style>
+    </head>
+    <body>
+		<div>
+            <svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" version="1.1" width="100%" height="100%" viewBox="0 0 1240 1752" preserveAspectRatio="none">
+                <image width="1240" height="1752" xlink:href="` + imgSrc + `"/>
+            </svg>
+        </div>
+	</body>
+</html>`
+		}
+		_, err = r.book.AddXHTML("xhtml/cover.xhtml", "Cover", htmlContent, 1)
+		if err != nil {
+			return err
+		}
+		r.logMsg(LogVerbose, "Add cover file cover.xhtml")
+	}
+	return nil
+}
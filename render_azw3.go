@@ -0,0 +1,34 @@
+package spell
+
+// azw3Format renders chapters as plain HTML fragments: mobi chunks must not
+// be full documents, and CSS is applied globally via AddStylesheet. All
+// chapters form one concatenated document, so every link is a plain #id.
+type azw3Format struct{}
+
+func (azw3Format) name() string {
+	return FormatAZW3
+}
+
+func (azw3Format) chapterDocument(_, body string, _ []string) string {
+	return body
+}
+
+func (azw3Format) href(_, id, _ string) string {
+	return "#" + id
+}
+
+func (azw3Format) chapterHref(_, label string) string {
+	return "#" + label
+}
+
+func (azw3Format) epubType(string) string {
+	return ""
+}
+
+func (azw3Format) element(tag string) string {
+	return tag
+}
+
+func (azw3Format) pagebreak() string {
+	return "<MBP:PAGEBREAK/>\n"
+}
@@ -0,0 +1,117 @@
+package spell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// renderCodeBlock writes a code block as <pre><code>, with the tokens of a
+// known language in classed spans for the highlight theme. Line numbers and
+// emphasized lines get spans of their own; a title is written above.
+func (r *renderer) renderCodeBlock(b *codeBlockNode) {
+	expanded := make([]string, len(b.lines))
+	for i, line := range b.lines {
+		expanded[i] = expandTabs(line, b.tabWidth)
+	}
+	src := strings.Join(expanded, "\n")
+	tokens := []token{{text: src}}
+	if lang := lookupLanguage(b.lang); lang != nil {
+		tokens = lang.tokenize(src)
+	}
+	lines := highlightLines(tokens)
+	if b.themed() {
+		r.themeCode()
+	}
+
+	if b.title != "" {
+		fmt.Fprintf(&r.content, "<div class=\"code-title\">%s</div>\n", escapeText(b.title))
+	}
+	class := "code"
+	if b.lang != "" {
+		class += " lang-" + b.lang
+	}
+	if b.wrap {
+		class += " wrap"
+	}
+	fmt.Fprintf(&r.content, `<pre class="%s"><code>`, escapeAttr(class))
+	width := len(strconv.Itoa(b.start + len(lines) - 1))
+	for i, line := range lines {
+		if i > 0 {
+			r.content.WriteString("\n")
+		}
+		n := b.start + i
+		if b.lineNumbers {
+			fmt.Fprintf(&r.content, `<span class="ln">%*d </span>`, width, n)
+		}
+		if b.highlighted(n) {
+			line = `<span class="hll">` + line + "</span>"
+		}
+		r.content.WriteString(line)
+	}
+	r.content.WriteString("</code></pre>\n")
+	r.firstparagraph = false // the code opens the section, like a paragraph
+}
+
+// themed reports whether the block needs the highlight theme: it has the
+// tokens of a known language or emphasized lines.
+func (b *codeBlockNode) themed() bool {
+	return lookupLanguage(b.lang) != nil || len(b.highlight) > 0
+}
+
+// themeCode notes that the file being rendered has highlighted code, so
+// that it links the stylesheet of the highlight theme. The stylesheet is
+// added with the first such code.
+func (r *renderer) themeCode() {
+	if !r.highlightTried {
+		r.highlightCSS = addHighlightStylesheet(r.parseContext)
+		r.highlightTried = true
+	}
+	if r.highlightCSS {
+		r.themedFiles[r.currentFile()] = true
+	}
+}
+
+// expandTabs replaces the tabs in line by spaces up to the next multiple of
+// width columns.
+func expandTabs(line string, width int) string {
+	if !strings.Contains(line, "\t") {
+		return line
+	}
+	var b strings.Builder
+	col := 0
+	for _, c := range line {
+		if c == '\t' {
+			n := width - col%width
+			b.WriteString(strings.Repeat(" ", n))
+			col += n
+			continue
+		}
+		b.WriteRune(c)
+		col++
+	}
+	return b.String()
+}
+
+// highlightLines returns the escaped markup of tokens, line by line. Spans
+// are closed at the end of a line and reopened on the next, so that every
+// line stands on its own.
+func highlightLines(tokens []token) []string {
+	lines := []string{""}
+	for _, t := range tokens {
+		for i, segment := range strings.Split(t.text, "\n") {
+			if i > 0 {
+				lines = append(lines, "")
+			}
+			if segment == "" {
+				continue
+			}
+			segment = escapeCode(segment)
+			if t.class != "" {
+				segment = `<span class="` + t.class + `">` + segment + "</span>"
+			}
+			lines[len(lines)-1] += segment
+		}
+	}
+	return lines
+}
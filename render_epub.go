@@ -0,0 +1,65 @@
+package spell
+
+// epubFormat renders every chapter as a complete XHTML document linking the
+// book's stylesheets. Links between chapters name the target file.
+type epubFormat struct {
+	epub2 bool
+}
+
+func (f epubFormat) name() string {
+	if f.epub2 {
+		return FormatEPUB2
+	}
+	return FormatEPUB3
+}
+
+func (epubFormat) chapterDocument(title, body string, cssPaths []string) string {
+	var customCSSLinks string
+	for _, p := range cssPaths {
+		customCSSLinks += "\n\t\t<link rel=\"stylesheet\" href=\"../" + escapeAttr(p) + "\"/>"
+	}
+	return `<?xml version="1.0" encoding="utf-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+    <head>
+        <meta http-equiv="Content-Type" content="text/html; charset=UTF-8"/>
+        <title>` + title + `</title>` + customCSSLinks + `
+    </head>
+    <body>
+	` + body + `
+	</body>
+</html>`
+}
+
+func (epubFormat) href(file, id, fromFile string) string {
+	if file == fromFile {
+		return "#" + id
+	}
+	return "../" + file + "#" + id
+}
+
+func (epubFormat) chapterHref(file, _ string) string {
+	return "../" + file
+}
+
+// epubType returns "" for EPUB 2, whose XHTML 1.1 has no epub:type.
+func (f epubFormat) epubType(t string) string {
+	if f.epub2 {
+		return ""
+	}
+	return ` epub:type="` + t + `"`
+}
+
+// element returns div for the HTML5 elements in EPUB 2.
+func (f epubFormat) element(tag string) string {
+	if f.epub2 {
+		return "div"
+	}
+	return tag
+}
+
+// pagebreak is a styled element: the MBP namespace of the Mobipocket page
+// break is not declared in an XHTML document.
+func (epubFormat) pagebreak() string {
+	return "<div class=\"pagebreak\"></div>\n"
+}
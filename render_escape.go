@@ -0,0 +1,81 @@
+package spell
+
+import (
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Escaping happens when text is written, so the tree always holds the text
+// as the author wrote it. Every chapter document is XML: outside the markup
+// spell generates itself, <, > and & must be escaped, and only numeric
+// character references and the five predefined XML entities may be used.
+
+// reEntity matches a character reference at the start of a string.
+var reEntity = regexp.MustCompile(`^&(?:#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+
+// xmlEntities are the named entities XML knows without a DTD.
+var xmlEntities = map[string]bool{"&amp;": true, "&lt;": true, "&gt;": true, "&quot;": true, "&apos;": true}
+
+// escapeText escapes running text. Numeric character references, which
+// also come from resolved backslash escapes and typography, and the XML
+// entities are kept; other HTML entities like &raquo; become numeric
+// references; any other & is escaped.
+func escapeText(s string) string {
+	if !strings.ContainsAny(s, "<>&") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '<':
+			b.WriteString("&lt;")
+		case '>':
+			b.WriteString("&gt;")
+		case '&':
+			ref := reEntity.FindString(s[i:])
+			switch {
+			case ref == "":
+				b.WriteString("&amp;")
+				continue
+			case ref[1] == '#' || xmlEntities[ref]:
+				b.WriteString(ref)
+			default:
+				decoded := html.UnescapeString(ref)
+				if decoded == ref {
+					b.WriteString("&amp;")
+					continue
+				}
+				for _, r := range decoded {
+					b.WriteString("&#" + strconv.Itoa(int(r)) + ";")
+				}
+			}
+			i += len(ref) - 1
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// escapeAttr escapes an attribute value written in double quotes.
+func escapeAttr(s string) string {
+	return strings.ReplaceAll(escapeText(s), `"`, "&quot;")
+}
+
+// codeEscaper escapes code, where every character is meant literally.
+var codeEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+func escapeCode(s string) string {
+	return codeEscaper.Replace(s)
+}
+
+// reTag matches a tag of the markup spell generates.
+var reTag = regexp.MustCompile(`<[^>]*>`)
+
+// labelText renders nodes as plain text without markup or references, for
+// the book's navigation and chapter titles. The book writers escape it.
+func (r *renderer) labelText(nodes []inline) string {
+	return html.UnescapeString(reTag.ReplaceAllString(r.plainInline(nodes), ""))
+}
@@ -0,0 +1,78 @@
+package spell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// figureLabels are the words figure numbers are set with, by language.
+var figureLabels = map[string]string{
+	"en": "Figure",
+	"de": "Abbildung",
+	"fr": "Figure",
+	"es": "Figura",
+	"it": "Figura",
+	"pt": "Figura",
+	"nl": "Figuur",
+	"da": "Figur",
+	"sv": "Figur",
+	"no": "Figur",
+	"nb": "Figur",
+	"fi": "Kuva",
+	"pl": "Rysunek",
+	"cs": "Obrázek",
+	"ru": "Рисунок",
+}
+
+// figureLabel returns the label of the figure number, like Figure 3.2, in
+// the book language.
+func (r *renderer) figureLabel(number string) string {
+	primary, _, _ := strings.Cut(strings.ToLower(r.language), "-")
+	label, ok := figureLabels[primary]
+	if !ok {
+		label = figureLabels["en"]
+	}
+	return label + noBreakSpace + number
+}
+
+// renderFigure writes a figure: the image, and below it the figure number
+// and the caption. EPUB 2 gets divs of the classes figure and figcaption.
+func (r *renderer) renderFigure(f *figureNode) {
+	var caption []string
+	if f.number != "" {
+		caption = append(caption, `<span class="figure-number">`+r.figureLabel(f.number)+`</span>`)
+	}
+	if f.caption != nil {
+		caption = append(caption, r.renderInline(f.caption))
+	}
+	class := strings.Join(append([]string{"figure"}, f.image.attrs.classes()...), " ")
+	figure, figcaption := r.format.element("figure"), r.format.element("figcaption")
+	fmt.Fprintf(&r.content, "<%s id=\"%s\" class=\"%s\">\n%s\n", figure, f.id, class, r.image(f.image, false))
+	if len(caption) > 0 {
+		fmt.Fprintf(&r.content, "<%s class=\"figcaption\">%s</%s>\n", figcaption, strings.Join(caption, " "), figcaption)
+	}
+	r.content.WriteString("</" + figure + ">\n")
+	r.firstparagraph = true
+}
+
+// figureRef renders [@fig:id] as the label of the figure, linked to it
+// like an anchor.
+func (r *renderer) figureRef(n *figureRefNode) string {
+	var f *figureNode
+	for _, e := range r.figures {
+		if e.figure.id == n.id {
+			f = e.figure
+			break
+		}
+	}
+	if f == nil || f.number == "" {
+		r.warnAt(n.pos, "figure %q not found", n.id)
+		return "[@fig:" + n.id + "]"
+	}
+	label := r.figureLabel(f.number)
+	if r.plain {
+		return label
+	}
+	href := resolveAnchorHref(r.parseContext, n.id, r.currentFile(), n.pos)
+	return fmt.Sprintf(`<a href="%s" class="figure-ref">%s</a>`, href, label)
+}
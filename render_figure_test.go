@@ -0,0 +1,40 @@
+package spell
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFigureMarkup(t *testing.T) {
+	md := "# One\n\n![The lantern](lantern.jpg \"The first lantern\"){#lantern}\n\nAs [@fig:lantern] shows.\n"
+	tests := []struct {
+		name   string
+		format outputFormat
+		want   []string
+	}{
+		{"EPUB 3", epubFormat{}, []string{
+			`<figure id="lantern" class="figure">`,
+			`<figcaption class="figcaption"><span class="figure-number">Figure&#160;1.1</span> The first lantern</figcaption>`,
+			"</figure>",
+			`<a href="#lantern" class="figure-ref">Figure&#160;1.1</a>`,
+		}},
+		{"EPUB 2", epubFormat{epub2: true}, []string{
+			`<div id="lantern" class="figure">`,
+			`<div class="figcaption"><span class="figure-number">Figure&#160;1.1</span> The first lantern</div>`,
+			"</div>\n",
+		}},
+		{"AZW3", azw3Format{}, []string{`<figure id="lantern" class="figure">`, `<figcaption class="figcaption">`}},
+	}
+	for _, tt := range tests {
+		c := convertAs(t, tt.format, md)
+		body := c.book.body()
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: missing %s in\n%s", tt.name, want, body)
+			}
+		}
+		if tt.format.name() == FormatEPUB2 && strings.Contains(body, "<fig") {
+			t.Errorf("%s: HTML5 figure in\n%s", tt.name, body)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package spell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// footnoteRef renders an inline footnote reference [^id] as an EPUB3/KF8
+// note reference. The referenced note is numbered per chapter and queued for
+// emission at the end of the chapter. The href="#fn-…" target is resolved to
+// a same-file fragment (EPUB) or a kindle:pos:fid link (AZW3, via the mobi
+// layer), which drives popup footnotes on supporting readers. Before an
+// %endnotes chapter the target is the note in that chapter instead, and with
+// continuous numbering the numbers go on from chapter to chapter.
+func (r *renderer) footnoteRef(n *footnoteRefNode) string {
+	if _, ok := r.footnoteDefs[n.id]; !ok {
+		r.warnAt(n.pos, "footnote %q referenced but not defined", n.id)
+		return "[^" + n.id + "]"
+	}
+	c := r.chapter.number
+	num, seen := r.footnoteAssigned[n.id]
+	if !seen {
+		r.footnoteNum++
+		num = r.footnoteNum
+		r.footnoteAssigned[n.id] = num
+	}
+	href := fmt.Sprintf("#fn-%d-%d", c, num)
+	if r.collectingEndnotes() {
+		href = r.format.href(r.endnotesChapter.file, fmt.Sprintf("fn-%d-%d", c, num), r.currentFile())
+	}
+	if seen {
+		// A repeat reference must not duplicate the fnref id; the
+		// back-link points at the first reference only.
+		return fmt.Sprintf(`<a%s href="%s"><sup>%d</sup></a>`, r.noteType("noteref"), href, num)
+	}
+	r.pendingFootnotes = append(r.pendingFootnotes, pendingNote{
+		chap: c,
+		num:  num,
+		id:   n.id,
+		file: r.currentFile(),
+	})
+	return fmt.Sprintf(`<a%s href="%s" id="fnref-%d-%d"><sup>%d</sup></a>`,
+		r.noteType("noteref"), href, c, num, num)
+}
+
+// collectingEndnotes reports whether the notes of the current chapter go to
+// the %endnotes chapter, which is the case for the chapters before it.
+func (r *renderer) collectingEndnotes() bool {
+	return r.endnotesChapter != nil && !r.endnotesWritten && r.chapter != r.endnotesChapter
+}
+
+// currentFile returns the file the text being rendered lands in: the
+// %endnotes chapter for the text of an endnote, else the current chapter.
+func (r *renderer) currentFile() string {
+	if r.inEndnote {
+		return r.endnotesChapter.file
+	}
+	return r.chapter.file
+}
+
+// appendPendingFootnotes writes the footnotes referenced in the current
+// chapter as footnote asides and resets the per-chapter
+// footnote state. It is called when all blocks of a chapter are rendered, so
+// the notes land at the end of that chapter, or in the %endnotes chapter.
+func (r *renderer) appendPendingFootnotes() {
+	if r.collectingEndnotes() {
+		r.collectEndnotes()
+		return
+	}
+	defer func() {
+		r.pendingFootnotes = nil
+		r.footnoteNum = 0
+		r.footnoteAssigned = map[string]int{}
+	}()
+	if len(r.pendingFootnotes) == 0 {
+		return
+	}
+
+	section, aside := r.format.element("section"), r.format.element("aside")
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("<%s%s class=\"footnotes\">\n", section, r.noteType("footnotes")))
+	// A note may itself reference further notes, which are appended while
+	// the list is being written.
+	for i := 0; i < len(r.pendingFootnotes); i++ {
+		n := r.pendingFootnotes[i]
+		text := r.noteText(n, fmt.Sprintf("#fnref-%d-%d", n.chap, n.num))
+		b.WriteString(fmt.Sprintf("<%s%s class=\"footnote\" id=\"fn-%d-%d\">%s</%s>\n",
+			aside, r.noteType("footnote"), n.chap, n.num, text, aside))
+	}
+	b.WriteString("</" + section + ">\n")
+	r.content.WriteString(b.String())
+}
+
+// collectEndnotes renders the notes referenced in the current chapter for
+// the %endnotes chapter. Their text is rendered now, while the chapter is
+// current, but links in it are resolved from the %endnotes chapter.
+func (r *renderer) collectEndnotes() {
+	r.inEndnote = true
+	for i := 0; i < len(r.pendingFootnotes); i++ {
+		n := r.pendingFootnotes[i]
+		n.chapter = r.chapter
+		n.text = r.noteText(n, r.format.href(n.file, fmt.Sprintf("fnref-%d-%d", n.chap, n.num), r.endnotesChapter.file))
+		r.endnotes = append(r.endnotes, n)
+	}
+	r.inEndnote = false
+
+	r.pendingFootnotes = nil
+	r.footnoteAssigned = map[string]int{}
+	if r.endnotesChapter.numbering != "continuous" {
+		r.footnoteNum = 0
+	}
+}
+
+// endnotesBody renders %endnotes or %endnotes(Title): the notes of the
+// chapters before it, grouped under the title of their chapter, each with a
+// link back to its reference. Notes of later chapters stay footnotes.
+func (r *renderer) endnotesBody(title string) string {
+	section, aside := r.format.element("section"), r.format.element("aside")
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("<%s%s class=\"endnotes\">\n<h1 id=\"%s\">%s</h1>\n",
+		section, r.noteType("endnotes"), labelFor(1, r.chapter.number), title))
+	var group *chapter
+	for _, n := range r.endnotes {
+		if n.chapter != group {
+			group = n.chapter
+			b.WriteString(fmt.Sprintf("<h2 class=\"endnotes-chapter\"><a href=\"%s\">%s</a></h2>\n",
+				r.format.chapterHref(group.file, labelFor(1, group.number)), r.plainInline(group.title)))
+		}
+		b.WriteString(fmt.Sprintf("<%s%s class=\"endnote\" id=\"fn-%d-%d\">%s</%s>\n",
+			aside, r.noteType("endnote"), n.chap, n.num, n.text, aside))
+	}
+	b.WriteString("</" + section + ">\n")
+	r.endnotesWritten = true
+	return b.String()
+}
+
+// noteText renders the blocks of the note n: the number goes in front of
+// its first paragraph and the link back to backHref after its last one,
+// each in a paragraph of its own if the note starts or ends with another
+// block.
+func (r *renderer) noteText(n pendingNote, backHref string) string {
+	saved, firstparagraph := r.content, r.firstparagraph
+	r.content, r.firstparagraph = strings.Builder{}, false
+	r.renderBlocks(r.footnoteDefs[n.id].blocks)
+	text := strings.TrimSuffix(r.content.String(), "\n")
+	r.content, r.firstparagraph = saved, firstparagraph
+
+	number := fmt.Sprintf("<sup>%d</sup>", n.num)
+	back := fmt.Sprintf("<a href=\"%s\">&#8617;</a>", backHref)
+	switch {
+	case text == "":
+		return "<p>" + number + " " + back + "</p>"
+	case strings.HasPrefix(text, "<p>"):
+		text = "<p>" + number + " " + strings.TrimPrefix(text, "<p>")
+	default:
+		text = "<p>" + number + "</p>\n" + text
+	}
+	if strings.HasSuffix(text, "</p>") {
+		return strings.TrimSuffix(text, "</p>") + " " + back + "</p>"
+	}
+	return text + "\n<p>" + back + "</p>"
+}
+
+// noteType returns the epub:type attribute of a note reference or note.
+// Kindle readers use it for pop-up footnotes, so AZW3 keeps it; only EPUB 2
+// drops it.
+func (r *renderer) noteType(t string) string {
+	if _, ok := r.format.(azw3Format); ok {
+		return ` epub:type="` + t + `"`
+	}
+	return r.format.epubType(t)
+}
@@ -0,0 +1,55 @@
+package spell
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFootnoteMarkup(t *testing.T) {
+	md := "# One\n\nA claim.[^a]\n\n[^a]: The source.\n"
+	tests := []struct {
+		name   string
+		format outputFormat
+		want   []string
+	}{
+		{"EPUB 3", epubFormat{}, []string{
+			`<a epub:type="noteref" href="#fn-1-1" id="fnref-1-1"><sup>1</sup></a>`,
+			`<section epub:type="footnotes" class="footnotes">`,
+			`<aside epub:type="footnote" class="footnote" id="fn-1-1">`,
+		}},
+		{"EPUB 2", epubFormat{epub2: true}, []string{
+			`<a href="#fn-1-1" id="fnref-1-1"><sup>1</sup></a>`,
+			`<div class="footnotes">`,
+			`<div class="footnote" id="fn-1-1">`,
+		}},
+		{"AZW3", azw3Format{}, []string{
+			`<a epub:type="noteref" href="#fn-1-1" id="fnref-1-1"><sup>1</sup></a>`,
+			`<aside epub:type="footnote" class="footnote" id="fn-1-1">`,
+		}},
+	}
+	for _, tt := range tests {
+		c := convertAs(t, tt.format, md)
+		body := c.book.body()
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: missing %s in\n%s", tt.name, want, body)
+			}
+		}
+		if tt.format.name() == FormatEPUB2 && (strings.Contains(body, "epub:type") || strings.Contains(body, "<aside")) {
+			t.Errorf("%s: EPUB 3 markup in\n%s", tt.name, body)
+		}
+	}
+}
+
+func TestEndnotesEPUB2(t *testing.T) {
+	md := "# One\n\nA claim.[^a]\n\n[^a]: The source.\n\n# Notes\n\n%endnotes\n"
+	body := convertAs(t, epubFormat{epub2: true}, md).book.body()
+	for _, want := range []string{`<div class="endnotes">`, `<div class="endnote" id="fn-1-1">`} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "epub:type") || strings.Contains(body, "<section") || strings.Contains(body, "<aside") {
+		t.Errorf("EPUB 3 markup in\n%s", body)
+	}
+}
@@ -0,0 +1,92 @@
+package spell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// tocBody renders %toc or %toc(Title) as a generated table of contents. The
+// optional title makes localization easy, e.g. %toc(Inhaltsverzeichnis). The
+// TOC lists every chapter and subchapter of the whole book (collected in
+// Pass 1), nested by heading level, and works identically for EPUB and AZW3.
+func (r *renderer) tocBody(title string) string {
+	// tocHref returns the link target for an entry: chapters link to their
+	// file, everything else to file#label. In AZW3 all chapters form one
+	// document, so every link is a plain #label anchor (resolved to exact
+	// positions by the KF8 writer).
+	tocHref := func(e tocEntry) string {
+		if e.label == "" {
+			return r.format.chapterHref(e.chapter.file, labelFor(1, e.chapter.number))
+		}
+		return r.format.href(e.chapter.fileName(), e.label, "")
+	}
+
+	section := r.format.element("section")
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("<%s class=\"toc\">\n<h1 id=\"%s\">%s</h1>\n", section, labelFor(1, r.chapter.number), title))
+	body.WriteString("<ol class=\"toc-list\">\n")
+	level := 1
+	openLi := false
+	for _, e := range r.tocEntries {
+		if e.level > level {
+			// Nest deeper inside the currently open list item.
+			for level < e.level {
+				body.WriteString("\n<ol>\n")
+				level++
+			}
+			openLi = false
+		} else {
+			if openLi {
+				body.WriteString("</li>\n")
+			}
+			for level > e.level {
+				body.WriteString("</ol>\n</li>\n")
+				level--
+			}
+		}
+		body.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a>", tocHref(e), r.plainInline(e.title)))
+		openLi = true
+	}
+	if openLi {
+		body.WriteString("</li>\n")
+	}
+	for level > 1 {
+		body.WriteString("</ol>\n</li>\n")
+		level--
+	}
+	body.WriteString("</ol>\n</" + section + ">\n")
+	return body.String()
+}
+
+// figuresBody renders %figures or %figures(Title) as a list of the figures
+// of the whole book (collected in Pass 1), each with its number and caption,
+// linked to the figure.
+func (r *renderer) figuresBody(title string) string {
+	section := r.format.element("section")
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("<%s%s class=\"loi\">\n<h1 id=\"%s\">%s</h1>\n<ul class=\"figure-list\">\n", section, r.format.epubType("loi"), labelFor(1, r.chapter.number), title))
+	for _, e := range r.figures {
+		text := `<span class="figure-number">` + r.figureLabel(e.figure.number) + `</span>`
+		if e.figure.caption != nil {
+			text += " " + r.plainInline(e.figure.caption)
+		}
+		href := r.format.href(e.chapter.fileName(), e.figure.id, r.chapter.file)
+		body.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a></li>\n", href, text))
+	}
+	body.WriteString("</ul>\n</" + section + ">\n")
+	return body.String()
+}
+
+// tablesBody renders %tables or %tables(Title) as a list of the captions of
+// all tables that have one, linked to the table.
+func (r *renderer) tablesBody(title string) string {
+	section := r.format.element("section")
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("<%s%s class=\"lot\">\n<h1 id=\"%s\">%s</h1>\n<ul class=\"table-list\">\n", section, r.format.epubType("lot"), labelFor(1, r.chapter.number), title))
+	for _, e := range r.tables {
+		href := r.format.href(e.chapter.fileName(), e.table.id, r.chapter.file)
+		body.WriteString(fmt.Sprintf("<li><a href=\"%s\">%s</a></li>\n", href, r.plainInline(e.table.caption)))
+	}
+	body.WriteString("</ul>\n</" + section + ">\n")
+	return body.String()
+}
@@ -0,0 +1,38 @@
+package spell
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGeneratedChapters(t *testing.T) {
+	md := "%toc(Contents)\n\n# One\n\n![Lamp](lamp.jpg \"A lamp\")\n\nTable: Prices\n| a |\n|---|\n| 1 |\n\n" +
+		"%figures(Illustrations)\n\n%tables(Tables)\n"
+	tests := []struct {
+		name   string
+		format outputFormat
+		want   []string
+	}{
+		{"EPUB 3", epubFormat{}, []string{
+			`<section class="toc">`,
+			`<section epub:type="loi" class="loi">`,
+			`<section epub:type="lot" class="lot">`,
+			`<a href="../xhtml/chapter_00002.xhtml#figure-1"><span class="figure-number">Figure&#160;1.1</span> A lamp</a>`,
+			`<a href="../xhtml/chapter_00002.xhtml#table-1">Prices</a>`,
+		}},
+		{"EPUB 2", epubFormat{epub2: true}, []string{`<div class="toc">`, `<div class="loi">`, `<div class="lot">`}},
+		{"AZW3", azw3Format{}, []string{`<section class="toc">`, `<section class="loi">`, `<section class="lot">`, `<a href="#table-1">Prices</a>`}},
+	}
+	for _, tt := range tests {
+		c := convertAs(t, tt.format, md)
+		body := c.book.body()
+		for _, want := range tt.want {
+			if !strings.Contains(body, want) {
+				t.Errorf("%s: missing %s in\n%s", tt.name, want, body)
+			}
+		}
+		if tt.format.name() == FormatEPUB2 && (strings.Contains(body, "<section") || strings.Contains(body, "epub:type")) {
+			t.Errorf("%s: HTML5 sections or epub:type in\n%s", tt.name, body)
+		}
+	}
+}
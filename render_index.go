@@ -0,0 +1,229 @@
+package spell
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexTerm is one entry of a generated index: a canonical term or, below
+// it, a sub-term, with its occurrences and cross-references.
+type indexTerm struct {
+	name     string
+	key      string // collation key of name
+	id       string // anchor of the entry, the target of cross-references
+	entries  []indexEntry
+	see      []indexEntry // cross-references to the preferred term
+	seeAlso  []indexEntry // cross-references to related terms
+	children []*indexTerm
+	byName   map[string]*indexTerm
+}
+
+// child returns the sub-term name of t, adding it if needed.
+func (t *indexTerm) child(name string, coll *collator) *indexTerm {
+	if c, ok := t.byName[name]; ok {
+		return c
+	}
+	c := &indexTerm{name: name, key: coll.key(name), byName: map[string]*indexTerm{}}
+	t.byName[name] = c
+	t.children = append(t.children, c)
+	return c
+}
+
+// sort orders the sub-terms of t by collation and numbers their anchors.
+func (t *indexTerm) sort(prefix string, next *int) {
+	sort.SliceStable(t.children, func(i, j int) bool {
+		if t.children[i].key != t.children[j].key {
+			return t.children[i].key < t.children[j].key
+		}
+		return t.children[i].name < t.children[j].name
+	})
+	for _, c := range t.children {
+		*next++
+		c.id = prefix + strconv.Itoa(*next)
+		c.sort(prefix, next)
+	}
+}
+
+// indexPath splits a canonical term like "lantern > oil" into its levels.
+func indexPath(canonical string) []string {
+	var path []string
+	for _, name := range strings.Split(canonical, ">") {
+		if name = strings.TrimSpace(name); name != "" {
+			path = append(path, name)
+		}
+	}
+	return path
+}
+
+// xrefLabels are the words that introduce see and see also references.
+var xrefLabels = map[string][2]string{
+	"en": {"see", "see also"},
+	"de": {"siehe", "siehe auch"},
+	"fr": {"voir", "voir aussi"},
+	"es": {"véase", "véase también"},
+	"it": {"vedi", "vedi anche"},
+	"nl": {"zie", "zie ook"},
+}
+
+// indexBody renders %index[name] or %index[name](Title) as a back-of-book
+// index. Entries are grouped by their canonical term and its sub-terms, and
+// the terms of every level sorted by the collation of the book language.
+// The top level is set under letter group headings that an optional jump
+// bar links to. Each term is followed by links to its occurrences, labelled
+// with their chapter or section title, or numbered, and by its see and see
+// also references.
+func (r *renderer) indexBody(title string) string {
+	filename := r.chapter.file
+	opts := r.chapter.index
+	coll := newCollator(r.language)
+
+	root := &indexTerm{byName: map[string]*indexTerm{}}
+	for _, e := range r.indexes[r.chapter.indexName] {
+		t := root
+		for _, name := range indexPath(e.canonical) {
+			t = t.child(name, coll)
+		}
+		switch {
+		case t == root:
+		case e.xref == "":
+			t.entries = append(t.entries, e)
+		case e.also:
+			t.seeAlso = append(t.seeAlso, e)
+		default:
+			t.see = append(t.see, e)
+		}
+	}
+	next := 0
+	root.sort(fmt.Sprintf("idxterm-%s-", sanitizeID(r.chapter.indexName)), &next)
+
+	type letterGroup struct {
+		letter string
+		id     string
+		terms  []*indexTerm
+	}
+	var groups []*letterGroup
+	for _, t := range root.children {
+		letter := coll.group(t.name)
+		if len(groups) == 0 || groups[len(groups)-1].letter != letter {
+			groups = append(groups, &letterGroup{letter: letter, id: fmt.Sprintf("idxgroup-%s-%d", sanitizeID(r.chapter.indexName), len(groups)+1)})
+		}
+		g := groups[len(groups)-1]
+		g.terms = append(g.terms, t)
+	}
+
+	indexHref := func(e indexEntry) string {
+		return r.format.href(e.chapter.fileName(), e.htmlID, filename)
+	}
+	et := r.format.epubType
+	primary, _, _ := strings.Cut(strings.ToLower(r.language), "-")
+	labels, ok := xrefLabels[primary]
+	if !ok {
+		labels = xrefLabels["en"]
+	}
+
+	// locators links every occurrence of t. Occurrences in the same chapter
+	// or section share its title: the first one is linked from the title,
+	// the others follow it numbered, as in "Chapter 6 (2, 3)".
+	locators := func(t *indexTerm) []string {
+		var links []string
+		var places []string
+		more := map[string][]string{} // place → links to its further occurrences
+		for i, e := range t.entries {
+			label, where := strconv.Itoa(i+1), e.htmlID
+			switch {
+			case opts.locators == "section" && e.section != nil:
+				label, where = r.plainInline(e.section.title), e.section.label
+			case opts.locators != "number":
+				label, where = r.plainInline(e.chapter.title), e.chapter.file
+			}
+			if seen, ok := more[where]; ok {
+				label = strconv.Itoa(len(seen) + 2)
+				more[where] = append(seen, fmt.Sprintf("<a%s href=\"%s\">%s</a>", et("index-locator"), indexHref(e), label))
+				continue
+			}
+			more[where] = nil
+			places = append(places, where)
+			links = append(links, fmt.Sprintf("<a%s href=\"%s\">%s</a>", et("index-locator"), indexHref(e), label))
+		}
+		for i, where := range places {
+			if len(more[where]) > 0 {
+				links[i] += " (" + strings.Join(more[where], ", ") + ")"
+			}
+		}
+		return links
+	}
+
+	// xrefs links the targets of cross-references of one kind.
+	xrefs := func(word, epubType string, refs []indexEntry) string {
+		var links []string
+		for _, e := range refs {
+			target := root
+			for _, name := range indexPath(e.xref) {
+				if target = target.byName[name]; target == nil {
+					break
+				}
+			}
+			text := escapeText(strings.Join(indexPath(e.xref), ", "))
+			if target == nil || target == root {
+				r.warnAt(e.pos, "index cross-reference from %q to unknown term %q", e.canonical, e.xref)
+				links = append(links, text)
+				continue
+			}
+			links = append(links, fmt.Sprintf("<a%s href=\"%s\">%s</a>", et(epubType), r.format.href(filename, target.id, filename), text))
+		}
+		return "<i>" + word + "</i> " + strings.Join(links, "; ")
+	}
+
+	// writeTerms writes terms and their sub-terms; the top level, the
+	// canonical terms, has the class index-canonical.
+	var writeTerms func(body *strings.Builder, terms []*indexTerm, indent string)
+	writeTerms = func(body *strings.Builder, terms []*indexTerm, indent string) {
+		class := ""
+		if indent == "  " {
+			class = ` class="index-canonical"`
+		}
+		for _, t := range terms {
+			var parts []string
+			if links := locators(t); len(links) > 0 {
+				parts = append(parts, strings.Join(links, ", "))
+			}
+			if len(t.see) > 0 {
+				parts = append(parts, xrefs(labels[0], "index-xref-preferred", t.see))
+			}
+			if len(t.seeAlso) > 0 {
+				parts = append(parts, xrefs(labels[1], "index-xref-related", t.seeAlso))
+			}
+			body.WriteString(fmt.Sprintf("%s<li%s id=\"%s\"><span%s%s>%s</span>", indent, et("index-entry"), t.id, et("index-term"), class, escapeText(t.name)))
+			if len(parts) > 0 {
+				body.WriteString(" " + strings.Join(parts, "; "))
+			}
+			if len(t.children) > 0 {
+				body.WriteString(fmt.Sprintf("\n%s  <ul%s>\n", indent, et("index-entry-list")))
+				writeTerms(body, t.children, indent+"    ")
+				body.WriteString(indent + "  </ul>\n" + indent)
+			}
+			body.WriteString("</li>\n")
+		}
+	}
+
+	section := r.format.element("section")
+	var body strings.Builder
+	body.WriteString(fmt.Sprintf("<%s%s class=\"index\">\n<h1 id=\"%s\">%s</h1>\n", section, et("index"), labelFor(1, r.chapter.number), title))
+	if opts.jumpBar {
+		var letters []string
+		for _, g := range groups {
+			letters = append(letters, fmt.Sprintf("<a href=\"%s\">%s</a>", r.format.href(filename, g.id, filename), escapeText(g.letter)))
+		}
+		body.WriteString("<p class=\"index-jumpbar\">" + strings.Join(letters, " ") + "</p>\n")
+	}
+	for _, g := range groups {
+		body.WriteString(fmt.Sprintf("<%s%s class=\"index-group\" id=\"%s\">\n<h2 class=\"index-letter\">%s</h2>\n<ul%s class=\"index-list\">\n",
+			section, et("index-group"), g.id, escapeText(g.letter), et("index-entry-list")))
+		writeTerms(&body, g.terms, "  ")
+		body.WriteString("</ul>\n</" + section + ">\n")
+	}
+	body.WriteString("</" + section + ">\n")
+	return body.String()
+}
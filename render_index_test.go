@@ -0,0 +1,114 @@
+package spell
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestIndexPath(t *testing.T) {
+	tests := []struct {
+		canonical string
+		want      []string
+	}{
+		{"lantern", []string{"lantern"}},
+		{"lantern > oil", []string{"lantern", "oil"}},
+		{" lantern>oil > wick ", []string{"lantern", "oil", "wick"}},
+		{"lantern >> oil", []string{"lantern", "oil"}},
+		{">", nil},
+	}
+	for _, tt := range tests {
+		if got := indexPath(tt.canonical); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("indexPath(%q) = %q, want %q", tt.canonical, got, tt.want)
+		}
+	}
+}
+
+func TestParseIndexMarkup(t *testing.T) {
+	var diags bytes.Buffer
+	ctx := newTestContext(nil, &diags)
+	nodes := ctx.parseInline("%[oil lamp](Inv|lantern > oil) %see[lamp](Inv|lantern) %seealso[wick](Inv|lantern > oil)", sourcePos{file: "main.md", line: 3, col: 1})
+	var got []string
+	for _, n := range nodes {
+		switch n := n.(type) {
+		case *indexTermNode:
+			got = append(got, "term "+n.index+"|"+n.canonical+"|"+inlineText(n.children))
+		case *indexXrefNode:
+			got = append(got, "xref "+n.index+"|"+n.term+"|"+n.target+"|"+strings.Repeat("also", btoi(n.also))+"|"+n.pos.String())
+		}
+	}
+	want := []string{
+		"term Inv|lantern > oil|oil lamp",
+		"xref Inv|lamp|lantern||main.md:3:32",
+		"xref Inv|wick|lantern > oil|also|main.md:3:56",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got  %q\nwant %q", got, want)
+	}
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestIndexSubTermsAndCrossReferences(t *testing.T) {
+	md := "# One\n\nThe %[everlight](Inv|lantern > everlight) and the %[oil lamp](Inv|lantern > oil), a %[lantern](Inv).\n" +
+		"%see[lamp](Inv|lantern) %seealso[lantern > oil](Inv|fuel) %seealso[lantern](Inv|fuel)\n\n" +
+		"%[fuel](Inv) %see[ghost](Inv|phantom)\n\n%index[Inv](Index)\n"
+	c := convertMarkdown(t, md)
+	chapter, index := c.book.chapters[0].content, c.book.chapters[1].content
+	if strings.Contains(chapter, "see") || strings.Contains(chapter, "ghost") || strings.Contains(chapter, "phantom") {
+		t.Errorf("cross-references show in the text:\n%s", chapter)
+	}
+	for _, want := range []string{
+		// The sub-terms are nested below their canonical term, in order.
+		`class="index-canonical">lantern</span> <a epub:type="index-locator" href="../xhtml/chapter_00001.xhtml#idx-inv-lantern-0">One</a>; ` +
+			`<i>see also</i> <a epub:type="index-xref-related" href="#idxterm-inv-`,
+		`<span epub:type="index-term">everlight</span> <a epub:type="index-locator"`,
+		`<span epub:type="index-term">oil</span> <a epub:type="index-locator" href="../xhtml/chapter_00001.xhtml#idx-inv-lantern---oil-0">One</a>; <i>see also</i>`,
+		// A term with only a cross-reference is listed without locators.
+		`class="index-canonical">lamp</span> <i>see</i> <a epub:type="index-xref-preferred" href="#idxterm-inv-`,
+		// An unknown target is written as text.
+		`class="index-canonical">ghost</span> <i>see</i> phantom</li>`,
+	} {
+		if !strings.Contains(index, want) {
+			t.Errorf("missing %s in\n%s", want, index)
+		}
+	}
+	if strings.Index(index, ">everlight<") > strings.Index(index, ">oil<") {
+		t.Errorf("sub-terms not sorted:\n%s", index)
+	}
+	if want := `main.md:6:14: warning: index cross-reference from "ghost" to unknown term "phantom"`; !strings.Contains(c.diags, want) {
+		t.Errorf("missing %q in\n%s", want, c.diags)
+	}
+}
+
+func TestIndexCrossReferenceLabels(t *testing.T) {
+	md := "$[language](de)\n\n# Eins\n\n%[Öl](Inv) %[Lampe](Inv) %see[Petroleum](Inv|Öl) %seealso[Öl](Inv|Lampe)\n\n%index[Inv](Index)\n"
+	index := convertMarkdown(t, md).book.chapters[1].content
+	for _, want := range []string{"<i>siehe</i> <a", "<i>siehe auch</i> <a"} {
+		if !strings.Contains(index, want) {
+			t.Errorf("missing %s in\n%s", want, index)
+		}
+	}
+}
+
+func TestIndexEPUB2(t *testing.T) {
+	md := "# One\n\n%[everlight](Inv|lantern > everlight) %see[lamp](Inv|lantern)\n\n%index[Inv](Index)\n"
+	c := convertAs(t, epubFormat{epub2: true}, md)
+	body := c.book.body()
+	for _, banned := range []string{"epub:type", "<section", "</section"} {
+		if strings.Contains(body, banned) {
+			t.Errorf("EPUB 2 index contains %s:\n%s", banned, body)
+		}
+	}
+	for _, want := range []string{`<div class="index">`, `<div class="index-group" id="idxgroup-inv-1">`, "</div>\n</div>\n"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("missing %s in\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package spell
+
+import (
+	"fmt"
+	"strings"
+)
+
+// renderTable writes a pipe table. Alignment is set with the align-* classes
+// of the default stylesheet rather than style attributes, which KF8 drops.
+func (r *renderer) renderTable(t *tableNode) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "<table id=\"%s\" class=\"table\">\n", t.id)
+	if t.caption != nil {
+		fmt.Fprintf(&b, "<caption>%s</caption>\n", r.renderInline(t.caption))
+	}
+	if t.header != nil {
+		b.WriteString("<thead>\n")
+		r.tableRow(&b, "th", t.align, t.header)
+		b.WriteString("</thead>\n")
+	}
+	if len(t.rows) > 0 {
+		b.WriteString("<tbody>\n")
+		for _, row := range t.rows {
+			r.tableRow(&b, "td", t.align, row)
+		}
+		b.WriteString("</tbody>\n")
+	}
+	b.WriteString("</table>\n")
+	r.content.WriteString(b.String())
+}
+
+func (r *renderer) tableRow(b *strings.Builder, cell string, align []string, row [][]inline) {
+	b.WriteString("<tr>")
+	for i, content := range row {
+		if i < len(align) && align[i] != "" {
+			fmt.Fprintf(b, "<%s class=\"align-%s\">%s</%s>", cell, align[i], r.renderInline(content), cell)
+		} else {
+			fmt.Fprintf(b, "<%s>%s</%s>", cell, r.renderInline(content), cell)
+		}
+	}
+	b.WriteString("</tr>\n")
+}
@@ -1,162 +1,172 @@
-package main
+// Package spell converts enhanced markdown into EPUB2, EPUB3 and AZW3 ebooks.
+//
+// The simplest entry point is Convert, which reads markdown from an
+// io.Reader and writes the finished ebook to an io.Writer. Converter and the
+// SpellBook implementations returned by NewEpubBook and NewAZW3Book give
+// finer control, e.g. to add content to a book before writing it.
+package spell
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
-	"path/filepath"
-	"regexp"
+	"sort"
 	"strings"
-
-	"github.com/behringer24/argumentative"
 )
 
+// Output formats understood by Convert.
 const (
-	title       = "spell"
-	description = "Smart Processing and Enhanced Lightweight Layout. Command line parser for converting enhanced markdown to epub."
-	version     = "v1.7.0"
+	FormatEPUB2 = "epub2"
+	FormatEPUB3 = "epub3"
+	FormatAZW3  = "azw3"
 )
 
-var (
-	inFileName    *string
-	outFileName   *string
-	outputFormat  *string
-	generateCover *bool
-	customCSS     *string
-	showHelp      *bool
-	showVer       *bool
-	verboseFlag   *bool
-)
+// Options configures a call to Convert.
+type Options struct {
+	Format  string   // FormatEPUB2, FormatEPUB3 or FormatAZW3; empty means FormatEPUB3
+	CSS     []string // custom stylesheet files, added after the default stylesheet
+	Cover   bool     // generate a cover page for ![cover](...)
+	Verbose bool     // also log LogVerbose messages
+	Strict  bool     // treat warnings as errors and write nothing if there are any
 
-const (
-	LogDefault = iota
-	LogVerbose
-)
+	// HighlightTheme styles highlighted code, see Converter.HighlightTheme.
+	HighlightTheme string
 
-func logMsg(level int, format string, args ...any) {
-	if level == LogDefault || *verboseFlag {
-		log.Printf(format, args...)
-	}
+	// SmartQuotes converts straight quotes, see Converter.SmartQuotes.
+	SmartQuotes bool
+
+	// Hyphenate and MinHyphenLength add soft hyphens, see
+	// Converter.Hyphenate.
+	Hyphenate       bool
+	MinHyphenLength int
+
+	// BaseDir is the directory includes, images and the cover are resolved
+	// against, i.e. the directory of the markdown input. Empty means ".".
+	BaseDir string
+
+	// FS, when set, is used instead of the local file system for every file
+	// the markdown or CSS refers to. BaseDir and CSS are paths within FS.
+	FS fs.FS
+
+	// Logger receives all log messages; nil uses the standard logger.
+	Logger *log.Logger
+
+	// Name is the name of the input in diagnostics, usually its path.
+	// Empty means "<input>".
+	Name string
+
+	// Commands are custom commands, see Converter.Register.
+	Commands []Command
 }
 
-// Function for reading a file
-func readFile(filename string) (string, error) {
-	data, err := os.ReadFile(filename)
-	if err != nil {
-		return "", err
+// NewBook returns an empty SpellBook for the given output format.
+func NewBook(format string) (SpellBook, error) {
+	switch format {
+	case FormatEPUB2:
+		return NewEpubBook(2.0), nil
+	case FormatEPUB3, "":
+		return NewEpubBook(3.0), nil
+	case FormatAZW3:
+		return NewAZW3Book(), nil
 	}
-	return string(data), nil
+	return nil, fmt.Errorf("format must be %s, %s, or %s, got %q", FormatEPUB2, FormatEPUB3, FormatAZW3, format)
 }
 
-// Replace all includes of md files using markdown syntax for images like
-// ![include](uri/uri.md "text") or
-// ![include](uri/uri.md)
-// text is optional and ignored, you can use it as internal reference
-func replaceAllIncludes(content string, baseDir string) string {
-	commandRegex := regexp.MustCompile(`\!\[include\]\(([^ \)]+)\s*(\"([^\"]*)\")?\)`)
-	return commandRegex.ReplaceAllStringFunc(content, func(match string) string {
-		// Extract includes and parameters
-		matches := commandRegex.FindStringSubmatch(match)
-		if len(matches) < 2 && strings.Compare(filepath.Ext(matches[2]), ".md") != 0 {
-			logMsg(LogDefault, "Error including %s with URI %s", matches[0], matches[1])
-			return match // Fallback: if the pattern is wrong or not an md file
-		}
-
-		includeContent, err := readFile(filepath.Join(baseDir, matches[1]))
-		if err != nil {
-			logMsg(LogDefault, "Error including %s with URI %s: %v", matches[0], matches[1], err)
-			return match
-		}
-
-		logMsg(LogVerbose, "Including markdown file %s (%s)", matches[1], matches[3])
-		return includeContent
-	})
+// HighlightThemes returns the names of the themes for highlighted code.
+func HighlightThemes() []string {
+	themes := make([]string, 0, len(highlightThemes))
+	for name := range highlightThemes {
+		themes = append(themes, name)
+	}
+	sort.Strings(themes)
+	return themes
 }
 
-// Process Markdown file
-func processMarkdownFile(book SpellBook, filePath string, customCSSFile string) error {
-	// Read markdown file
-	content, err := readFile(filePath)
+// Convert reads enhanced markdown from r, renders it as configured by opts
+// and writes the resulting ebook to w.
+//
+// If errors were reported, Convert returns a *BuildError counting them; the
+// book is still written, without what failed, unless opts.Strict is set. A
+// book that cannot be written to w is counted as a write error. Any other
+// error means nothing was written.
+func Convert(r io.Reader, opts Options, w io.Writer) error {
+	book, err := NewBook(opts.Format)
 	if err != nil {
 		return err
 	}
+	if _, ok := highlightThemes[opts.HighlightTheme]; !ok && opts.HighlightTheme != "" {
+		return fmt.Errorf("highlight theme must be %s, got %q", strings.Join(HighlightThemes(), ", "), opts.HighlightTheme)
+	}
 
-	// Replace all includes
-	baseDir := filepath.Dir(filePath)
-	content = replaceAllIncludes(content, baseDir)
-
-	// Parse markdown
-	err = parseMarkdown(book, content, baseDir, customCSSFile)
+	content, err := io.ReadAll(r)
 	if err != nil {
 		return err
 	}
 
-	return nil
-}
-
-// Parse command line parameters
-func parseArgs() {
-	flags := &argumentative.Flags{}
-	showHelp = flags.Flags().AddBool("help", "h", "Show this help text")
-	showVer = flags.Flags().AddBool("version", "v", "Show version information")
-	generateCover = flags.Flags().AddBool("cover", "c", "Generate cover page. This is normally not recommended")
-	outputFormat = flags.Flags().AddString("format", "f", false, "epub3", "Output format: epub2, epub3, or azw3")
-	customCSS = flags.Flags().AddString("style", "s", false, "", "Comma-separated list of CSS files to include")
-	verboseFlag = flags.Flags().AddBool("verbose", "V", "Enable verbose logging")
-	inFileName = flags.Flags().AddPositional("infile", true, "", "File to read from")
-	outFileName = flags.Flags().AddPositional("outfile", false, "", "File to write to (default: ./ebook.epub or ./ebook.azw3)")
-
-	err := flags.Parse(os.Args)
-	if *showHelp {
-		flags.Usage(title, description, nil)
-		os.Exit(0)
-	} else if *showVer {
-		fmt.Print(strings.ToUpper(title), " version: ", version)
-		os.Exit(0)
-	} else if *outputFormat != "epub2" && *outputFormat != "epub3" && *outputFormat != "azw3" {
-		fmt.Print("Error: format must be epub2, epub3, or azw3")
-		os.Exit(1)
-	} else if err != nil {
-		flags.Usage(title, description, err)
-		os.Exit(1)
+	baseDir := opts.BaseDir
+	if baseDir == "" {
+		baseDir = "."
 	}
-}
-
-func main() {
-	// Use argumentative as command line parser
-	parseArgs()
-
-	// Apply default output filename based on format when not specified
-	if *outFileName == "" {
-		if *outputFormat == "azw3" {
-			*outFileName = "./ebook.azw3"
-		} else {
-			*outFileName = "./ebook.epub"
+	conv := &Converter{
+		GenerateCover:   opts.Cover,
+		Verbose:         opts.Verbose,
+		Logger:          opts.Logger,
+		Strict:          opts.Strict,
+		HighlightTheme:  opts.HighlightTheme,
+		SmartQuotes:     opts.SmartQuotes,
+		Hyphenate:       opts.Hyphenate,
+		MinHyphenLength: opts.MinHyphenLength,
+		FS:              opts.FS,
+	}
+	for _, cmd := range opts.Commands {
+		if err := conv.Register(cmd); err != nil {
+			return err
 		}
 	}
+	err = conv.convertSource(book, string(content), opts.Name, baseDir, opts.CSS)
+	var buildErr *BuildError
+	if err != nil && (!errors.As(err, &buildErr) || opts.Strict) {
+		return err
+	}
 
-	// Create the book for the requested output format
-	var book SpellBook
-	switch *outputFormat {
-	case "epub2":
-		book = newEpubBook(2.0)
-	case "epub3":
-		book = newEpubBook(3.0)
-	case "azw3":
-		book = newAZW3Book()
+	if err := writeBook(book, w); err != nil {
+		conv.diag(sourcePos{}, "error", "writing book: %v", err)
+		if buildErr == nil {
+			buildErr = &BuildError{}
+		}
+		buildErr.Errors++
+		buildErr.WriteErrors++
+		return buildErr
+	}
+	if buildErr != nil {
+		buildErr.Written = true
+		return buildErr
 	}
+	return nil
+}
 
-	// Process input file
-	err := processMarkdownFile(book, *inFileName, *customCSS)
+// writeBook writes book to w. The book writers only write to named files, so
+// the book is written to a temporary file first and then copied.
+func writeBook(book SpellBook, w io.Writer) error {
+	tmp, err := os.CreateTemp("", "spell-*")
 	if err != nil {
-		log.Fatalf("Error processing file '%s': %v", *inFileName, err)
+		return err
 	}
+	tmpName := tmp.Name()
+	tmp.Close()
+	defer os.Remove(tmpName)
 
-	// Write output
-	err = book.Write(*outFileName)
+	if err := book.Write(tmpName); err != nil {
+		return err
+	}
+	f, err := os.Open(tmpName)
 	if err != nil {
-		log.Fatalf("Error writing file '%s': %v", *outFileName, err)
+		return err
 	}
-
-	fmt.Printf("File '%s' created successfully!\n", *outFileName)
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
 }
@@ -1,4 +1,9 @@
-package main
+package spell
+
+import (
+	"fmt"
+	"strings"
+)
 
 const defaultCSS = `/* Default spell CSS */
 h1, h2, h3, h4, h5, h6 {
@@ -29,6 +34,9 @@ p, li {
 	margin-top: 0.3em;
     margin-bottom: 0.3em;
 }
+div.pagebreak {
+	page-break-after: always;
+}
 hr {
 	border: 1px solid #444;
 	height: 2px;
@@ -92,18 +100,102 @@ blockquote.warn::before {
 	left: -0.8em;
   	z-index: 1;
 }
-blockquote.code {
-	font-family: monospace, monospace;
-	background-color: #ccc;
-	border-radius: 0.5em;
-	text-align: left;
-}
 span.code {
 	font-family: monospace, monospace;
 	background-color: #aaa;
 	border-radius: 2px;
 	padding: 0.1em;
 }
+table {
+	border-collapse: collapse;
+	margin: 1em auto;
+	page-break-inside: avoid;
+}
+.figure {
+	margin: 1em 0;
+	text-align: center;
+	page-break-inside: avoid;
+}
+.figure img {
+	max-width: 100%;
+}
+.figcaption {
+	font-style: italic;
+	padding: 0.3em;
+}
+span.figure-number {
+	font-style: normal;
+	font-weight: bold;
+}
+img.img-icon {
+	height: 1em;
+	width: auto;
+	vertical-align: middle;
+}
+.img-sized img {
+	width: 100%;
+}
+.img-left {
+	display: block;
+	margin-left: 0;
+	margin-right: auto;
+	text-align: left;
+}
+.img-center {
+	display: block;
+	margin-left: auto;
+	margin-right: auto;
+	text-align: center;
+}
+.img-right {
+	display: block;
+	margin-left: auto;
+	margin-right: 0;
+	text-align: right;
+}
+.img-float-left {
+	float: left;
+	margin: 0.3em 1em 0.3em 0;
+}
+.img-float-right {
+	float: right;
+	margin: 0.3em 0 0.3em 1em;
+}
+.img-page {
+	page-break-before: always;
+	page-break-after: always;
+	margin: 0;
+	text-align: center;
+}
+.img-page img {
+	max-width: 100%;
+	max-height: 100%;
+}
+ul.figure-list, ul.table-list {
+	list-style: none;
+	padding-left: 0;
+}
+table caption {
+	font-style: italic;
+	padding: 0.3em;
+}
+th, td {
+	border: 1px solid #888;
+	padding: 0.2em 0.5em;
+	vertical-align: top;
+}
+th {
+	background-color: #ddd;
+}
+th.align-left, td.align-left {
+	text-align: left;
+}
+th.align-center, td.align-center {
+	text-align: center;
+}
+th.align-right, td.align-right {
+	text-align: right;
+}
 span.index-entry {
 	font-style: italic;
 }
@@ -114,21 +206,175 @@ ul.index-list {
 ul.index-list li {
 	margin: 0.2em 0;
 }
-ul.index-list li ul {
-	display: inline;
+ul.index-list ul {
 	list-style: none;
-	padding-left: 0;
+	padding-left: 1.5em;
+}
+p.index-jumpbar {
+	text-align: center;
+	text-indent: 0;
+}
+p.index-jumpbar a {
+	padding: 0 0.3em;
 }
-ul.index-list li ul li {
-	display: inline;
-	margin-left: 0.3em;
+h2.index-letter {
+	margin: 1em 0 0.3em 0;
 }
-ul.index-list li ul li a {
-	padding: 0.4em 0.5em;
+h2.endnotes-chapter {
+	font-size: 1.1em;
+	margin: 1.5em 0 0.5em 0;
+}
+h2.endnotes-chapter a {
+	text-decoration: none;
+}
+pre.code {
+	font-family: monospace, monospace;
+	font-size: 85%;
+	text-align: left;
+	white-space: pre;
+	margin: 1em 0;
+	padding: 0.5em;
+	page-break-inside: avoid;
+}
+pre.code.wrap {
+	white-space: pre-wrap;
+	word-wrap: break-word;
+}
+pre.code span.ln {
+	color: #888;
+}
+div.code-title {
+	font-family: monospace, monospace;
+	font-size: 85%;
+	font-weight: bold;
+	margin-top: 1em;
+	page-break-after: avoid;
+}
+div.code-title + pre.code {
+	margin-top: 0.2em;
 }
 `
 
-func addDefaultTemplate(book SpellBook) {
-	book.AddStylesheet("css/_spellDefault.css", defaultCSS)
-	logMsg(LogVerbose, "Added default stylesheet css/_spellDefault.css")
+// highlightThemes are the selectable styles of the highlighted code.
+var highlightThemes = map[string]string{
+	"light": `pre.code {
+	background-color: #f4f4f4;
+	color: #222;
+	border-radius: 0.3em;
+}
+pre.code span.kw {
+	color: #00279e;
+	font-weight: bold;
+}
+pre.code span.typ {
+	color: #7a1486;
+}
+pre.code span.str {
+	color: #0b6e1c;
+}
+pre.code span.num {
+	color: #1750eb;
+}
+pre.code span.com {
+	color: #777;
+	font-style: italic;
+}
+pre.code span.hll {
+	background-color: #fff3a8;
+}
+`,
+	"dark": `pre.code {
+	background-color: #282c34;
+	color: #dcdfe4;
+	border-radius: 0.3em;
+}
+pre.code span.kw {
+	color: #c678dd;
+	font-weight: bold;
+}
+pre.code span.typ {
+	color: #61afef;
+}
+pre.code span.str {
+	color: #98c379;
+}
+pre.code span.num {
+	color: #d19a66;
+}
+pre.code span.com {
+	color: #7f848e;
+	font-style: italic;
+}
+pre.code span.ln {
+	color: #636d83;
+}
+pre.code span.hll {
+	background-color: #3e4451;
+}
+`,
+	// eink does without colors, which grayscale screens turn into hard to
+	// tell apart grays.
+	"eink": `pre.code {
+	border: 1px solid #000;
+	border-width: 1px 0;
+}
+pre.code span.kw {
+	font-weight: bold;
+}
+pre.code span.com {
+	font-style: italic;
+}
+pre.code span.hll {
+	background-color: #ddd;
+}
+`,
+	"none": "",
+}
+
+// defaultHighlightTheme is used if no theme is given: colors for EPUB, no
+// colors for AZW3, which is mostly read on e-ink devices.
+func defaultHighlightTheme(format outputFormat) string {
+	if _, isAZW3 := format.(azw3Format); isAZW3 {
+		return "eink"
+	}
+	return "light"
+}
+
+// highlightStylesheet is the path of the stylesheet of the highlight theme.
+const highlightStylesheet = "css/_spellHighlight.css"
+
+// addHighlightStylesheet adds the stylesheet of the highlight theme, once
+// the first block of highlighted code is rendered. It reports whether there
+// is one: the theme none has no stylesheet.
+func addHighlightStylesheet(ctx *parseContext) bool {
+	theme := ctx.HighlightTheme
+	if theme == "" {
+		theme = defaultHighlightTheme(ctx.format)
+	}
+	themeCSS, ok := highlightThemes[theme]
+	if !ok {
+		ctx.errorAt(sourcePos{}, problemParse, "unknown highlight theme %q", theme)
+		return false
+	}
+	if themeCSS == "" {
+		return false
+	}
+	ctx.book.AddStylesheet(highlightStylesheet, "/* Spell code highlighting */\n"+themeCSS)
+	ctx.logMsg(LogVerbose, "Added highlight stylesheet %s (%s)", highlightStylesheet, theme)
+	return true
+}
+
+func addDefaultTemplate(ctx *parseContext) {
+	ctx.book.AddStylesheet("css/_spellDefault.css", defaultCSS+imageWidthCSS())
+	ctx.logMsg(LogVerbose, "Added default stylesheet css/_spellDefault.css")
+}
+
+// imageWidthCSS returns the img-w5 to img-w100 classes that set the width
+// of an image, see imageAttrs.classes.
+func imageWidthCSS() string {
+	var b strings.Builder
+	for w := 5; w <= 100; w += 5 {
+		fmt.Fprintf(&b, ".img-w%d {\n\twidth: %d%%;\n}\n", w, w)
+	}
+	return b.String()
 }
@@ -0,0 +1,247 @@
+package spell
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// typographyRule is a locale rule applied to running text before the dashes
+// and dots of typography(). It is on for the book languages listed;
+// $[typography](-name) turns it off and $[typography](name) on.
+type typographyRule struct {
+	name      string
+	languages []string
+	apply     func(string) string
+}
+
+var typographyRules = []typographyRule{
+	{"punctuation-spacing", []string{"fr"}, spacePunctuation},
+	{"guillemet-spacing", []string{"fr"}, spaceGuillemets},
+	{"spaced-dashes", []string{"de"}, spacedEnDashes},
+	{"abbreviations", []string{"de"}, bindAbbreviations},
+	// Units are opt-in: symbols like A, t or m are words, too, as in "1 A.D.".
+	{"units", nil, bindUnits},
+}
+
+// Character references of the spaces the rules insert.
+const (
+	noBreakSpace       = "&#160;"
+	narrowNoBreakSpace = "&#8239;"
+)
+
+var (
+	reReference    = regexp.MustCompile(`&(?:#[0-9]+|#[xX][0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+	reGermanDash   = regexp.MustCompile(`\s+-{1,3}\s+`)
+	reAbbreviation = regexp.MustCompile(`(^|[^\pL])(\pL\.)[ \t]+(\pL{1,2}\.)`)
+	reUnit         = regexp.MustCompile(`(\d)[ \t]+(` + unitPattern() + `)([^\pL\pN]|$)`)
+)
+
+// units are the unit symbols bound to the number before them.
+var units = []string{
+	"nm", "µm", "mm", "cm", "dm", "m", "km", "m²", "km²", "m³", "mi", "ft",
+	"mg", "g", "kg", "t", "lb", "oz", "ml", "cl", "dl", "l",
+	"ms", "s", "min", "h", "km/h", "mph", "Hz", "kHz", "MHz", "GHz",
+	"B", "kB", "KB", "MB", "GB", "TB", "W", "kW", "MW", "V", "mV", "A", "mA", "Ω",
+	"°C", "°F", "°", "K", "%", "‰", "€", "$", "£", "px", "pt",
+}
+
+// unitPattern returns the alternation of units, longest first, so that km
+// is not taken for k followed by m.
+func unitPattern() string {
+	quoted := make([]string, len(units))
+	for i, u := range units {
+		quoted[i] = regexp.QuoteMeta(u)
+	}
+	sort.SliceStable(quoted, func(i, j int) bool { return len(quoted[i]) > len(quoted[j]) })
+	return strings.Join(quoted, "|")
+}
+
+// typographyRuleNames returns the names of the locale typography rules.
+func typographyRuleNames() []string {
+	names := make([]string, len(typographyRules))
+	for i, rule := range typographyRules {
+		names[i] = rule.name
+	}
+	return names
+}
+
+// setTypography applies a $[typography] line: a comma-separated list of
+// rule names, each prefixed with - to turn it off.
+func (r *renderer) setTypography(m *metaNode) {
+	for _, name := range strings.Split(m.value, ",") {
+		name = strings.TrimSpace(name)
+		on := !strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		if name == "" {
+			continue
+		}
+		if !knownTypographyRule(name) {
+			r.warnAt(m.pos, "unknown typography rule %q, expected one of %s", name, strings.Join(typographyRuleNames(), ", "))
+			continue
+		}
+		r.typographyOverrides[name] = on
+	}
+}
+
+func knownTypographyRule(name string) bool {
+	for _, rule := range typographyRules {
+		if rule.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// typographyRule reports whether the rule name applies to the book.
+func (r *renderer) typographyRule(name string) bool {
+	if on, ok := r.typographyOverrides[name]; ok {
+		return on
+	}
+	primary, _, _ := strings.Cut(strings.ToLower(r.language), "-")
+	for _, rule := range typographyRules {
+		if rule.name == name {
+			for _, lang := range rule.languages {
+				if lang == primary {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// typography applies the locale rules of the book to the text s, then the
+// dashes and dots. HTML written by the author only gets the latter.
+func (r *renderer) typography(s string) string {
+	if !r.raw {
+		for _, rule := range typographyRules {
+			if r.typographyRule(rule.name) {
+				s = outsideReferences(s, rule.apply)
+			}
+		}
+	}
+	return typography(s)
+}
+
+// outsideReferences applies f to the parts of s between character
+// references, so that the rules never see the ; of &#160;.
+func outsideReferences(s string, f func(string) string) string {
+	refs := reReference.FindAllStringIndex(s, -1)
+	if refs == nil {
+		return f(s)
+	}
+	var b strings.Builder
+	last := 0
+	for _, ref := range refs {
+		b.WriteString(f(s[last:ref[0]]))
+		b.WriteString(s[ref[0]:ref[1]])
+		last = ref[1]
+	}
+	b.WriteString(f(s[last:]))
+	return b.String()
+}
+
+// spacePunctuation puts a narrow no-break space before ; : ! and ?, as
+// French does. The colons of URLs and times are left alone.
+func spacePunctuation(s string) string {
+	var b []byte
+	spaces := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			spaces = true
+			b = append(b, c)
+			continue
+		case strings.IndexByte(";:!?", c) >= 0:
+			next := byte(0)
+			if i+1 < len(s) {
+				next = s[i+1]
+			}
+			colon := c == ':' && (next == '/' || isDigit(next) && i > 0 && isDigit(s[i-1]))
+			trimmed := strings.TrimRight(string(b), " \t")
+			if !colon && (spaces || trimmed != "" && strings.IndexByte(";:!?", trimmed[len(trimmed)-1]) < 0) {
+				b = append([]byte(trimmed), narrowNoBreakSpace...)
+			}
+		}
+		spaces = false
+		b = append(b, c)
+	}
+	return string(b)
+}
+
+var guillemetSpacer = strings.NewReplacer("« ", "«"+narrowNoBreakSpace, " »", narrowNoBreakSpace+"»", "«", "«"+narrowNoBreakSpace, "»", narrowNoBreakSpace+"»")
+
+// spaceGuillemets puts narrow no-break spaces inside guillemets written in
+// the text, replacing a space that is already there.
+func spaceGuillemets(s string) string {
+	return guillemetSpacer.Replace(s)
+}
+
+// spacedEnDashes turns a dash between spaces, - or -- or ---, into the spaced
+// en dash German uses.
+func spacedEnDashes(s string) string {
+	return reGermanDash.ReplaceAllString(s, noBreakSpace+"&#8211;"+noBreakSpace)
+}
+
+// bindAbbreviations keeps abbreviations like z. B. and i. d. R. on one line.
+func bindAbbreviations(s string) string {
+	for {
+		bound := reAbbreviation.ReplaceAllString(s, "$1$2"+noBreakSpace+"$3")
+		if bound == s {
+			return s
+		}
+		s = bound
+	}
+}
+
+// bindUnits keeps a number and its unit on one line.
+func bindUnits(s string) string {
+	for {
+		bound := reUnit.ReplaceAllString(s, "$1"+noBreakSpace+"$2$3")
+		if bound == s {
+			return s
+		}
+		s = bound
+	}
+}
+
+// quoteText returns what the quote node n is written as: the straight quote
+// if it is one of the text and smart quotes are off.
+func (r *renderer) quoteText(n *quoteNode) string {
+	if n.auto && (r.raw || !r.SmartQuotes) {
+		return strings.Trim(n.marker, "%")
+	}
+	return r.quote(n.marker)
+}
+
+// spacedText returns the text of nodes[i] with the spaces next to a spaced
+// guillemet quote node removed, as the narrow space takes their place.
+func (r *renderer) spacedText(nodes []inline, i int) string {
+	text := nodes[i].(*textNode).text
+	if r.raw || !r.typographyRule("guillemet-spacing") {
+		return text
+	}
+	if q, ok := prevNode(nodes, i).(*quoteNode); ok && r.quoteText(q) == "«" {
+		text = strings.TrimLeft(text, " \t")
+	}
+	if q, ok := nextNode(nodes, i).(*quoteNode); ok && r.quoteText(q) == "»" {
+		text = strings.TrimRight(text, " \t")
+	}
+	return text
+}
+
+func prevNode(nodes []inline, i int) inline {
+	if i > 0 {
+		return nodes[i-1]
+	}
+	return nil
+}
+
+func nextNode(nodes []inline, i int) inline {
+	if i+1 < len(nodes) {
+		return nodes[i+1]
+	}
+	return nil
+}
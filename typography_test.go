@@ -0,0 +1,71 @@
+package spell
+
+import (
+	"strings"
+	"testing"
+)
+
+// spaces shows the character references of the inserted spaces as _ for a
+// no-break space and ^ for a narrow one.
+var spaces = strings.NewReplacer(noBreakSpace, "_", narrowNoBreakSpace, "^")
+
+func TestTypographyRules(t *testing.T) {
+	tests := []struct {
+		rule func(string) string
+		in   string
+		want string
+	}{
+		{spacePunctuation, "Quoi ? Oui! Non ; si: non", "Quoi^? Oui^! Non^; si^: non"},
+		{spacePunctuation, "Vraiment ?!", "Vraiment^?!"},
+		{spacePunctuation, "https://example.com à 10:30", "https://example.com à 10:30"},
+		{spacePunctuation, "? au début", "? au début"},
+		{spaceGuillemets, "« Bonjour » et «salut»", "«^Bonjour^» et «^salut^»"},
+		{spacedEnDashes, "Er kam - und ging -- schnell --- weg", "Er kam_&#8211;_und ging_&#8211;_schnell_&#8211;_weg"},
+		{spacedEnDashes, "Berlin-Mitte und 3-4", "Berlin-Mitte und 3-4"},
+		{bindAbbreviations, "z. B. und i. d. R. oder d. h.", "z._B. und i._d._R. oder d._h."},
+		{bindAbbreviations, "Das ist es. Er ging.", "Das ist es. Er ging."},
+		{bindUnits, "5 km, 20 % und 3 m² bei 100 km/h", "5_km, 20_% und 3_m² bei 100_km/h"},
+		{bindUnits, "3 mm und 3 min", "3_mm und 3_min"},
+		{bindUnits, "3 kittens and 5 more", "3 kittens and 5 more"},
+		{bindUnits, "10 €, 5 °C", "10_€, 5_°C"},
+	}
+	for _, tt := range tests {
+		if got := spaces.Replace(tt.rule(tt.in)); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestTypographyByLanguage(t *testing.T) {
+	tests := []struct {
+		front, md, want string
+	}{
+		{"$[language](fr)\n", "Oui ! 5 km", "Oui^! 5 km"},
+		{"$[language](fr-CA)\n", "Oui !", "Oui^!"},
+		{"$[language](de)\n", "Ja - z. B. 5 km", "Ja_&#8211;_z._B. 5 km"},
+		{"$[language](en)\n", "Yes - 1 A.D. - e. g. Oui !", "Yes - 1 A.D. - e. g. Oui !"},
+		{"$[language](en)\n$[typography](units)\n", "5 km in 1 h", "5_km in 1_h"},
+		{"$[language](fr)\n$[typography](-punctuation-spacing)\n", "Oui !", "Oui !"},
+		{"$[language](en)\n$[typography](spaced-dashes, abbreviations)\n", "Yes - z. B.", "Yes_&#8211;_z._B."},
+	}
+	for _, tt := range tests {
+		got := paragraphs(t, &Converter{}, tt.front, tt.md)
+		if len(got) != 1 || spaces.Replace(got[0]) != tt.want {
+			t.Errorf("%s%s: got %q, want %q", tt.front, tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestTypographySkipsCodeAndReferences(t *testing.T) {
+	got := paragraphs(t, &Converter{}, "$[language](fr)\n", "Le code `a ? b` et &amp; !")
+	if want := `Le code <span class="code">a ? b</span> et &amp;^!`; len(got) != 1 || spaces.Replace(got[0]) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUnknownTypographyRule(t *testing.T) {
+	c := convertMarkdown(t, "$[typography](kerning)\n\n# One\n\ntext\n")
+	if want := `main.md:1:1: warning: unknown typography rule "kerning"`; !strings.Contains(c.diags, want) {
+		t.Errorf("missing %q in\n%s", want, c.diags)
+	}
+}